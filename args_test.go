@@ -2,12 +2,15 @@ package main
 
 import (
 	"fmt"
+	"github.com/aviddiviner/inc/backup"
+	"github.com/aviddiviner/inc/store"
 	"github.com/docopt/docopt-go"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func assertFlagError(t *testing.T, cmdline string) {
@@ -32,11 +35,18 @@ func assertParseSuccess(t *testing.T, cmdline string) options {
 
 // Just some random tests for a few command line argument combinations. Not exhaustive or thorough by any means.
 func TestArgs(t *testing.T) {
-	assertFlagError(t, "init")
-	assertFlagError(t, "init -f")
+	assertFlagError(t, "init --pass ABC --pass-file FILE")
+	assertFlagError(t, "init --pass-file")
 	assertFlagError(t, "backup")
 	assertFlagError(t, "restore")
 	assertFlagError(t, "restore foo/")
+	assertFlagError(t, "restore --snapshot ABC --as-of 2016-01-05 --dest DIR foo/")
+	assertFlagError(t, "diff latest")
+	assertFlagError(t, "diff latest --disk")
+	assertFlagError(t, "verify --as-of 2016-01-05")
+	assertFlagError(t, "pin")
+	assertFlagError(t, "key add --new-pass")
+	assertFlagError(t, "key passwd --pass OLD --new-pass-file")
 
 	args := assertFlagSuccess(t, "init --pass ABC")
 	assert.EqualValues(t, "~/.inc.cfg", args["--cfg"], "default config path")
@@ -96,7 +106,199 @@ func TestOpts(t *testing.T) {
 	assert.EqualValues(t, "/tmp/fs", opts.fsRootFolder)
 	assert.EqualValues(t, []string{os.Getenv("HOME")}, opts.includePaths)
 
+	opts = assertParseSuccess(t, "restore --snapshot 1426f9f4 --dest /tmp/restore ~/code")
+	assert.EqualValues(t, "restore", opts.command)
+	assert.EqualValues(t, "1426f9f4", opts.snapshotID)
+
+	opts = assertParseSuccess(t, "restore --as-of 2016-01-05 --dest /tmp/restore ~/code")
+	assert.EqualValues(t, time.Date(2016, 1, 5, 0, 0, 0, 0, time.Local), opts.asOf)
+
+	opts = assertParseSuccess(t, "snapshots --storage fs --fs-root /tmp/fs")
+	assert.EqualValues(t, "snapshots", opts.command)
+
+	opts = assertParseSuccess(t, "ls -l --snapshot 1426f9f4 ~/code")
+	assert.EqualValues(t, "ls", opts.command)
+	assert.EqualValues(t, true, opts.longListing)
+	assert.EqualValues(t, []string{filepath.Join(os.Getenv("HOME"), "code")}, opts.includePaths)
+
+	opts = assertParseSuccess(t, "find --name *.jpg --min-size 1.5M --max-size 2G --changed-in 1426f9f4")
+	assert.EqualValues(t, "find", opts.command)
+	assert.EqualValues(t, "*.jpg", opts.filter.Name)
+	assert.EqualValues(t, 1500000, opts.filter.MinSize)
+	assert.EqualValues(t, 2e9, opts.filter.MaxSize)
+	assert.EqualValues(t, "1426f9f4", opts.filter.Set)
+	assert.Empty(t, opts.includePaths)
+
+	opts = assertParseSuccess(t, "diff --json 1426f9f4 latest")
+	assert.EqualValues(t, "diff", opts.command)
+	assert.EqualValues(t, true, opts.jsonOutput)
+	assert.EqualValues(t, "1426f9f4", opts.diffFrom)
+	assert.EqualValues(t, "latest", opts.diffTo)
+
+	opts = assertParseSuccess(t, "diff latest --disk ~/code")
+	assert.EqualValues(t, "latest", opts.diffFrom)
+	assert.EqualValues(t, "", opts.diffTo)
+	assert.EqualValues(t, []string{filepath.Join(os.Getenv("HOME"), "code")}, opts.includePaths)
+
+	opts = assertParseSuccess(t, "verify --snapshot 1426f9f4 --sample 10")
+	assert.EqualValues(t, "verify", opts.command)
+	assert.EqualValues(t, "1426f9f4", opts.snapshotID)
+	assert.EqualValues(t, 10, opts.samplePercent)
+
+	opts = assertParseSuccess(t, "verify")
+	assert.EqualValues(t, 100, opts.samplePercent)
+
+	opts = assertParseSuccess(t, "prune --dry-run")
+	assert.EqualValues(t, "prune", opts.command)
+	assert.EqualValues(t, true, opts.dryRun)
+
+	opts = assertParseSuccess(t, "forget --keep-last 3 --keep-daily 7 --keep-within 2w --dry-run")
+	assert.EqualValues(t, "forget", opts.command)
+	assert.EqualValues(t, 3, opts.retention.Last)
+	assert.EqualValues(t, 7, opts.retention.Daily)
+	assert.EqualValues(t, 0, opts.retention.Weekly)
+	assert.EqualValues(t, 14*24*time.Hour, opts.retention.Within)
+	assert.EqualValues(t, true, opts.dryRun)
+
+	opts = assertParseSuccess(t, "unpin 1426f9f4")
+	assert.EqualValues(t, "unpin", opts.command)
+	assert.EqualValues(t, "1426f9f4", opts.snapshotID)
+
+	opts = assertParseSuccess(t, "restore --host laptop --set photos --dest DIR ~/pics")
+	assert.EqualValues(t, backup.Lineage{Host: "laptop", BackupSet: "photos"}, opts.lineage)
+	opts = assertParseSuccess(t, "backup --set photos ~/pics")
+	assert.EqualValues(t, "photos", backupLineage(opts).BackupSet)
+	assert.NotEmpty(t, backupLineage(opts).Host)
+
+	opts = assertParseSuccess(t, "key passwd --pass OLD --new-pass NEW")
+	assert.EqualValues(t, "key", opts.command)
+	assert.EqualValues(t, "passwd", opts.keyCommand)
+	assert.EqualValues(t, "NEW", opts.newSecret)
+	assert.EqualValues(t, true, needsNewPassword(opts))
+	opts = assertParseSuccess(t, "key add --label bob --new-pass-file ~/.inc.newpass")
+	assert.EqualValues(t, filepath.Join(os.Getenv("HOME"), ".inc.newpass"), opts.newPassFile)
+	assert.EqualValues(t, true, needsNewPassword(opts))
+	opts = assertParseSuccess(t, "key passwd --new-pass-command pass_show_new")
+	assert.EqualValues(t, "pass_show_new", opts.newPassCmd)
+	opts = assertParseSuccess(t, "key passwd --pass OLD") // asked for at the terminal
+	assert.EqualValues(t, "", opts.newSecret)
+	assert.EqualValues(t, true, needsNewPassword(opts))
+	assert.EqualValues(t, false, needsNewPassword(assertParseSuccess(t, "key list")))
+	assertFlagError(t, "key add --new-pass NEW --new-pass-file FILE")
+	opts = assertParseSuccess(t, "key remove 1a2b3c4d")
+	assert.EqualValues(t, "remove", opts.keyCommand)
+	assert.EqualValues(t, "1a2b3c4d", opts.keySlot)
+	assert.EqualValues(t, false, needsExclusiveLock(assertParseSuccess(t, "key list")))
+	opts = assertParseSuccess(t, "key upgrade-metadata --pass SECRET")
+	assert.EqualValues(t, "upgrade-metadata", opts.keyCommand)
+	assert.EqualValues(t, true, needsExclusiveLock(opts))
+	opts = assertParseSuccess(t, "key upgrade-kdf --pass SECRET")
+	assert.EqualValues(t, "upgrade-kdf", opts.keyCommand)
+	assert.EqualValues(t, true, needsExclusiveLock(opts))
+
+	opts = assertParseSuccess(t, "backup --pass SECRET --write-only ~/code")
+	assert.EqualValues(t, true, opts.writeOnly)
+	assert.EqualValues(t, true, allowsWriteOnly(opts))
+	assert.EqualValues(t, false, allowsWriteOnly(assertParseSuccess(t, "restore --dest DIR ~/code")))
+
+	opts = assertParseSuccess(t, "backup --compress zstd:19 ~/code")
+	assert.EqualValues(t, "zstd:19", opts.compression)
+	_, err := parseFlags(strings.Split("backup --compress lz4 ~/code", " "), false)
+	assert.Error(t, err)
+
+	opts = assertParseSuccess(t, "backup --retry-attempts 8 --retry-delay 2s ~/code")
+	assert.EqualValues(t, 8, opts.retryAttempts)
+	assert.EqualValues(t, "2s", opts.retryDelay)
+	for _, cmdline := range []string{"prune --retry-attempts 0", "prune --retry-attempts few", "prune --retry-delay 0s",
+		"prune --retry-delay soon"} {
+		_, err = parseFlags(strings.Split(cmdline, " "), false)
+		assert.Error(t, err, cmdline)
+	}
+
+	opts = assertParseSuccess(t, "init --key-file ~/.inc.keys --pass-file ~/.inc.pass")
+	assert.EqualValues(t, filepath.Join(os.Getenv("HOME"), ".inc.keys"), opts.keyFile)
+	assert.EqualValues(t, filepath.Join(os.Getenv("HOME"), ".inc.pass"), opts.passFile)
+	assert.EqualValues(t, true, needsPassword(opts))
+	opts = assertParseSuccess(t, "restore --pass-command pass_show_inc --dest DIR ~/code")
+	assert.EqualValues(t, "pass_show_inc", opts.passCommand)
+	assert.EqualValues(t, false, needsPassword(opts))
+	assert.EqualValues(t, true, needsPassword(assertParseSuccess(t, "key passwd --new-pass NEW")))
+	assert.EqualValues(t, true, needsPassword(assertParseSuccess(t, "backup --write-only ~/code")))
+
+	opts = assertParseSuccess(t, "unlock --all")
+	assert.EqualValues(t, "unlock", opts.command)
+	assert.EqualValues(t, true, opts.unlockAll)
+	assert.EqualValues(t, true, needsExclusiveLock(assertParseSuccess(t, "prune")))
+	assert.EqualValues(t, false, needsExclusiveLock(assertParseSuccess(t, "prune --dry-run")))
+	assert.EqualValues(t, false, needsExclusiveLock(assertParseSuccess(t, "verify")))
+
 	opts = assertParseSuccess(t, "scan ~")
 	assert.EqualValues(t, true, opts.scanOnly)
 	assert.EqualValues(t, []string{os.Getenv("HOME")}, opts.includePaths)
 }
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2016, 1, 7, 12, 0, 0, 0, time.Local)
+
+	ts, err := parseTime("2016-01-05 18:30", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2016, 1, 5, 18, 30, 0, 0, time.Local), ts)
+
+	ts, err = parseTime("36h", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2016, 1, 6, 0, 0, 0, 0, time.Local), ts)
+
+	_, err = parseTime("last tuesday", now)
+	assert.Error(t, err)
+}
+
+func TestParseDuration(t *testing.T) {
+	for val, expected := range map[string]time.Duration{"36h": 36 * time.Hour, "14d": 14 * 24 * time.Hour, "1.5w": 252 * time.Hour} {
+		d, err := parseDuration(val)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, d, val)
+	}
+	for _, val := range []string{"", "d", "-3d", "-1h", "soon"} {
+		_, err := parseDuration(val)
+		assert.Error(t, err, val)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for val, expected := range map[string]int64{"500": 500, "500K": 500e3, "20mb": 20e6, "1.5G": 1.5e9, "2B": 2} {
+		n, err := parseSize(val)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, n, val)
+	}
+	for _, val := range []string{"", "M", "1KK", "-5", "lots"} {
+		_, err := parseSize(val)
+		assert.Error(t, err, val)
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	for val, expected := range map[string]float64{"10": 10, "2.5%": 2.5, "100": 100} {
+		n, err := parsePercent(val)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, n, val)
+	}
+	for _, val := range []string{"", "0", "101", "-5", "some"} {
+		_, err := parsePercent(val)
+		assert.Error(t, err, val)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p, err := LocalConfigStore{}.RetryPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, store.DefaultRetryPolicy, p)
+
+	p, err = LocalConfigStore{RetryAttempts: 8, RetryDelay: "2m"}.RetryPolicy()
+	assert.NoError(t, err)
+	assert.Equal(t, store.RetryPolicy{Attempts: 8, BaseDelay: 2 * time.Minute, MaxDelay: 2 * time.Minute}, p)
+
+	for _, cfg := range []LocalConfigStore{{RetryAttempts: -1}, {RetryDelay: "0s"}, {RetryDelay: "soon"}} {
+		_, err = cfg.RetryPolicy()
+		assert.Error(t, err, fmt.Sprintf("%+v", cfg))
+	}
+}
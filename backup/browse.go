@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"github.com/aviddiviner/inc/file"
+	"github.com/aviddiviner/inc/store"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EntryFilter selects manifest entries when searching a snapshot. The zero
+// value matches everything.
+type EntryFilter struct {
+	Name    string    // glob pattern matched against the file name (or full path, if it has a "/")
+	MinSize int64     // smallest size in bytes
+	MaxSize int64     // largest size in bytes, if > 0
+	Newer   time.Time // modified at or after this time
+	Older   time.Time // modified before this time
+	Set     string    // changed in the backup set with this ID (or ID prefix)
+}
+
+// Match returns true if the entry passes all the filter conditions.
+func (f EntryFilter) Match(e *ManifestEntry) bool {
+	if f.Name != "" {
+		target := e.Name
+		if strings.Contains(f.Name, "/") {
+			target = e.Path()
+		}
+		if ok, _ := path.Match(f.Name, target); !ok {
+			return false
+		}
+	}
+	if f.MinSize > 0 && (e.IsDir() || e.Size < f.MinSize) {
+		return false
+	}
+	if f.MaxSize > 0 && (e.IsDir() || e.Size > f.MaxSize) {
+		return false
+	}
+	if !f.Newer.IsZero() && e.ModTime.Before(f.Newer) {
+		return false
+	}
+	if !f.Older.IsZero() && !e.ModTime.Before(f.Older) {
+		return false
+	}
+	if f.Set != "" && !strings.HasPrefix(e.Set, f.Set) {
+		return false
+	}
+	return true
+}
+
+// Checks if a path is equal to, or inside of, any of the given paths.
+func isWithin(p string, dirs []string) bool {
+	for _, dir := range dirs {
+		if file.IsWithin(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindEntries returns the entries (not deleted) within some paths that match
+// the filter, sorted by path. If no paths are given, all entries are searched.
+func (m *Manifest) FindEntries(paths []string, filter EntryFilter) (found []*ManifestEntry) {
+	for _, e := range m.Entries {
+		if e.Deleted {
+			continue
+		}
+		if len(paths) > 0 && !isWithin(e.Path(), paths) {
+			continue
+		}
+		if filter.Match(e) {
+			found = append(found, e)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].Path() < found[j].Path()
+	})
+	return
+}
+
+// GetSnapshotManifest returns the manifest for a snapshot, selected as per
+// SelectSnapshot.
+func GetSnapshotManifest(bucket *store.Store, id string, asOf time.Time) (Manifest, error) {
+	if id == "" && asOf.IsZero() {
+		return getSnapshotManifest(bucket, "")
+	}
+	snap, err := SelectSnapshot(bucket, Lineage{}, id, asOf)
+	if err != nil {
+		return Manifest{}, err
+	}
+	return GetManifest(bucket, snap.ID)
+}
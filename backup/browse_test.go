@@ -0,0 +1,63 @@
+package backup
+
+import (
+	"github.com/aviddiviner/inc/file"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFindEntries(t *testing.T) {
+	photo := mockFileIn("/home/pics")
+	photo.Name = "beach.jpg"
+	photo.Size = 5e6
+	notes := mockFileIn("/home/docs")
+	notes.Name = "notes.txt"
+	notes.ModTime = time.Date(2016, 1, 5, 0, 0, 0, 0, time.UTC)
+	dir := mockFileIn("/home")
+	dir.Name = "pics"
+	dir.Mode = os.ModeDir | 0755
+	m := NewManifest([]file.File{photo, notes, dir})
+	firstSet := m.LastSet
+
+	gone := mockFileIn("/home/docs")
+	m.Update([]file.File{gone})
+	m.Delete([]file.File{gone})
+
+	paths := func(entries []*ManifestEntry) (out []string) {
+		for _, e := range entries {
+			out = append(out, e.Path())
+		}
+		return
+	}
+
+	all := m.FindEntries(nil, EntryFilter{})
+	assert.Equal(t, []string{"/home/docs/notes.txt", "/home/pics", "/home/pics/beach.jpg"}, paths(all))
+
+	found := m.FindEntries([]string{"/home/pics"}, EntryFilter{})
+	assert.Equal(t, []string{"/home/pics", "/home/pics/beach.jpg"}, paths(found))
+
+	found = m.FindEntries(nil, EntryFilter{Name: "*.jpg"})
+	assert.Equal(t, []string{"/home/pics/beach.jpg"}, paths(found))
+
+	found = m.FindEntries(nil, EntryFilter{Name: "/home/docs/*"})
+	assert.Equal(t, []string{"/home/docs/notes.txt"}, paths(found))
+
+	found = m.FindEntries(nil, EntryFilter{MinSize: 1e6})
+	assert.Equal(t, []string{"/home/pics/beach.jpg"}, paths(found))
+
+	found = m.FindEntries(nil, EntryFilter{MaxSize: 1e6})
+	assert.Equal(t, []string{"/home/docs/notes.txt"}, paths(found))
+
+	found = m.FindEntries(nil, EntryFilter{Older: time.Date(2016, 1, 6, 0, 0, 0, 0, time.UTC)})
+	assert.Equal(t, []string{"/home/docs/notes.txt"}, paths(found))
+
+	found = m.FindEntries(nil, EntryFilter{Newer: time.Date(2016, 1, 6, 0, 0, 0, 0, time.UTC)})
+	assert.Equal(t, []string{"/home/pics", "/home/pics/beach.jpg"}, paths(found))
+
+	found = m.FindEntries(nil, EntryFilter{Set: firstSet[:12]})
+	assert.Len(t, found, 3)
+	found = m.FindEntries(nil, EntryFilter{Set: m.LastSet})
+	assert.Empty(t, found)
+}
@@ -1,6 +1,8 @@
 package backup
 
 import (
+	"crypto/sha1"
+	"fmt"
 	"github.com/aviddiviner/inc/file"
 	"github.com/aviddiviner/inc/file/archive"
 	"github.com/aviddiviner/inc/store"
@@ -12,6 +14,7 @@ import (
 
 const c_BUNDLE_LIMIT_SIZE = 1000 << 6 // don't bundle files >64KB
 const c_BUNDLE_MAX_SIZE = 1000 << 10  // bundles are max. 1MB
+const c_CHUNK_LIMIT_SIZE = 1 << 20    // split files >1MB into chunks
 
 // Create the initial bundle.
 func makeBundle(files []file.File) (bundles [][]file.File) {
@@ -135,40 +138,154 @@ func bundleSmallFilesAcrossPaths(files []file.File) [][]file.File {
 
 // -----------------------------------------------------------------------------
 
+// Add a new entry to the manifest, or replace the existing entry for its path.
+func (m *Manifest) putEntry(newEntry *ManifestEntry) {
+	if m.Has(newEntry.File) {
+		*m.pathMap[newEntry.Path()] = *newEntry // replace the entry
+	} else {
+		m.pathMap[newEntry.Path()] = newEntry // add a new entry
+		m.Entries = append(m.Entries, newEntry)
+	}
+}
+
+// Update adds files to the manifest in a new set. Files with the same contents
+// as some file already in the store (or earlier in the list) are pointed at the
+// data stored for that file, rather than being stored again. Large files are
+// left without parts, to be split into chunks when they are stored.
 func (m *Manifest) Update(files []file.File) time.Time {
-	file.ChecksumFiles(files) // pre-populate hashes
+	m.checksumFiles(files) // pre-populate hashes
 
 	now := time.Now()
 	m.LastSet = manifestKey(now)
 	m.Updated = now.Truncate(time.Second)
-	bundles := bundleSmallFilesAcrossPaths(files)
-	nextKey := keyFactory(len(bundles))
+	m.deduped = 0
+	m.chunking = nil
+	m.previous = make(map[string]ManifestEntry)
+	if m.contentMap == nil {
+		m.buildContentMap()
+	}
+	if m.chunkMap == nil {
+		m.chunkMap = m.chunkIndex() // before changed files lose their parts
+	}
 
-	for _, bundle := range bundles {
+	var upload, dupes []file.File
+	uploading := make(map[[sha1.Size]byte]bool)
+	for _, f := range files {
+		if e, ok := m.pathMap[f.Path()]; ok {
+			m.previous[f.Path()] = *e
+		}
+		if isDedupable(f) {
+			if _, ok := m.contentMap[f.SHA1]; ok || uploading[f.SHA1] {
+				dupes = append(dupes, f)
+				continue
+			}
+		}
+		if isChunkable(f) {
+			// Copies of large files get deduped by their chunks instead.
+			m.putEntry(&ManifestEntry{File: f, Set: m.LastSet})
+			m.chunking = append(m.chunking, f.Path())
+			continue
+		}
+		if isDedupable(f) {
+			uploading[f.SHA1] = true
+		}
+		upload = append(upload, f)
+	}
+
+	// Files which are compressed already are bundled apart, to store them as they are.
+	var compress, raw []file.File
+	for _, f := range upload {
+		if m.isIncompressible(f) {
+			raw = append(raw, f)
+		} else {
+			compress = append(compress, f)
+		}
+	}
+	bundles := bundleSmallFilesAcrossPaths(compress)
+	rawBundles := bundleSmallFilesAcrossPaths(raw)
+	nextKey := keyFactory(len(bundles) + len(rawBundles))
+	m.raw = make(map[string]bool)
+
+	for i, bundle := range append(bundles, rawBundles...) {
 		key := nextKey()
+		if i >= len(bundles) {
+			m.raw[m.LastSet+"/"+key] = true
+		}
 		for _, f := range bundle {
 			var parts []ManifestEntryPart
 			if !f.IsDir() {
 				parts = []ManifestEntryPart{{Key: key}}
 			}
-			newEntry := &ManifestEntry{f, m.LastSet, parts}
-			if m.Has(f) {
-				*m.pathMap[f.Path()] = *newEntry // replace the entry
-			} else {
-				m.pathMap[f.Path()] = newEntry // add a new entry
-				m.Entries = append(m.Entries, newEntry)
-			}
+			newEntry := &ManifestEntry{File: f, Set: m.LastSet, Parts: parts}
+			m.putEntry(newEntry)
+			m.addContent(newEntry)
 		}
 	}
 
+	for _, f := range dupes {
+		ref := m.contentMap[f.SHA1]
+		m.putEntry(&ManifestEntry{File: f, Set: ref.set, Parts: ref.parts})
+		m.deduped += f.Size
+	}
+
 	return now
 }
 
+// Delete marks files as deleted in the latest set, leaving tombstone entries in
+// their place. Call this after Update, so that LastSet is the new set.
+func (m *Manifest) Delete(files []file.File) {
+	for _, f := range files {
+		if e, ok := m.pathMap[f.Path()]; ok {
+			e.Set = m.LastSet
+			e.Parts = nil
+			e.Deleted = true
+		}
+	}
+}
+
+// All the files (including those sharing the data of others) stored in an object.
+func (m *Manifest) entriesStoredIn(key string) (files []file.File) {
+	for _, e := range m.Entries {
+		for _, p := range e.Parts {
+			if e.objectKey(p) == key {
+				files = append(files, e.File)
+				break
+			}
+		}
+	}
+	return
+}
+
+// Where each file was packed in an object, by path.
+type fileRanges map[string]store.ByteRange
+
+// Record where the data of each file was stored in its object, for the entries
+// (and content refs) pointing at it.
+func (m *Manifest) setRanges(packed map[string]fileRanges) {
+	for _, e := range m.Entries {
+		for i, p := range e.Parts {
+			if rng, ok := packed[e.objectKey(p)][e.archiveName(p)]; ok {
+				e.Parts[i].Range = rng
+			}
+		}
+	}
+	for _, ref := range m.contentMap {
+		for i, p := range ref.parts {
+			if rng, ok := packed["blob/"+ref.set+"/"+p.Key][p.Name]; ok {
+				ref.parts[i].Range = rng
+			}
+		}
+	}
+}
+
 func (m *Manifest) LatestEntries() map[string][]*ManifestEntry {
 	entries := make(map[string][]*ManifestEntry)
 	for _, e := range m.Entries {
 		if e.Set == m.LastSet {
 			for _, p := range e.Parts {
+				if p.Name != "" || p.isChunk() {
+					continue // data is stored for another file, or in chunks
+				}
 				obj := m.LastSet + "/" + p.Key
 				entries[obj] = append(entries[obj], e)
 			}
@@ -192,14 +309,60 @@ func init() {
 	}
 }
 
+// DeferredError is returned by a backup which couldn't store some files, even
+// after retrying. The rest of the backup is saved without them, and they'll be
+// stored by the next backup.
+type DeferredError struct {
+	Paths []string
+}
+
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("%d files couldn't be stored, deferred to the next backup", len(e.Paths))
+}
+
+// Pack some files into a blob, each file as its own tarball so that it can be
+// read back alone, and compressed unless raw. Returns where each file was
+// stored, and the bytes written.
+func putBundle(bucket *store.Store, key string, files []file.File, raw bool) (ranges fileRanges, n int, err error) {
+	var packer *store.Packer
+	if raw {
+		packer, err = bucket.PackUncompressed("blob/" + key)
+	} else {
+		packer, err = bucket.Pack("blob/" + key)
+	}
+	if err != nil {
+		return
+	}
+	ranges = make(fileRanges)
+	for _, f := range files {
+		var rng store.ByteRange
+		rng, err = packer.PutReaderRange(archive.PackReader(f))
+		if err != nil {
+			return
+		}
+		ranges[f.Path()] = rng
+		n += rng.Len()
+	}
+	err = packer.Close()
+	return
+}
+
 // Backup changed files only.
 func backupLatest(store *store.Store, m Manifest) (err error) {
+	var deferred []string
+	progress := newProgress()
+	uncompressed := storesUncompressed(store)
 	latest := m.LatestEntries()
 	totalPuts := len(latest)
 	if totalPuts > 0 {
 		var donePuts int
 		var doneBytes util.ByteCount
+		var failed []string
 		for key, entries := range latest {
+			if isInterrupted() {
+				break
+			}
+			maybeCheckpoint(store, &m, progress)
 			var files []file.File
 			for _, e := range entries {
 				if e.IsDir() {
@@ -210,40 +373,29 @@ func backupLatest(store *store.Store, m Manifest) (err error) {
 			<-uploadSem
 			// This func is blocked on our semaphore above.
 			go func(key string, files []file.File) {
+				defer func() { uploadSem <- true }()
 
-				dropFromManifest := func() {
-					totalPuts -= 1
-					log.Printf("backup: failed to put %s, removing files from manifest.\n", key)
-					for _, f := range files {
-						m.Remove(f)
-						log.Printf("backup: removed %q\n", f.Path())
-					}
-					uploadSem <- true
-				}
-
-				tarball := archive.PackReader(files...)
-				packer, err := store.Pack("blob/" + key)
-				if err != nil {
-					dropFromManifest()
+				var ranges fileRanges
+				var n int
+				err := store.Retry("put.packer", "blob/"+key, func() (err error) {
+					ranges, n, err = putBundle(store, key, files, m.raw[key])
 					return
-				}
+				})
 
-				n, err := packer.PutReader(tarball)
+				progress.Lock()
+				defer progress.Unlock()
 				if err != nil {
-					dropFromManifest()
+					log.Printf("backup: failed to put %s: %s\n", key, err)
+					failed = append(failed, key)
 					return
 				}
-
-				err = packer.Close()
-				if err != nil {
-					dropFromManifest()
-					return
+				progress.packed["blob/"+key] = ranges
+				for _, f := range files {
+					progress.stats.add(f, f.Size, int64(ranges[f.Path()].Len()), m.raw[key] && uncompressed)
 				}
-
 				donePuts += 1
 				doneBytes += util.ByteCount(n)
 				log.Printf("backup: [%s] stored %d files (%s, %d/%d)\n", key, len(files), util.ByteCount(n), donePuts, totalPuts)
-				uploadSem <- true
 			}(key, files)
 		}
 		// Synchronize on all uploads being finished.
@@ -253,9 +405,42 @@ func backupLatest(store *store.Store, m Manifest) (err error) {
 		for i := 0; i < cap(uploadSem); i++ {
 			uploadSem <- true
 		}
+		// Only touch the manifest once all the goroutines are done with it.
+		for _, key := range failed {
+			log.Printf("backup: putting back the previous entries of files stored in %s.\n", key)
+			for _, f := range m.entriesStoredIn("blob/" + key) {
+				m.revert(f)
+				deferred = append(deferred, f.Path())
+			}
+		}
+		m.setRanges(progress.packed)
 		log.Printf("backup: finished saving data. put %d objects (%s)\n", donePuts, doneBytes)
-		return saveManifest(store, m)
+	} else {
+		log.Println("backup: no new file data to store.")
+	}
+	if len(m.chunking) > 0 {
+		deferred = append(deferred, storeChunkedFiles(store, &m, progress)...)
+	}
+	progress.stats.log()
+	if isInterrupted() {
+		if err = writeCheckpoint(store, &m, progress); err != nil {
+			return
+		}
+		return ErrInterrupted
+	}
+	if m.deduped > 0 {
+		log.Printf("backup: deduplicated %s of file data already in the store.\n", util.ByteCount(m.deduped))
 	}
-	log.Println("no new entries to store.")
-	return nil
+	if err = saveManifest(store, m); err != nil {
+		return
+	}
+	deleteCheckpoints(store, m.Lineage, m.LastSet)
+	if len(deferred) > 0 {
+		sort.Strings(deferred)
+		for _, p := range deferred {
+			log.Printf("backup: deferred %q\n", p)
+		}
+		err = &DeferredError{deferred}
+	}
+	return
 }
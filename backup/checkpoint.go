@@ -0,0 +1,183 @@
+package backup
+
+import (
+	"errors"
+	"github.com/aviddiviner/inc/store"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Error when a backup stops early because it was interrupted.
+var ErrInterrupted = errors.New("backup interrupted; what was stored so far will be resumed by the next backup")
+
+// Error when asked to use a checkpoint manifest as a snapshot.
+var ErrPartialManifest = errors.New("manifest is a checkpoint of an unfinished backup, not a snapshot")
+
+// How often a running backup writes a checkpoint of what it has stored so far.
+var checkpointInterval = 5 * time.Minute
+
+var interrupted = make(chan struct{})
+var interruptOnce sync.Once
+
+// Interrupt stops a running backup. The uploads in progress are finished, and
+// a checkpoint written, so that the next backup carries on from there.
+func Interrupt() {
+	interruptOnce.Do(func() { close(interrupted) })
+}
+
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// The progress of a running backup; which of the files in the latest set have
+// been stored so far.
+type progress struct {
+	sync.Mutex
+	packed     map[string]fileRanges          // blobs stored, by object key
+	chunked    map[string][]ManifestEntryPart // large files stored, by path
+	checkpoint time.Time                      // when the last checkpoint was written
+	stats      compressionStats               // of the files stored so far
+}
+
+func newProgress() *progress {
+	return &progress{
+		packed:     make(map[string]fileRanges),
+		chunked:    make(map[string][]ManifestEntryPart),
+		checkpoint: time.Now(),
+		stats:      make(compressionStats),
+	}
+}
+
+// Make a partial copy of the manifest, with only the entries of the latest set
+// whose data has been stored so far (along with all the older entries).
+func (m *Manifest) checkpoint(p *progress) Manifest {
+	p.Lock()
+	defer p.Unlock()
+	cp := Manifest{LastSet: m.LastSet, Lineage: m.Lineage, Created: m.Created, Updated: m.Updated, Partial: true}
+	for _, e := range m.Entries {
+		c := *e
+		c.Parts = append([]ManifestEntryPart(nil), e.Parts...)
+		if e.Set == m.LastSet && !e.Deleted && !e.IsDir() {
+			switch {
+			case len(e.Parts) == 0: // still to be chunked
+				parts, ok := p.chunked[e.Path()]
+				if !ok {
+					continue
+				}
+				c.Parts = parts
+			case e.isChunked():
+			default:
+				ranges, ok := p.packed[e.objectKey(e.Parts[0])]
+				if !ok {
+					continue
+				}
+				c.Parts[0].Range = ranges[e.archiveName(e.Parts[0])]
+			}
+		}
+		cp.Entries = append(cp.Entries, &c)
+	}
+	return cp
+}
+
+// Write a checkpoint of the backup, if it's been a while since the last one.
+func maybeCheckpoint(bucket *store.Store, m *Manifest, p *progress) {
+	if time.Since(p.checkpoint) < checkpointInterval {
+		return
+	}
+	if err := writeCheckpoint(bucket, m, p); err != nil {
+		log.Printf("backup: failed to write checkpoint: %s\n", err)
+	}
+}
+
+// Write a checkpoint of the backup to the store, as checkpoint/<set>.
+func writeCheckpoint(bucket *store.Store, m *Manifest, p *progress) (err error) {
+	cp := m.checkpoint(p)
+	data, err := cp.JSON()
+	if err != nil {
+		return
+	}
+	if err = putStoreObject(bucket, "checkpoint/"+cp.LastSet, data); err != nil {
+		return
+	}
+	p.checkpoint = time.Now()
+	log.Printf("backup: wrote checkpoint %s (%d entries)\n", cp.LastSet, len(cp.Entries))
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// List the sets of the checkpoints in the store, from oldest to newest.
+func listCheckpoints(bucket *store.Store) (sets []string, err error) {
+	objects, err := bucket.List("checkpoint/")
+	if err != nil {
+		return
+	}
+	for key := range objects {
+		sets = append(sets, key[len("checkpoint/"):])
+	}
+	sort.Slice(sets, func(i, j int) bool { return setTime(sets[i]).Before(setTime(sets[j])) })
+	return
+}
+
+// Read a checkpoint from the store (or the cache) by its set.
+func readCheckpoint(bucket *store.Store, set string) (cp Manifest, err error) {
+	data, err := cacheGetStoreObject(bucket, "checkpoint/"+set)
+	if err != nil {
+		return
+	}
+	return ReadManifestData(data)
+}
+
+// Find the latest checkpoint of a lineage written after some set, if any.
+func getCheckpoint(bucket *store.Store, l Lineage, after string) (cp Manifest, ok bool, err error) {
+	sets, err := listCheckpoints(bucket)
+	if err != nil {
+		return
+	}
+	for i := len(sets) - 1; i >= 0; i-- {
+		if after != "" && !setTime(sets[i]).After(setTime(after)) {
+			break
+		}
+		cp, err = readCheckpoint(bucket, sets[i])
+		if err == store.ErrWriteOnly {
+			err = nil // not ours, or no longer cached
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if cp.Partial && cp.Lineage == l {
+			return cp, true, nil
+		}
+	}
+	return Manifest{}, false, nil
+}
+
+// Delete the checkpoints of a lineage from before some set, now that it's saved.
+func deleteCheckpoints(bucket *store.Store, l Lineage, before string) {
+	sets, err := listCheckpoints(bucket)
+	if err != nil {
+		log.Printf("backup: failed to list checkpoints: %s\n", err)
+		return
+	}
+	for _, set := range sets {
+		if !setTime(set).Before(setTime(before)) {
+			continue
+		}
+		if cp, err := readCheckpoint(bucket, set); err != nil || cp.Lineage != l {
+			continue
+		}
+		if err := deleteStoreObject(bucket, "checkpoint/"+set); err != nil && !bucket.IsNotExist(err) {
+			log.Printf("backup: failed to delete checkpoint %s: %s\n", set, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"github.com/aviddiviner/inc/file"
+	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/store/storage"
+	"github.com/aviddiviner/inc/util/test"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func resetInterrupt() {
+	interrupted = make(chan struct{})
+	interruptOnce = sync.Once{}
+}
+
+func setupTestStore(t *testing.T) (*store.Store, *storage.MockStorage) {
+	layer := storage.NewMockStorage()
+	bucket := store.NewStore(layer, "test")
+	keys, err := bucket.Wipe([]byte("secret"))
+	assert.NoError(t, err)
+	assert.NoError(t, bucket.Open(keys))
+	return bucket, layer
+}
+
+func TestBackupResumesFromCheckpoint(t *testing.T) {
+	defer resetInterrupt()
+	test.RandSeed(53)
+	dir := test.CreateTempDir(t)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		// Big enough that each file is a bundle of its own.
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), test.RandBytes(600<<10), 0644))
+	}
+	scanner := file.NewScanner().IncludePath(dir)
+	bucket, layer := setupTestStore(t)
+
+	// Interrupt the backup once the first file is stored; the rest fail.
+	var mu sync.Mutex
+	var puts int
+	layer.InjectRequestFault(func(key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !strings.HasPrefix(key, "blob/") {
+			return nil
+		}
+		puts += 1
+		if puts == 1 {
+			Interrupt()
+			return nil
+		}
+		return storage.MockErrAccessDenied
+	})
+	assert.Equal(t, ErrInterrupted, ScanAndBackup(bucket, scanner))
+	layer.ClearRequestFaults()
+
+	list, err := ListSnapshots(bucket)
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+	checkpoints, err := listCheckpoints(bucket)
+	assert.NoError(t, err)
+	assert.Len(t, checkpoints, 1)
+	stored, err := layer.List("blob/")
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+
+	// The next backup only stores the files which weren't stored before.
+	resetInterrupt()
+	puts = 0
+	layer.InjectRequestFault(func(key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(key, "blob/") {
+			puts += 1
+		}
+		return nil
+	})
+	assert.NoError(t, ScanAndBackup(bucket, scanner))
+	layer.ClearRequestFaults()
+	assert.Equal(t, 4, puts)
+
+	checkpoints, err = listCheckpoints(bucket)
+	assert.NoError(t, err)
+	assert.Empty(t, checkpoints)
+	m, err := GetSnapshotManifest(bucket, "", time.Time{})
+	assert.NoError(t, err)
+	assert.False(t, m.Partial)
+	assert.Len(t, m.Entries, 6)
+	report, err := Verify(bucket, &m, 100)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+}
@@ -0,0 +1,194 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"github.com/aviddiviner/inc/file"
+	"github.com/aviddiviner/inc/file/chunker"
+	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/util"
+	"io"
+	"log"
+	"path"
+	"sync"
+)
+
+// Error when a chunk read from the store doesn't match its key or length.
+var ErrChunkMismatch = errors.New("chunk contents don't match")
+
+// Should a file be split into chunks to store it?
+func isChunkable(f file.File) bool {
+	return f.IsRegular() && f.Size > c_CHUNK_LIMIT_SIZE
+}
+
+// Index the chunks referenced by the manifest, by the hash of their contents.
+func (m *Manifest) chunkIndex() map[string]string {
+	index := make(map[string]string)
+	for _, e := range m.Entries {
+		if e.Deleted || !e.isChunked() {
+			continue
+		}
+		for _, p := range e.Parts {
+			index[path.Base(p.Key)] = p.Key
+		}
+	}
+	return index
+}
+
+// Split a file into chunks, storing those which aren't in the index already
+// (uncompressed, if raw), and returning the bytes they took up in the store.
+// New chunks are stored under the given set, and added to the index.
+func storeChunks(bucket *store.Store, set string, f file.File, raw bool, index map[string]string, mu *sync.Mutex) (parts []ManifestEntryPart, stored, reused, written int64, err error) {
+	fh, err := file.DefaultFileSystem.OpenRead(f.Path())
+	if err != nil {
+		return
+	}
+	defer fh.Close()
+
+	c := chunker.New(fh)
+	for {
+		var data []byte
+		data, err = c.Next()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+		var hash string
+		hash, err = bucket.ContentKey(data)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		key, ok := index[hash]
+		mu.Unlock()
+		if ok {
+			reused += int64(len(data))
+		} else {
+			key = set + "/" + hash
+			var n int
+			if raw {
+				n, err = bucket.PutUncompressed("chunk/"+key, data)
+			} else {
+				n, err = bucket.Put("chunk/"+key, data)
+			}
+			if err != nil {
+				return
+			}
+			written += int64(n)
+			mu.Lock()
+			index[hash] = key
+			mu.Unlock()
+			stored += int64(len(data))
+		}
+		parts = append(parts, ManifestEntryPart{Key: key, Size: int64(len(data))})
+	}
+}
+
+// Store the large files of the latest set in chunks, only storing the chunks
+// which aren't in the store already. Files which fail are removed from the
+// manifest, and their paths returned.
+func storeChunkedFiles(bucket *store.Store, m *Manifest, progress *progress) (deferred []string) {
+	index := m.chunkMap
+	if index == nil {
+		index = m.chunkIndex()
+		m.chunkMap = index
+	}
+	var failed []file.File
+	var mu sync.Mutex // guards the index
+	var wg sync.WaitGroup
+	uncompressed := storesUncompressed(bucket)
+
+	for _, p := range m.chunking {
+		e, ok := m.pathMap[p]
+		if !ok {
+			continue // removed since
+		}
+		if isInterrupted() {
+			break
+		}
+		maybeCheckpoint(bucket, m, progress)
+		<-uploadSem
+		wg.Add(1)
+		go func(f file.File) {
+			defer func() {
+				uploadSem <- true
+				wg.Done()
+			}()
+			raw := m.isIncompressible(f)
+			parts, stored, reused, written, err := storeChunks(bucket, m.LastSet, f, raw, index, &mu)
+			progress.Lock()
+			defer progress.Unlock()
+			if err != nil {
+				log.Printf("backup: failed to store chunks of %q: %s\n", f.Path(), err)
+				failed = append(failed, f)
+				return
+			}
+			progress.chunked[f.Path()] = parts
+			if stored > 0 {
+				progress.stats.add(f, stored, written, raw && uncompressed)
+			}
+			m.deduped += reused
+			log.Printf("backup: [chunks] stored %q in %d chunks (%s new)\n", f.Path(), len(parts), util.ByteCount(stored))
+		}(e.File)
+	}
+	wg.Wait()
+
+	// Only touch the manifest entries once all the goroutines are done with it.
+	for p, parts := range progress.chunked {
+		m.pathMap[p].Parts = parts
+	}
+	for _, f := range failed {
+		m.revert(f)
+		deferred = append(deferred, f.Path())
+	}
+	m.chunking = nil
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// Read a chunk from the store, checking it's the data we expect.
+func readChunk(bucket *store.Store, e *ManifestEntry, p ManifestEntryPart) ([]byte, error) {
+	data, err := bucket.Get(e.objectKey(p))
+	if err != nil {
+		return nil, err
+	}
+	hash, err := bucket.ContentKey(data)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != p.Size || hash != path.Base(p.Key) {
+		return nil, ErrChunkMismatch
+	}
+	return data, nil
+}
+
+// Reads the contents of a chunked file, one chunk at a time, in order.
+type chunkReader struct {
+	bucket *store.Store
+	entry  *ManifestEntry
+	next   int
+	buf    *bytes.Reader
+}
+
+func newChunkReader(bucket *store.Store, e *ManifestEntry) io.Reader {
+	return &chunkReader{bucket: bucket, entry: e}
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	for c.buf == nil || c.buf.Len() == 0 {
+		if c.next >= len(c.entry.Parts) {
+			return 0, io.EOF
+		}
+		data, err := readChunk(c.bucket, c.entry, c.entry.Parts[c.next])
+		if err != nil {
+			return 0, err
+		}
+		c.next += 1
+		c.buf = bytes.NewReader(data)
+	}
+	return c.buf.Read(b)
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"github.com/aviddiviner/inc/file"
+	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/store/zip"
+	"github.com/aviddiviner/inc/util"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The kind of a file, by its extension; its class (for the compression stats of a backup), and whether files of the
+// kind are compressed already.
+type fileKind struct {
+	class      string
+	compressed bool
+}
+
+const c_OTHER_FILES = "other"
+
+var fileKinds = []struct {
+	fileKind
+	exts string
+}{
+	{fileKind{"images", true}, "jpg jpeg png gif webp heic heif avif"},
+	{fileKind{"images", false}, "bmp tif tiff psd svg ico raw cr2 nef dng"},
+	{fileKind{"video", true}, "mp4 m4v mkv mov avi webm wmv flv mpg mpeg 3gp"},
+	{fileKind{"audio", true}, "mp3 m4a aac ogg oga opus flac wma"},
+	{fileKind{"audio", false}, "wav aif aiff"},
+	{fileKind{"archives", true}, "zip gz tgz bz2 tbz xz txz zst lz4 7z rar jar war apk dmg"},
+	{fileKind{"archives", false}, "tar iso"},
+	{fileKind{"documents", true}, "docx xlsx pptx odt ods odp epub"},
+	{fileKind{"documents", false}, "pdf doc xls ppt rtf"},
+	{fileKind{"text", false}, "txt md rst log csv tsv json xml yaml yml toml ini cfg conf html htm css js ts go c h " +
+		"cc cpp hpp java py rb rs sh sql php swift kt scala"},
+}
+
+var extKinds = make(map[string]fileKind)
+
+func init() {
+	for _, k := range fileKinds {
+		for _, ext := range strings.Fields(k.exts) {
+			extKinds["."+ext] = k.fileKind
+		}
+	}
+}
+
+func kindOf(f file.File) fileKind {
+	if k, ok := extKinds[strings.ToLower(filepath.Ext(f.Name))]; ok {
+		return k
+	}
+	return fileKind{class: c_OTHER_FILES}
+}
+
+// Checksum files which need it, sniffing the start of each one as it's read, so isIncompressible needn't read them
+// again.
+func (m *Manifest) checksumFiles(groups ...[]file.File) {
+	if m.sniffed == nil {
+		m.sniffed = make(map[string]bool)
+	}
+	file.ChecksumFilesSniff(zip.SampleSize, func(f file.File, head []byte) {
+		m.sniffed[f.Path()] = zip.Incompressible(head)
+	}, groups...)
+}
+
+// Should a file be stored without compressing it? By its extension, or else by a sample of its contents, taken when
+// it was checksummed. Files whose checksum was known already were never sniffed; they're compressed as usual.
+func (m *Manifest) isIncompressible(f file.File) bool {
+	if !f.IsRegular() {
+		return false
+	}
+	if kindOf(f).compressed {
+		return true
+	}
+	return m.sniffed[f.Path()]
+}
+
+// Are objects put uncompressed stored that way? Stores made before store format 4
+// compress everything with gzip.
+func storesUncompressed(bucket *store.Store) bool {
+	return bucket.CheckCompression(zip.Config{Codec: zip.None}) == nil
+}
+
+// -----------------------------------------------------------------------------
+
+// How well the files of each class compressed in a backup, by class.
+type compressionStats map[string]*classStats
+
+type classStats struct {
+	files        int
+	uncompressed int   // files stored without compressing them
+	size         int64 // bytes of file data stored
+	stored       int64 // bytes they took up in the store
+}
+
+// Count the data of a file stored in the backup; size bytes of it, which took up stored bytes in the store.
+func (cs compressionStats) add(f file.File, size, stored int64, uncompressed bool) {
+	class := kindOf(f).class
+	s, ok := cs[class]
+	if !ok {
+		s = &classStats{}
+		cs[class] = s
+	}
+	s.files += 1
+	s.size += size
+	s.stored += stored
+	if uncompressed {
+		s.uncompressed += 1
+	}
+}
+
+// Log the compression ratio of each class.
+func (cs compressionStats) log() {
+	var classes []string
+	for class := range cs {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		s := cs[class]
+		if s.stored == 0 {
+			continue
+		}
+		log.Printf("backup: compression of %s: %d files, %s stored as %s (%.2fx; %d uncompressed)\n", class, s.files,
+			util.ByteCount(s.size), util.ByteCount(s.stored), float64(s.size)/float64(s.stored), s.uncompressed)
+	}
+}
@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"bytes"
+	"github.com/aviddiviner/inc/file"
+	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/store/storage"
+	"github.com/aviddiviner/inc/util/test"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIncompressibleFiles(t *testing.T) {
+	test.RandSeed(60)
+	dir := test.CreateTempDir(t)
+	noise := func(n int) []byte {
+		b := make([]byte, n)
+		rand.Read(b)
+		return b
+	}
+	write := func(name string, data []byte) file.File {
+		assert.NoError(t, ioutil.WriteFile(path.Join(dir, name), data, 0644))
+		return file.ScanFile(path.Join(dir, name))
+	}
+	logs := write("access.log", bytes.Repeat([]byte("GET /index.html 200\n"), 2000))
+	photo := write("photo.JPG", test.RandBytes(20<<10)) // by its extension
+	movie := write("movie", append([]byte("\x00\x00\x00\x18ftypmp42"), test.RandBytes(20<<10)...))
+	random := write("random", noise(20<<10))
+	short := write("short", noise(100))
+
+	// Their contents are sniffed while they're checksummed, and not read again after.
+	sniffer := &Manifest{}
+	assert.False(t, sniffer.isIncompressible(random), "not sniffed yet")
+	sniffer.checksumFiles([]file.File{logs, photo, movie, random, short})
+	assert.NoError(t, os.Remove(random.Path()))
+	assert.False(t, sniffer.isIncompressible(logs))
+	assert.True(t, sniffer.isIncompressible(photo))
+	assert.True(t, sniffer.isIncompressible(movie))
+	assert.True(t, sniffer.isIncompressible(random))
+	assert.False(t, sniffer.isIncompressible(short), "too little to tell")
+	random = write("random", noise(20<<10))
+	assert.Equal(t, "text", kindOf(logs).class)
+	assert.Equal(t, "images", kindOf(photo).class)
+	assert.Equal(t, c_OTHER_FILES, kindOf(random).class)
+
+	// Incompressible files are bundled apart, and stored as they are.
+	m := NewManifest([]file.File{logs, photo, movie, random, short})
+	latest := m.LatestEntries()
+	assert.Len(t, latest, 2)
+	bucket, layer := setupTestStore(t)
+	assert.NoError(t, backupLatest(bucket, m))
+	for key, entries := range latest {
+		var size int64
+		for _, e := range entries {
+			size += e.Size
+		}
+		stored, err := layer.Size("blob/" + key)
+		assert.NoError(t, err)
+		if m.raw[key] {
+			assert.Len(t, entries, 3)
+			assert.True(t, int64(stored) > size)
+		} else {
+			assert.Len(t, entries, 2)
+			assert.True(t, int64(stored) < size/10)
+		}
+	}
+
+	// Stores made before store format 4 gzip them anyway, so they don't count as uncompressed.
+	assert.True(t, storesUncompressed(bucket))
+	layer = storage.NewMockStorage()
+	layer.PutString("metadata", `{"version":1,"storeFormat":1,"salt":"5+ZOMGkPADM="}`)
+	old := store.NewStore(layer, "test")
+	old.AllowLegacyMetadata()
+	_, err := old.Unlock([]byte("secret"))
+	assert.NoError(t, err)
+	assert.False(t, storesUncompressed(old))
+
+	stats := make(compressionStats)
+	stats.add(logs, 40000, 1000, false)
+	stats.add(photo, 20000, 20100, true)
+	stats.add(photo, 10000, 10100, true)
+	assert.Equal(t, classStats{files: 1, size: 40000, stored: 1000}, *stats["text"])
+	assert.Equal(t, classStats{files: 2, uncompressed: 2, size: 30000, stored: 30200}, *stats["images"])
+}
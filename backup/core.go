@@ -5,11 +5,13 @@ import (
 	"github.com/aviddiviner/inc/file/archive"
 	"github.com/aviddiviner/inc/file/fs"
 	"github.com/aviddiviner/inc/store"
+	"io"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Write the latest manifest to the store and to disk.
@@ -24,23 +26,38 @@ func saveManifest(bucket *store.Store, m Manifest) (err error) {
 		return
 	}
 	log.Printf("core: wrote file %q with manifest data\n", localFile)
-	_, err = bucket.Put("manifest/"+m.LastSet, data)
+	err = putStoreObject(bucket, "manifest/"+m.LastSet, data)
 	if err != nil {
 		return
 	}
+	err = addSnapshot(bucket, newSnapshot(&m))
+	if err != nil {
+		return
+	}
+	if !m.Lineage.IsEmpty() {
+		if err = bucket.PutMetadata(latestKey(m.Lineage), m.LastSet); err != nil {
+			return
+		}
+		if bucket.IsWriteOnly() {
+			return // hosts with write-only keys only touch the pointer of their own lineage
+		}
+	}
 	err = bucket.PutMetadata("manifest/latest", m.LastSet)
 	return
 }
 
 var defaultCachePath = filepath.Join(os.Getenv("HOME"), ".inc", "cache")
 
+func cacheFilePath(bucket *store.Store, key string) string {
+	return filepath.Join(defaultCachePath, strings.Replace(bucket.ID()+"/"+key, "/", "_", -1))
+}
+
 func cacheGetStoreObject(bucket *store.Store, key string) (data []byte, err error) {
-	cacheFile := filepath.Join(defaultCachePath, strings.Replace(bucket.ID()+"/"+key, "/", "_", -1))
+	cacheFile := cacheFilePath(bucket, key)
 	if _, e := os.Stat(cacheFile); os.IsNotExist(e) {
 		data, err = bucket.Get(key)
 		if err == nil {
-			file.DefaultFileSystem.MkdirAll(defaultCachePath, 0755)
-			file.DefaultFileSystem.WriteFile(cacheFile, data, 0644)
+			cachePutObject(bucket, key, data)
 		}
 		return
 	}
@@ -48,6 +65,29 @@ func cacheGetStoreObject(bucket *store.Store, key string) (data []byte, err erro
 	return file.DefaultFileSystem.ReadFile(cacheFile)
 }
 
+func cachePutObject(bucket *store.Store, key string, data []byte) {
+	file.DefaultFileSystem.MkdirAll(defaultCachePath, 0755)
+	file.DefaultFileSystem.WriteFile(cacheFilePath(bucket, key), data, 0644)
+}
+
+// Put an object in the store. With write-only keys, we can't read it back from
+// there, so keep a copy in the cache too.
+func putStoreObject(bucket *store.Store, key string, data []byte) error {
+	if _, err := bucket.Put(key, data); err != nil {
+		return err
+	}
+	if bucket.IsWriteOnly() {
+		cachePutObject(bucket, key, data)
+	}
+	return nil
+}
+
+// Delete an object from the store, and from the cache.
+func deleteStoreObject(bucket *store.Store, key string) error {
+	file.DefaultFileSystem.RemoveAll(cacheFilePath(bucket, key))
+	return bucket.Delete(key)
+}
+
 // Get the latest manifest that was written to the store.
 func getLatestManifest(bucket *store.Store) (data []byte, err error) {
 	lastSet, err := bucket.GetMetadata("manifest/latest")
@@ -65,6 +105,22 @@ func getLatestManifest(bucket *store.Store) (data []byte, err error) {
 	return nil, err
 }
 
+// Get the manifest of some snapshot, or the latest manifest if the ID is blank.
+func getSnapshotManifest(bucket *store.Store, id string) (Manifest, error) {
+	if id != "" {
+		return GetManifest(bucket, id)
+	}
+	data, err := getLatestManifest(bucket)
+	if err != nil {
+		return Manifest{}, err
+	}
+	m, err := ReadManifestData(data)
+	if err == nil && m.Partial {
+		err = ErrPartialManifest
+	}
+	return m, err
+}
+
 // Write a manifest file from some path scan.
 func WriteManifest(filename string, scanner *file.PathScanner) (err error) {
 	m := NewManifest(scanner.Scan())
@@ -76,54 +132,124 @@ func WriteManifest(filename string, scanner *file.PathScanner) (err error) {
 	return
 }
 
-// Scan a path for changes (compared to latest manifest) and upload the diff.
+// Scan a path for changes (compared to latest manifest) and upload the diff,
+// as a snapshot of this host's default backup set.
 func ScanAndBackup(bucket *store.Store, scanner *file.PathScanner) error {
+	return ScanAndBackupLineage(bucket, LocalLineage(""), scanner)
+}
+
+// Scan a path for changes (compared to the latest manifest of a lineage) and
+// upload the diff. If an earlier backup didn't finish, carry on from its last
+// checkpoint.
+func ScanAndBackupLineage(bucket *store.Store, l Lineage, scanner *file.PathScanner) error {
 	ls := scanner.Scan()
 	if len(ls) > 0 {
 		// Fetch last manifest.
-		data, err := getLatestManifest(bucket)
+		m, err := getLineageManifest(bucket, l)
+		if err == store.ErrWriteOnly {
+			// We can only read the manifests we wrote (and still have cached).
+			log.Printf("core: can't read the latest manifest of %s with write-only keys; backing up every file\n", l)
+			err = ErrSnapshotNotFound
+		}
+		if err != nil && err != ErrSnapshotNotFound {
+			// Other error; bail out.
+			return err
+		}
+		// Look for a checkpoint of some later backup which didn't finish.
+		cp, resumed, e := getCheckpoint(bucket, l, m.LastSet)
+		if e != nil {
+			return e
+		}
+		if resumed {
+			log.Printf("core: resuming from checkpoint %s (%d entries)\n", cp.LastSet, len(cp.Entries))
+			cp.Partial = false
+			m, err = cp, nil
+		}
+
 		switch {
 		case err == nil:
-			// No error; read the manifest and update it with new files for backup.
-			m, err := ReadManifestData(data)
-			if err != nil {
-				return err
-			}
+			// Update the manifest with new files for backup. (Always save a resumed
+			// checkpoint as a snapshot, even if nothing else changed.)
 			changed := m.Compare(ls)
-			if len(changed) > 0 {
+			removed := m.Removed(ls, scanner.Covers)
+			if len(changed) > 0 || len(removed) > 0 || resumed {
 				m.Update(changed)
+				m.Delete(removed)
+				log.Printf("core: %d files changed, %d files deleted\n", len(changed), len(removed))
 				err = backupLatest(bucket, m)
 				if err != nil {
 					return err
 				}
 			}
-		case bucket.IsNotExist(err):
+		default:
 			// Manifest not found; create a new one with files for backup.
+			log.Printf("core: first backup of %s\n", l)
 			m := NewManifest(ls)
+			m.Lineage = l
 			err = backupLatest(bucket, m)
 			if err != nil {
 				return err
 			}
-		default:
-			// Other error; bail out.
-			return err
 		}
 	}
 	return nil
 }
 
+// SelectSnapshot finds a snapshot of some lineage by its ID, or else the newest
+// one taken at or before some time. With neither given, it returns the latest
+// snapshot of the lineage (or of any, if the lineage is empty).
+func SelectSnapshot(bucket *store.Store, l Lineage, id string, asOf time.Time) (Snapshot, error) {
+	if id == "" && asOf.IsZero() && l.IsEmpty() {
+		m, err := getSnapshotManifest(bucket, "")
+		if err != nil {
+			return Snapshot{}, err
+		}
+		return newSnapshot(&m), nil
+	}
+	list, err := ListSnapshots(bucket)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	list = FilterSnapshots(list, l)
+	switch {
+	case id != "":
+		return FindSnapshot(list, id)
+	case !asOf.IsZero():
+		return FindSnapshotAsOf(list, asOf)
+	case len(list) == 0:
+		return Snapshot{}, ErrSnapshotNotFound
+	}
+	return list[len(list)-1], nil
+}
+
 // Restore changed files from the store to a particular folder.
 // Will do an incremental restore and only write the files that are different.
 func RestoreToPath(bucket *store.Store, root string, incl []string) error {
-	// Fetch last manifest.
-	data, err := getLatestManifest(bucket)
+	return RestoreSnapshotToPath(bucket, "", root, incl)
+}
+
+// Restore changed files from some snapshot in the store to a particular folder.
+// If the snapshot ID is blank, the latest snapshot is used.
+func RestoreSnapshotToPath(bucket *store.Store, id string, root string, incl []string) error {
+	m, err := getSnapshotManifest(bucket, id)
 	if err != nil {
 		return err
 	}
-	m, err := ReadManifestData(data)
+	return restoreManifest(bucket, m, root, incl)
+}
+
+// Restore changed files from the latest snapshot of a lineage to a particular folder.
+// Returns ErrSnapshotNotFound if the lineage has no snapshots yet.
+func RestoreLineageToPath(bucket *store.Store, l Lineage, root string, incl []string) error {
+	m, err := getLineageManifest(bucket, l)
 	if err != nil {
 		return err
 	}
+	return restoreManifest(bucket, m, root, incl)
+}
+
+func restoreManifest(bucket *store.Store, m Manifest, root string, incl []string) error {
+	log.Printf("restore: using snapshot %s (%s)\n", m.LastSet, newSnapshot(&m).Time())
 
 	// Ensure the root folder exists.
 	if err := file.MakeDir(root); err != nil {
@@ -140,8 +266,15 @@ func RestoreToPath(bucket *store.Store, root string, incl []string) error {
 		return false
 	}
 
-	// Map of which blobs to fetch, containing the files for restore.
-	targets := make(map[string][]file.File)
+	// Map of which blobs to fetch, containing the files (by their name in the blob)
+	// for restore.
+	targets := make(map[string]map[string][]file.File)
+	// The parts of each blob to fetch, if we only need some of it. (Blobs stored
+	// before we packed files separately have to be fetched whole.)
+	ranges := make(map[string]map[store.ByteRange]bool)
+	whole := make(map[string]bool)
+	// Large files, restored from their chunks.
+	var chunked []*ManifestEntry
 
 	// Scan and tag for restore.
 	localFiles := file.NewScanner().IncludePath(root).ScanRelativeTo(root)
@@ -154,6 +287,9 @@ func RestoreToPath(bucket *store.Store, root string, incl []string) error {
 
 	local := NewManifest(localFiles)
 	for _, e := range m.Entries {
+		if e.Deleted {
+			continue // wasn't on disk at the time of this snapshot
+		}
 		if !local.HasIdentical(e.File) && included(e.Path()) {
 			subdir := path.Join(root, path.Dir(e.Path()))
 			if e.IsDir() { // restore directly from the manifest data
@@ -161,24 +297,44 @@ func RestoreToPath(bucket *store.Store, root string, incl []string) error {
 				if err := archive.RestoreDir(subdir, e.File); err != nil {
 					// TODO: Handle this better.
 				}
+			} else if e.isChunked() {
+				chunked = append(chunked, e)
 			} else {
-				key := "blob/" + e.Set + "/" + e.Parts[0].Key
-				targets[key] = append(targets[key], e.File)
+				p := e.Parts[0]
+				key, name := e.objectKey(p), e.archiveName(p)
+				if targets[key] == nil {
+					targets[key] = make(map[string][]file.File)
+					ranges[key] = make(map[store.ByteRange]bool)
+				}
+				targets[key][name] = append(targets[key][name], e.File)
+				if p.Range == emptyRange {
+					whole[key] = true
+				} else {
+					ranges[key][p.Range] = true
+				}
 			}
 		}
 	}
 
 	// Fetch blobs and restore selected files from each blob.
-	for key, list := range targets {
-		only := make(map[string]file.File)
-		for _, f := range list {
-			only[f.Path()] = f
+	for key, names := range targets {
+		var tarball io.Reader
+		if whole[key] {
+			tarball, err = bucket.GetReader(key)
+		} else {
+			tarball, err = bucket.GetReaderParts(key, sortedRanges(ranges[key]))
 		}
-		tarball, err := bucket.GetReader(key)
 		if err != nil {
 			return err
 		}
-		if err := archive.UnpackReader(root, tarball, only); err != nil {
+		if err := archive.UnpackReaderTo(root, tarball, names); err != nil {
+			return err
+		}
+	}
+
+	// Reassemble large files from their chunks.
+	for _, e := range chunked {
+		if err := archive.RestoreFile(root, e.File, newChunkReader(bucket, e)); err != nil {
 			return err
 		}
 	}
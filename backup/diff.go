@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"github.com/aviddiviner/inc/file"
+	"sort"
+)
+
+// ChangeKind classifies how a file differs between two snapshots.
+type ChangeKind string
+
+const (
+	Added    ChangeKind = "added"    // only found in the newer snapshot
+	Removed  ChangeKind = "removed"  // only found in the older snapshot
+	Modified ChangeKind = "modified" // file contents (or type) changed
+	Metadata ChangeKind = "metadata" // only the mode, owner or mtime changed
+)
+
+// Change is a single difference found between two snapshots.
+type Change struct {
+	Kind ChangeKind `json:"kind"`
+	Path string     `json:"path"`
+	Size int64      `json:"size"` // size of the newer file, or the removed file
+}
+
+// Diff is the full list of changes between two snapshots, sorted by path.
+type Diff struct {
+	Changes []Change           `json:"changes"`
+	Summary map[ChangeKind]int `json:"summary"`
+}
+
+func (d *Diff) add(kind ChangeKind, f file.File) {
+	d.Changes = append(d.Changes, Change{kind, f.Path(), f.Size})
+	d.Summary[kind] += 1
+}
+
+func (d *Diff) sort() {
+	sort.Slice(d.Changes, func(i, j int) bool {
+		return d.Changes[i].Path < d.Changes[j].Path
+	})
+}
+
+func newDiff() Diff {
+	return Diff{Summary: map[ChangeKind]int{Added: 0, Removed: 0, Modified: 0, Metadata: 0}}
+}
+
+// Compare the contents and then metadata of a file against an older entry.
+// Returns a blank kind if they are the same.
+func compareEntry(before *ManifestEntry, after file.File) ChangeKind {
+	if before.Mode&^before.Mode.Perm() != after.Mode&^after.Mode.Perm() {
+		return Modified // file type changed
+	}
+	if !after.IsDir() {
+		if before.Size != after.Size {
+			return Modified
+		}
+		if before.HasChecksum() && after.HasChecksum() && before.SHA1 != after.SHA1 {
+			return Modified
+		}
+	}
+	if before.Mode != after.Mode || before.UID != after.UID || before.GID != after.GID ||
+		!before.ModTime.Equal(after.ModTime) {
+		return Metadata
+	}
+	return ""
+}
+
+// DiffManifests lists the changes going from one manifest to another.
+func DiffManifests(before, after *Manifest) Diff {
+	d := newDiff()
+	for _, a := range after.Entries {
+		if a.Deleted {
+			continue
+		}
+		b, ok := before.pathMap[a.Path()]
+		if !ok || b.Deleted {
+			d.add(Added, a.File)
+		} else if kind := compareEntry(b, a.File); kind != "" {
+			d.add(kind, a.File)
+		}
+	}
+	for _, b := range before.Entries {
+		if b.Deleted {
+			continue
+		}
+		if a, ok := after.pathMap[b.Path()]; !ok || a.Deleted {
+			d.add(Removed, b.File)
+		}
+	}
+	d.sort()
+	return d
+}
+
+// DiffDisk lists the changes going from a manifest to the files on disk. Only
+// the scanned paths are compared.
+func DiffDisk(before *Manifest, scanner *file.PathScanner) Diff {
+	d := newDiff()
+	ls := scanner.Scan()
+
+	// Compare finds the new and changed files, hashing only what it needs to.
+	changed := make(map[string]bool)
+	for _, f := range before.Compare(ls) {
+		changed[f.Path()] = true
+		if before.Has(f) && !before.pathMap[f.Path()].Deleted {
+			d.add(Modified, f)
+		} else {
+			d.add(Added, f)
+		}
+	}
+	// The rest have the same contents. Check if their metadata is different.
+	for _, f := range ls {
+		if changed[f.Path()] {
+			continue
+		}
+		b := before.pathMap[f.Path()]
+		if !before.HasIdentical(f) || compareEntry(b, f) != "" {
+			d.add(Metadata, f)
+		}
+	}
+	for _, f := range before.Removed(ls, scanner.Covers) {
+		d.add(Removed, f)
+	}
+	d.sort()
+	return d
+}
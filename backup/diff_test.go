@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"github.com/aviddiviner/inc/file"
+	"github.com/aviddiviner/inc/util/test"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiffManifests(t *testing.T) {
+	kept, changed, touched, removed := mockFile(), mockFile(), mockFile(), mockFile()
+	before := NewManifest([]file.File{kept, changed, touched, removed})
+
+	after := NewManifest([]file.File{kept, changed, touched, removed})
+	changed.SHA1 = test.RandSHA1()
+	touched.ModTime = touched.ModTime.Add(time.Hour)
+	added := mockFile()
+	after.Update([]file.File{changed, touched, added})
+	after.Delete([]file.File{removed})
+
+	diff := DiffManifests(&before, &after)
+	assert.Len(t, diff.Changes, 4)
+	assert.Equal(t, map[ChangeKind]int{Added: 1, Removed: 1, Modified: 1, Metadata: 1}, diff.Summary)
+
+	kinds := make(map[string]ChangeKind)
+	for _, c := range diff.Changes {
+		kinds[c.Path] = c.Kind
+	}
+	assert.Equal(t, Added, kinds[added.Path()])
+	assert.Equal(t, Removed, kinds[removed.Path()])
+	assert.Equal(t, Modified, kinds[changed.Path()])
+	assert.Equal(t, Metadata, kinds[touched.Path()])
+
+	assert.Empty(t, DiffManifests(&after, &after).Changes)
+}
+
+func TestDiffDisk(t *testing.T) {
+	dir := test.CreateTempDir(t)
+	for _, name := range []string{"same", "changed", "touched", "chmod", "removed"} {
+		test.AppendToFile(t, filepath.Join(dir, name), name)
+	}
+	scan := func() []file.File { return file.NewScanner().IncludePath(dir).Scan() }
+	files := scan()
+	file.ChecksumFiles(files)
+	m := NewManifest(files)
+
+	test.AppendToFile(t, filepath.Join(dir, "changed"), "something else")
+	test.TouchFileTime(t, filepath.Join(dir, "touched"), time.Now().Add(time.Hour))
+	assert.NoError(t, os.Chmod(filepath.Join(dir, "chmod"), 0600))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "removed")))
+	test.AppendToFile(t, filepath.Join(dir, "added"), "added")
+
+	diff := DiffDisk(&m, file.NewScanner().IncludePath(dir))
+	kinds := make(map[string]ChangeKind)
+	for _, c := range diff.Changes {
+		kinds[filepath.Base(c.Path)] = c.Kind
+	}
+	assert.Equal(t, map[string]ChangeKind{
+		"added":            Added,
+		"removed":          Removed,
+		"changed":          Modified,
+		"touched":          Metadata,
+		"chmod":            Metadata,
+		filepath.Base(dir): Metadata, // the folder mtime changed
+	}, kinds)
+}
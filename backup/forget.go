@@ -0,0 +1,156 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aviddiviner/inc/store"
+	"log"
+	"time"
+)
+
+// Error when asked to forget snapshots without any rules for which to keep.
+var ErrNoRetentionPolicy = errors.New("no retention policy given; refusing to forget every snapshot")
+
+// RetentionPolicy decides which snapshots to keep when forgetting the rest.
+// The latest snapshot and any pinned snapshots are always kept.
+type RetentionPolicy struct {
+	Last    int           // keep the last n snapshots
+	Daily   int           // keep the last snapshot of each of the last n days (with snapshots)
+	Weekly  int           // keep the last snapshot of each of the last n weeks
+	Monthly int           // keep the last snapshot of each of the last n months
+	Within  time.Duration // keep all snapshots taken within this long before now
+}
+
+// IsEmpty returns true if the policy has no rules.
+func (p RetentionPolicy) IsEmpty() bool {
+	return p == RetentionPolicy{}
+}
+
+// A retention rule keeps the newest snapshot in each of the last n buckets.
+type retentionRule struct {
+	n      int
+	bucket func(t time.Time) string // nil means every snapshot is its own bucket
+	last   string
+}
+
+func (r *retentionRule) keep(s Snapshot) bool {
+	if r.n <= 0 {
+		return false
+	}
+	b := s.ID
+	if r.bucket != nil {
+		b = r.bucket(s.Time().Local())
+	}
+	if b == r.last {
+		return false
+	}
+	r.last = b
+	r.n -= 1
+	return true
+}
+
+// Apply splits a list of snapshots into those to keep and those to forget,
+// both sorted from oldest to newest.
+func (p RetentionPolicy) Apply(list []Snapshot, now time.Time) (keep, forget []Snapshot) {
+	sorted := append([]Snapshot(nil), list...)
+	sortSnapshots(sorted)
+
+	rules := []*retentionRule{
+		{n: p.Last},
+		{n: p.Daily, bucket: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{n: p.Weekly, bucket: func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", y, w)
+		}},
+		{n: p.Monthly, bucket: func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	// Walk from newest to oldest, so each rule keeps the newest in its buckets.
+	for i := len(sorted) - 1; i >= 0; i-- {
+		s := sorted[i]
+		ok := i == len(sorted)-1 || s.Pinned
+		if p.Within > 0 && !s.Time().Before(now.Add(-p.Within)) {
+			ok = true
+		}
+		for _, r := range rules {
+			if r.keep(s) {
+				ok = true
+			}
+		}
+		if ok {
+			keep = append([]Snapshot{s}, keep...)
+		} else {
+			forget = append([]Snapshot{s}, forget...)
+		}
+	}
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// Forget removes the snapshots (of some lineage, or of all of them if it's empty)
+// not kept by the retention policy, deleting their manifests. The policy applies
+// to each lineage on its own, so every one keeps its latest snapshot. With dryRun,
+// nothing is removed; it only returns what would be.
+//
+// No file data is deleted here. Newer manifests still refer to the blobs of the
+// older sets their files were stored in, so the data is only deleted by Prune
+// once no manifest refers to it anymore.
+func Forget(bucket *store.Store, l Lineage, policy RetentionPolicy, now time.Time, dryRun bool) (keep, forget []Snapshot, err error) {
+	if policy.IsEmpty() {
+		err = ErrNoRetentionPolicy
+		return
+	}
+	list, err := ListSnapshots(bucket)
+	if err != nil {
+		return
+	}
+	var others []Snapshot // in other lineages; always kept
+	for lineage, group := range groupSnapshots(list) {
+		if !l.Matches(lineage) {
+			others = append(others, group...)
+			continue
+		}
+		k, f := policy.Apply(group, now)
+		keep = append(keep, k...)
+		forget = append(forget, f...)
+	}
+	sortSnapshots(keep)
+	sortSnapshots(forget)
+	log.Printf("forget: keeping %d snapshots, forgetting %d\n", len(keep), len(forget))
+	if dryRun || len(forget) == 0 {
+		return
+	}
+
+	// Update the index first, so we never list a snapshot without a manifest.
+	if err = putSnapshots(bucket, append(others, keep...)); err != nil {
+		return
+	}
+	for _, s := range forget {
+		if e := deleteStoreObject(bucket, "manifest/"+s.ID); e != nil && !bucket.IsNotExist(e) {
+			log.Printf("forget: error deleting manifest %s: %s\n", s.ID, e)
+			err = e
+		}
+	}
+	return
+}
+
+// PinSnapshot pins (or unpins) a snapshot, so it is never forgotten.
+func PinSnapshot(bucket *store.Store, id string, pinned bool) (snap Snapshot, err error) {
+	list, err := ListSnapshots(bucket)
+	if err != nil {
+		return
+	}
+	snap, err = FindSnapshot(list, id)
+	if err != nil {
+		return
+	}
+	for i := range list {
+		if list[i].ID == snap.ID {
+			list[i].Pinned = pinned
+			snap = list[i]
+		}
+	}
+	err = putSnapshots(bucket, list)
+	return
+}
@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Two snapshots a day (at 9:00 and 18:00) for all of January, 2016.
+func mockDailySnapshots() (list []Snapshot) {
+	for d := 1; d <= 31; d++ {
+		for _, h := range []int{9, 18} {
+			t := time.Date(2016, 1, d, h, 0, 0, 0, time.Local)
+			list = append(list, Snapshot{ID: manifestKey(t), Updated: t})
+		}
+	}
+	return
+}
+
+func snapshotTimes(list []Snapshot) (times []string) {
+	for _, s := range list {
+		times = append(times, s.Time().Format("01-02 15"))
+	}
+	return
+}
+
+func TestRetentionPolicyKeepsLatest(t *testing.T) {
+	list := mockDailySnapshots()
+	now := list[len(list)-1].Time()
+
+	keep, forget := RetentionPolicy{Within: time.Minute}.Apply(list, now)
+	assert.Equal(t, []string{"01-31 18"}, snapshotTimes(keep))
+	assert.Len(t, forget, len(list)-1)
+
+	keep, forget = RetentionPolicy{Last: 3}.Apply(list, now)
+	assert.Equal(t, []string{"01-30 18", "01-31 09", "01-31 18"}, snapshotTimes(keep))
+	assert.Len(t, forget, len(list)-3)
+}
+
+func TestRetentionPolicyBuckets(t *testing.T) {
+	list := mockDailySnapshots()
+	now := list[len(list)-1].Time()
+
+	keep, _ := RetentionPolicy{Daily: 3}.Apply(list, now)
+	assert.Equal(t, []string{"01-29 18", "01-30 18", "01-31 18"}, snapshotTimes(keep))
+
+	// ISO weeks start on Mondays; the 25th, 18th and 11th.
+	keep, _ = RetentionPolicy{Weekly: 3}.Apply(list, now)
+	assert.Equal(t, []string{"01-17 18", "01-24 18", "01-31 18"}, snapshotTimes(keep))
+
+	keep, _ = RetentionPolicy{Monthly: 6}.Apply(list, now)
+	assert.Equal(t, []string{"01-31 18"}, snapshotTimes(keep))
+
+	keep, _ = RetentionPolicy{Within: 36 * time.Hour}.Apply(list, now)
+	assert.Equal(t, []string{"01-30 09", "01-30 18", "01-31 09", "01-31 18"}, snapshotTimes(keep))
+
+	// Rules add up, rather than each narrowing down the others.
+	keep, _ = RetentionPolicy{Last: 2, Daily: 2, Weekly: 2}.Apply(list, now)
+	assert.Equal(t, []string{"01-24 18", "01-30 18", "01-31 09", "01-31 18"}, snapshotTimes(keep))
+}
+
+func TestRetentionPolicyKeepsPinned(t *testing.T) {
+	list := mockDailySnapshots()
+	list[4].Pinned = true
+	now := list[len(list)-1].Time()
+
+	keep, forget := RetentionPolicy{Last: 1}.Apply(list, now)
+	assert.Equal(t, []string{"01-03 09", "01-31 18"}, snapshotTimes(keep))
+	assert.Len(t, forget, len(list)-2)
+	assert.True(t, RetentionPolicy{}.IsEmpty())
+}
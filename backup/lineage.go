@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"github.com/aviddiviner/inc/store"
+	"os"
+)
+
+// The backup set used when none is named.
+const DefaultBackupSet = "default"
+
+// Lineage names a line of snapshots, each carrying on from the one before; the
+// backups of one backup set, from one host. Many lineages can share a store
+// (and the file data they have in common).
+//
+// When selecting snapshots, blank fields match any host or backup set.
+// Snapshots taken before lineages existed have neither.
+type Lineage struct {
+	Host      string `json:"host,omitempty"`
+	BackupSet string `json:"backupSet,omitempty"`
+}
+
+// LocalLineage returns the lineage of some backup set on this host. A blank set
+// name means the default set.
+func LocalLineage(set string) Lineage {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	if set == "" {
+		set = DefaultBackupSet
+	}
+	return Lineage{Host: host, BackupSet: set}
+}
+
+func (l Lineage) String() string {
+	host, set := l.Host, l.BackupSet
+	if host == "" {
+		host = "*"
+	}
+	if set == "" {
+		set = "*"
+	}
+	return host + "/" + set
+}
+
+// IsEmpty returns true if the lineage has no host or backup set; it matches every snapshot.
+func (l Lineage) IsEmpty() bool {
+	return l == Lineage{}
+}
+
+// Matches returns true if some other lineage is selected by this one.
+func (l Lineage) Matches(o Lineage) bool {
+	return (l.Host == "" || l.Host == o.Host) && (l.BackupSet == "" || l.BackupSet == o.BackupSet)
+}
+
+// FilterSnapshots returns the snapshots in some lineage (or matching a partial one).
+func FilterSnapshots(list []Snapshot, l Lineage) (found []Snapshot) {
+	for _, s := range list {
+		if l.Matches(s.Lineage) {
+			found = append(found, s)
+		}
+	}
+	return
+}
+
+// Group snapshots by their lineage.
+func groupSnapshots(list []Snapshot) map[Lineage][]Snapshot {
+	groups := make(map[Lineage][]Snapshot)
+	for _, s := range list {
+		groups[s.Lineage] = append(groups[s.Lineage], s)
+	}
+	return groups
+}
+
+// -----------------------------------------------------------------------------
+
+// The store metadata field pointing at the latest manifest of a lineage.
+func latestKey(l Lineage) string {
+	return "manifest/latest/" + l.Host + "/" + l.BackupSet
+}
+
+// Get the latest manifest of a lineage. Returns ErrSnapshotNotFound if it has
+// no snapshots yet.
+func getLineageManifest(bucket *store.Store, l Lineage) (m Manifest, err error) {
+	id, err := bucket.GetMetadata(latestKey(l))
+	switch err {
+	case nil:
+		if val, ok := id.(string); ok {
+			return GetManifest(bucket, val)
+		}
+		err = store.ErrMalformedMetadata
+		return
+	case store.ErrMissingMetadata:
+		// Stores written before lineages had just the one latest manifest. The
+		// first lineage to back up carries on from it.
+		var data []byte
+		data, err = getLatestManifest(bucket)
+		if bucket.IsNotExist(err) {
+			err = ErrSnapshotNotFound
+		}
+		if err != nil {
+			return
+		}
+		if m, err = ReadManifestData(data); err != nil {
+			return
+		}
+		if !m.Lineage.IsEmpty() {
+			return Manifest{}, ErrSnapshotNotFound
+		}
+		m.Lineage = l
+	}
+	return
+}
@@ -1,34 +1,115 @@
 package backup
 
 import (
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"github.com/aviddiviner/inc/file"
 	"github.com/aviddiviner/inc/store"
 	"github.com/aviddiviner/inc/util"
+	"sort"
 	"time"
 )
 
 type Manifest struct {
 	Version int              `json:"version"`
 	LastSet string           `json:"lastSet"`
+	Lineage                  // the host and backup set this is a snapshot of
 	Created time.Time        `json:"created"`
 	Updated time.Time        `json:"updated"`
+	Partial bool             `json:"partial,omitempty"` // a checkpoint of a backup in progress, not a snapshot
 	Entries []*ManifestEntry `json:"entries"`
 
 	//sync.RWMutex
-	pathMap map[string]*ManifestEntry
+	pathMap    map[string]*ManifestEntry
+	contentMap map[[sha1.Size]byte]contentRef
+	chunkMap   map[string]string        // chunk keys by content hash (see chunkIndex)
+	deduped    int64                    // bytes of file data which the last Update found already stored
+	chunking   []string                 // paths of large files added by the last Update, still to be chunked
+	raw        map[string]bool          // objects of the last Update to store uncompressed, by key (set/key)
+	previous   map[string]ManifestEntry // entries the last Update replaced with new data, by path (see revert)
+	sniffed    map[string]bool          // files whose start looks compressed already, by path (see checksumFiles)
 }
 
 type ManifestEntry struct {
 	file.File
-	Set   string
-	Parts []ManifestEntryPart
+	Set     string
+	Parts   []ManifestEntryPart
+	Deleted bool // tombstone; the file was deleted from disk in this Set
 }
 
 type ManifestEntryPart struct {
 	Key   string          `json:"key"`
 	Range store.ByteRange `json:"range"`
+	Name  string          `json:"name"` // path of the data in the object, if stored for another file
+	Size  int64           `json:"size"` // length of the data, if this is a chunk of a large file
+}
+
+// Large files are split into chunks, each stored as its own object. Chunks are
+// named by a hash of their contents, so they can be shared between files (and
+// versions of the same file) across sets.
+func (p ManifestEntryPart) isChunk() bool {
+	return p.Size > 0
+}
+
+// Is this entry's data stored in chunks?
+func (e *ManifestEntry) isChunked() bool {
+	return len(e.Parts) > 0 && e.Parts[0].isChunk()
+}
+
+// The store object holding a part of this entry's data.
+func (e *ManifestEntry) objectKey(p ManifestEntryPart) string {
+	if p.isChunk() {
+		return "chunk/" + p.Key
+	}
+	return "blob/" + e.Set + "/" + p.Key
+}
+
+// The path of this entry's data within an object. When the same content was
+// already stored for another file, this is the path of that file.
+func (e *ManifestEntry) archiveName(p ManifestEntryPart) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return e.Path()
+}
+
+// Where some file content is already stored.
+type contentRef struct {
+	set   string
+	parts []ManifestEntryPart
+}
+
+// Can the contents of a file be pointed at data stored for some other file?
+func isDedupable(f file.File) bool {
+	return f.IsRegular() && f.Size > 0 && f.HasChecksum()
+}
+
+// Index an entry by its content, unless some other entry already has the same.
+func (m *Manifest) addContent(e *ManifestEntry) {
+	if e.Deleted || len(e.Parts) == 0 || !isDedupable(e.File) {
+		return
+	}
+	if _, ok := m.contentMap[e.SHA1]; ok {
+		return
+	}
+	ref := contentRef{set: e.Set}
+	for _, p := range e.Parts {
+		if !p.isChunk() {
+			p.Name = e.archiveName(p)
+		}
+		ref.parts = append(ref.parts, p)
+	}
+	m.contentMap[e.SHA1] = ref
+}
+
+// Index all the (live) entries by SHA1, so that files with the same contents can
+// share the data already in the store.
+func (m *Manifest) buildContentMap() {
+	m.contentMap = make(map[[sha1.Size]byte]contentRef)
+	for _, e := range m.Entries {
+		m.addContent(e)
+	}
 }
 
 // -----------------------------------------------------------------------------
@@ -62,11 +143,25 @@ func (m *Manifest) Remove(f file.File) bool {
 	return true
 }
 
+// Undo the last Update of a file whose data failed to store. It goes back to its
+// entry from before, which still points at the data stored by an earlier set, or
+// out of the manifest if it had none.
+func (m *Manifest) revert(f file.File) {
+	if ref, ok := m.contentMap[f.SHA1]; ok && ref.set == m.LastSet && isDedupable(f) {
+		delete(m.contentMap, f.SHA1) // nothing else can point at the data now
+	}
+	if e, ok := m.previous[f.Path()]; ok {
+		m.putEntry(&e)
+		return
+	}
+	m.Remove(f)
+}
+
 // -----------------------------------------------------------------------------
 
 func (m *Manifest) HasIdentical(their file.File) bool {
 	our, ok := m.pathMap[their.Path()]
-	if !ok {
+	if !ok || our.Deleted {
 		return false
 	}
 	if !our.IsDir() && our.Size != their.Size {
@@ -90,7 +185,9 @@ func (before *Manifest) Compare(after []file.File) []file.File {
 	for _, a := range after {
 		if before.Has(a) {
 			b := before.pathMap[a.Path()]
-			if !a.IsDir() && a.Size != b.Size { // non-dir, size different
+			if b.Deleted { // deleted before; must be new again
+				changed = append(changed, a)
+			} else if !a.IsDir() && a.Size != b.Size { // non-dir, size different
 				changed = append(changed, a)
 			} else if !a.ModTime.Equal(b.ModTime) { // timestamp touched
 				touched = append(touched, a)
@@ -100,7 +197,7 @@ func (before *Manifest) Compare(after []file.File) []file.File {
 		}
 	}
 
-	file.ChecksumFiles(touched, changed)
+	before.checksumFiles(touched, changed)
 
 	for _, a := range touched {
 		b := before.pathMap[a.Path()]
@@ -112,6 +209,24 @@ func (before *Manifest) Compare(after []file.File) []file.File {
 	return changed
 }
 
+// Removed returns the files we have entries for, which are no longer found on
+// disk. Only paths covered by the scan are considered, so that files from paths
+// which simply weren't scanned this time are not counted as removed.
+func (before *Manifest) Removed(after []file.File, covered func(path string) bool) []file.File {
+	found := make(map[string]bool, len(after))
+	for _, a := range after {
+		found[a.Path()] = true
+	}
+
+	var removed []file.File
+	for _, b := range before.Entries {
+		if !b.Deleted && !found[b.Path()] && covered(b.Path()) {
+			removed = append(removed, b.File)
+		}
+	}
+	return removed
+}
+
 // -----------------------------------------------------------------------------
 
 // Used to avoid infinite recursion in UnmarshalJSON below.
@@ -125,7 +240,7 @@ func (m *Manifest) buildPathMap() {
 }
 
 func (m *Manifest) MarshalJSON() ([]byte, error) {
-	m.Version = 3
+	m.Version = 7
 	return json.Marshal(*m)
 }
 
@@ -162,6 +277,9 @@ func (f *ManifestEntry) MarshalJSON() ([]byte, error) {
 	if f.HasChecksum() {
 		jsonMap["sha1"] = f.SHA1[:] // convert to slice = base64 encoded
 	}
+	if f.Deleted {
+		jsonMap["deleted"] = true
+	}
 
 	return json.Marshal(jsonMap)
 }
@@ -193,6 +311,9 @@ func (f *ManifestEntry) UnmarshalJSON(data []byte) (err error) {
 		errors["sha1"] = json.Unmarshal(*sha1, &b)
 		copy(f.SHA1[:], b)
 	}
+	if deleted, ok := keymap["deleted"]; ok {
+		errors["deleted"] = json.Unmarshal(*deleted, &f.Deleted)
+	}
 	for _, v := range errors {
 		if v != nil {
 			return v
@@ -206,6 +327,15 @@ func (f *ManifestEntry) UnmarshalJSON(data []byte) (err error) {
 
 var emptyRange = [2]int{}
 
+// Sort a set of byte ranges by their offsets.
+func sortedRanges(set map[store.ByteRange]bool) (ranges []store.ByteRange) {
+	for r := range set {
+		ranges = append(ranges, r)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	return
+}
+
 func (p *ManifestEntryPart) MarshalJSON() ([]byte, error) {
 	jsonMap := map[string]interface{}{
 		"key": p.Key,
@@ -214,6 +344,12 @@ func (p *ManifestEntryPart) MarshalJSON() ([]byte, error) {
 	if p.Range != emptyRange {
 		jsonMap["range"] = p.Range
 	}
+	if p.Name != "" {
+		jsonMap["name"] = p.Name
+	}
+	if p.Size > 0 {
+		jsonMap["size"] = p.Size
+	}
 
 	return json.Marshal(jsonMap)
 }
@@ -239,7 +375,7 @@ func ReadManifestData(data []byte) (m Manifest, err error) {
 		switch ver {
 		case 1, 2:
 			err = unmarshalV2Manifest(data, &m)
-		case 3:
+		case 3, 4, 5, 6, 7:
 			err = json.Unmarshal(data, &m)
 		default:
 			err = ErrBadVersion
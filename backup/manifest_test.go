@@ -7,6 +7,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"os"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -131,6 +132,85 @@ func TestManifestAlterations(t *testing.T) {
 	}
 }
 
+func TestManifestTombstones(t *testing.T) {
+	files := []file.File{mockFileIn("/foo"), mockFileIn("/foo"), mockFileIn("/bar")}
+	m := NewManifest(files)
+	inFoo := func(path string) bool { return strings.HasPrefix(path, "/foo/") }
+
+	// Only files in scanned paths are counted as removed.
+	removed := m.Removed(files[1:], inFoo)
+	assert.Equal(t, []file.File{files[0]}, removed)
+	assert.Empty(t, m.Removed(files[:2], inFoo))
+
+	m.Update(nil)
+	m.Delete(removed)
+	tomb := m.pathMap[files[0].Path()]
+	assert.True(t, tomb.Deleted)
+	assert.Equal(t, m.LastSet, tomb.Set)
+	assert.Empty(t, tomb.Parts)
+	assert.Len(t, m.Entries, 3)
+
+	// Tombstones survive marshalling.
+	data, err := m.JSON()
+	assert.NoError(t, err)
+	after, err := ReadManifestData(data)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, after.Version)
+	assert.True(t, after.pathMap[files[0].Path()].Deleted)
+
+	// A deleted file is not removed twice, and is changed if it comes back.
+	assert.Empty(t, m.Removed(files[1:], inFoo))
+	assert.False(t, m.HasIdentical(files[0]))
+	assert.Equal(t, []file.File{files[0]}, m.Compare(files[:1]))
+
+	m.Update(files[:1])
+	assert.False(t, m.pathMap[files[0].Path()].Deleted)
+	assert.True(t, m.HasIdentical(files[0]))
+}
+
+func TestManifestDedup(t *testing.T) {
+	orig := mockFile()
+	m := NewManifest([]file.File{orig})
+	origSet := m.LastSet
+	assert.Zero(t, m.deduped)
+
+	// A copy of a file already stored points at the stored data.
+	copied := mockFile()
+	copied.SHA1 = orig.SHA1
+	m.Update([]file.File{copied})
+	e := m.pathMap[copied.Path()]
+	assert.Equal(t, origSet, e.Set)
+	assert.Equal(t, []ManifestEntryPart{{Key: "0", Name: orig.Path()}}, e.Parts)
+	assert.EqualValues(t, copied.Size, m.deduped)
+	assert.Empty(t, m.LatestEntries())
+
+	// Two new copies of the same file only store it once.
+	first, second, link := mockFile(), mockFile(), mockSymlink()
+	second.SHA1 = first.SHA1
+	link.SHA1 = first.SHA1
+	m.Update([]file.File{first, second, link})
+	assert.Equal(t, m.LastSet, m.pathMap[second.Path()].Set)
+	assert.Equal(t, first.Path(), m.pathMap[second.Path()].Parts[0].Name)
+	assert.Empty(t, m.pathMap[link.Path()].Parts[0].Name)
+	assert.EqualValues(t, second.Size, m.deduped)
+	for _, entries := range m.LatestEntries() {
+		assert.Len(t, entries, 2) // first and link
+	}
+	assert.Len(t, m.entriesStoredIn(m.pathMap[first.Path()].objectKey(m.pathMap[first.Path()].Parts[0])), 3)
+
+	// Shared data survives marshalling, and is used again after.
+	data, err := m.JSON()
+	assert.NoError(t, err)
+	after, err := ReadManifestData(data)
+	assert.NoError(t, err)
+	assert.Equal(t, orig.Path(), after.pathMap[copied.Path()].Parts[0].Name)
+	another := mockFile()
+	another.SHA1 = copied.SHA1
+	after.Update([]file.File{another})
+	assert.Equal(t, orig.Path(), after.pathMap[another.Path()].Parts[0].Name)
+	assert.Equal(t, origSet, after.pathMap[another.Path()].Set)
+}
+
 func TestManifestKeyIsAlwaysUnique(t *testing.T) {
 	oldFiles := []file.File{mockFile(), mockFile(), mockFile()}
 	newFiles := []file.File{mockFile(), mockFile()}
@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/util"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PruneReport lists the unreferenced objects found (and deleted) by a prune.
+type PruneReport struct {
+	Referenced   int      // objects still referenced by some snapshot
+	Unreferenced []string // objects not referenced by any snapshot
+	Bytes        int64    // total stored size of the unreferenced objects
+	Deleted      int      // objects actually deleted
+}
+
+// Collect the objects referenced by the live entries of a manifest.
+func (m *Manifest) addReferencedKeys(keys map[string]bool) {
+	for _, e := range m.Entries {
+		if e.Deleted {
+			continue
+		}
+		for _, p := range e.Parts {
+			keys[e.objectKey(p)] = true
+		}
+	}
+}
+
+// Get the set ID from a blob/<set>/<key> (or chunk/<set>/<hash>) object key.
+func objectSet(key string) string {
+	parts := strings.Split(key, "/")
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Find the blob and chunk objects which aren't referenced by any of the snapshots
+// listed (or by a checkpoint), with their sizes, and count those which are.
+// Objects of sets newer than the latest snapshot aren't counted either way.
+func unreferencedObjects(bucket *store.Store, list []Snapshot) (unreferenced map[string]int, referenced int, err error) {
+	keys := make(map[string]bool)
+	for _, snap := range list {
+		var m Manifest
+		if m, err = GetManifest(bucket, snap.ID); err != nil {
+			return
+		}
+		m.addReferencedKeys(keys)
+	}
+	// Keep the data of unfinished backups, to be resumed.
+	checkpoints, err := listCheckpoints(bucket)
+	if err != nil {
+		return
+	}
+	for _, set := range checkpoints {
+		var m Manifest
+		if m, err = readCheckpoint(bucket, set); err != nil {
+			return
+		}
+		m.addReferencedKeys(keys)
+	}
+	var latest time.Time
+	if len(list) > 0 {
+		latest = setTime(list[len(list)-1].ID)
+	}
+
+	objects, err := bucket.List("blob/")
+	if err != nil {
+		return
+	}
+	chunks, err := bucket.List("chunk/")
+	if err != nil {
+		return
+	}
+	for key, size := range chunks {
+		objects[key] = size
+	}
+	unreferenced = make(map[string]int)
+	for key, size := range objects {
+		if keys[key] {
+			referenced += 1
+			continue
+		}
+		if setTime(objectSet(key)).After(latest) {
+			continue // may still be in progress
+		}
+		unreferenced[key] = size
+	}
+	return
+}
+
+// Prune deletes all the blob and chunk objects which aren't referenced by any snapshot in
+// the store. With dryRun, nothing is deleted; only the report is returned.
+//
+// Blobs from sets newer than the latest snapshot are kept, since those might
+// belong to a backup that is still running, as are those of checkpoints left
+// by unfinished backups. (Once a later backup finishes, the blobs of any failed
+// backup before it will be pruned.)
+func Prune(bucket *store.Store, dryRun bool) (report PruneReport, err error) {
+	list, err := ListSnapshots(bucket)
+	if err != nil {
+		return
+	}
+	if len(list) == 0 {
+		log.Println("prune: no snapshots found, nothing to do")
+		return
+	}
+
+	unreferenced, referenced, err := unreferencedObjects(bucket, list)
+	if err != nil {
+		return // don't delete anything unless we know all that's referenced
+	}
+	report.Referenced = referenced
+	for key, size := range unreferenced {
+		report.Unreferenced = append(report.Unreferenced, key)
+		report.Bytes += int64(size)
+	}
+	sort.Strings(report.Unreferenced)
+	log.Printf("prune: %d objects referenced by %d snapshots, %d unreferenced (%s)\n",
+		report.Referenced, len(list), len(report.Unreferenced), util.ByteCount(report.Bytes))
+
+	if dryRun {
+		return
+	}
+	for _, key := range report.Unreferenced {
+		err = bucket.Delete(key)
+		if bucket.IsNotExist(err) {
+			err = nil // already gone
+		}
+		if err != nil {
+			return
+		}
+		report.Deleted += 1
+	}
+	return
+}
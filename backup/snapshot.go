@@ -0,0 +1,282 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/util"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error when no snapshot matches the ID or time requested.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Error when a snapshot ID prefix matches more than one snapshot.
+var ErrSnapshotAmbiguous = errors.New("snapshot id is ambiguous")
+
+// The store object holding the index of every manifest written to the store.
+const c_SNAPSHOTS_KEY = "manifest/index"
+
+// Hosts with write-only keys can't read the index to add their snapshots to it.
+// Each one is put under this prefix instead, and merged into the index by the
+// next host with the full keys to write it.
+const c_PENDING_SNAPSHOTS = "manifest/pending/"
+
+// Snapshot summarises a single manifest stored as manifest/<ID>.
+type Snapshot struct {
+	ID string `json:"id"`
+	Lineage
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	Files   int       `json:"files"` // number of files (not dirs) in the manifest
+	Added   int64     `json:"added"` // bytes of file data added by this backup set
+	Pinned  bool      `json:"pinned,omitempty"`
+}
+
+// Time returns when the snapshot was taken. Older manifests have no updated
+// time, so fall back to the time encoded in the set key.
+func (s Snapshot) Time() time.Time {
+	if !s.Updated.IsZero() {
+		return s.Updated
+	}
+	return setTime(s.ID)
+}
+
+type snapshotIndex struct {
+	Version   int        `json:"version"`
+	Snapshots []Snapshot `json:"snapshots"`
+}
+
+// Parse the time from a set key. Since v2, keys are the hex encoded UnixNano of
+// when the set was made. V1 keys were hex encoded Unix seconds.
+func setTime(key string) time.Time {
+	n, err := strconv.ParseInt(key, 16, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	if len(key) < 16 {
+		return time.Unix(n, 0)
+	}
+	return time.Unix(0, n)
+}
+
+func newSnapshot(m *Manifest) Snapshot {
+	s := Snapshot{ID: m.LastSet, Lineage: m.Lineage, Created: m.Created, Updated: m.Updated}
+	for _, e := range m.Entries {
+		if e.IsDir() || e.Deleted {
+			continue
+		}
+		s.Files += 1
+		if e.Set == m.LastSet && (len(e.Parts) == 0 || e.Parts[0].Name == "") {
+			s.Added += e.Size // not counting files sharing the data of others
+		}
+	}
+	return s
+}
+
+func sortSnapshots(list []Snapshot) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Time().Before(list[j].Time())
+	})
+}
+
+// -----------------------------------------------------------------------------
+
+// Get a particular manifest from the store by its set ID.
+func GetManifest(bucket *store.Store, id string) (m Manifest, err error) {
+	data, err := cacheGetStoreObject(bucket, "manifest/"+id)
+	if err != nil {
+		return
+	}
+	m, err = ReadManifestData(data)
+	if err == nil && m.Partial {
+		err = ErrPartialManifest
+	}
+	return
+}
+
+// ListSnapshots returns all the manifests stored, sorted from oldest to newest.
+func ListSnapshots(bucket *store.Store) ([]Snapshot, error) {
+	list, err := readSnapshots(bucket)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := bucket.List(c_PENDING_SNAPSHOTS)
+	if err != nil {
+		return nil, err
+	}
+	for key := range pending {
+		data, err := bucket.Get(key)
+		if bucket.IsNotExist(err) {
+			continue // merged since
+		}
+		if err != nil {
+			return nil, err
+		}
+		var snap Snapshot
+		if err = json.Unmarshal(data, &snap); err != nil {
+			return nil, err
+		}
+		list = mergeSnapshot(list, snap)
+	}
+	sortSnapshots(list)
+	return list, nil
+}
+
+// Read the snapshot index, or rebuild it if there isn't one.
+func readSnapshots(bucket *store.Store) ([]Snapshot, error) {
+	data, err := bucket.Get(c_SNAPSHOTS_KEY)
+	if bucket.IsNotExist(err) {
+		return rebuildSnapshots(bucket)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var index snapshotIndex
+	if ver, ok := util.ParseVersionJSON(data); ok {
+		switch ver {
+		case 1:
+			err = json.Unmarshal(data, &index)
+		default:
+			err = ErrBadVersion
+		}
+	} else {
+		err = ErrMalformedConfig
+	}
+	if err != nil {
+		return nil, err
+	}
+	return index.Snapshots, nil
+}
+
+// Write the snapshot index. The pending snapshots were merged into it when it
+// was listed; with the store locked, no others can have been added since.
+func putSnapshots(bucket *store.Store, list []Snapshot) error {
+	sortSnapshots(list)
+	data, err := json.Marshal(snapshotIndex{Version: 1, Snapshots: list})
+	if err != nil {
+		return err
+	}
+	if _, err = bucket.Put(c_SNAPSHOTS_KEY, data); err != nil {
+		return err
+	}
+	pending, err := bucket.List(c_PENDING_SNAPSHOTS)
+	if err != nil {
+		return err
+	}
+	for key := range pending {
+		if err = bucket.Delete(key); err != nil && !bucket.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add a snapshot to the index, replacing any existing one with the same ID (but
+// keeping it pinned, if it was). With write-only keys, leave it pending.
+func addSnapshot(bucket *store.Store, snap Snapshot) error {
+	if bucket.IsWriteOnly() {
+		data, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		_, err = bucket.Put(c_PENDING_SNAPSHOTS+snap.ID, data)
+		return err
+	}
+	list, err := ListSnapshots(bucket)
+	if err != nil {
+		return err
+	}
+	return putSnapshots(bucket, mergeSnapshot(list, snap))
+}
+
+// Add a snapshot to a list, replacing any with the same ID (but keeping it
+// pinned, if it was).
+func mergeSnapshot(list []Snapshot, snap Snapshot) []Snapshot {
+	for i := range list {
+		if list[i].ID == snap.ID {
+			snap.Pinned = snap.Pinned || list[i].Pinned
+			list[i] = snap
+			return list
+		}
+	}
+	return append(list, snap)
+}
+
+// Stores written before the snapshot index existed only know their latest
+// manifest. Every set referenced by its entries was also the latest at some
+// point, so we can find the older manifests that are still around from there.
+func rebuildSnapshots(bucket *store.Store) (list []Snapshot, err error) {
+	data, err := getLatestManifest(bucket)
+	if bucket.IsNotExist(err) {
+		return nil, nil // empty store
+	}
+	if err != nil {
+		return
+	}
+	latest, err := ReadManifestData(data)
+	if err != nil {
+		return
+	}
+	log.Println("snapshots: no index found, rebuilding from the latest manifest")
+	list = append(list, newSnapshot(&latest))
+	seen := map[string]bool{latest.LastSet: true}
+	for _, e := range latest.Entries {
+		if seen[e.Set] || e.Set == "" {
+			continue
+		}
+		seen[e.Set] = true
+		m, err := GetManifest(bucket, e.Set)
+		if bucket.IsNotExist(err) {
+			continue // manifest was never written, or is gone
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, newSnapshot(&m))
+	}
+	sortSnapshots(list)
+	return
+}
+
+// -----------------------------------------------------------------------------
+
+// FindSnapshot returns the snapshot matching some ID (or unique ID prefix).
+func FindSnapshot(list []Snapshot, id string) (Snapshot, error) {
+	var found []Snapshot
+	for _, s := range list {
+		if s.ID == id {
+			return s, nil
+		}
+		if strings.HasPrefix(s.ID, id) {
+			found = append(found, s)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return Snapshot{}, ErrSnapshotNotFound
+	case 1:
+		return found[0], nil
+	}
+	return Snapshot{}, ErrSnapshotAmbiguous
+}
+
+// FindSnapshotAsOf returns the newest snapshot taken at or before some time.
+func FindSnapshotAsOf(list []Snapshot, t time.Time) (Snapshot, error) {
+	var found *Snapshot
+	for i := range list {
+		if !list[i].Time().After(t) {
+			if found == nil || list[i].Time().After(found.Time()) {
+				found = &list[i]
+			}
+		}
+	}
+	if found == nil {
+		return Snapshot{}, ErrSnapshotNotFound
+	}
+	return *found, nil
+}
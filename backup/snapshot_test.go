@@ -0,0 +1,135 @@
+package backup
+
+import (
+	"github.com/aviddiviner/inc/file"
+	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/store/storage"
+	"github.com/aviddiviner/inc/util/test"
+	"github.com/stretchr/testify/assert"
+	"path"
+	"testing"
+	"time"
+)
+
+func mockSnapshots() []Snapshot {
+	day := func(d int) time.Time { return time.Date(2016, 1, d, 12, 0, 0, 0, time.UTC) }
+	return []Snapshot{
+		{ID: manifestKey(day(1)), Updated: day(1)},
+		{ID: manifestKey(day(3)), Updated: day(3)},
+		{ID: manifestKey(day(5)), Updated: day(5)},
+	}
+}
+
+func TestSetTime(t *testing.T) {
+	now := time.Now()
+	assert.True(t, now.Equal(setTime(manifestKey(now))))
+	assert.Equal(t, int64(1451502276), setTime("056842ac4").Unix()) // v1 key
+	assert.True(t, setTime("latest").IsZero())
+}
+
+func TestFindSnapshot(t *testing.T) {
+	list := mockSnapshots()
+
+	s, err := FindSnapshot(list, list[1].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, list[1], s)
+
+	s, err = FindSnapshot(list, list[2].ID[:12])
+	assert.NoError(t, err)
+	assert.Equal(t, list[2], s)
+
+	_, err = FindSnapshot(list, list[0].ID[:2])
+	assert.Equal(t, ErrSnapshotAmbiguous, err)
+
+	_, err = FindSnapshot(list, "foo")
+	assert.Equal(t, ErrSnapshotNotFound, err)
+}
+
+func TestFindSnapshotAsOf(t *testing.T) {
+	list := mockSnapshots()
+
+	s, err := FindSnapshotAsOf(list, list[1].Updated)
+	assert.NoError(t, err)
+	assert.Equal(t, list[1], s)
+
+	s, err = FindSnapshotAsOf(list, list[1].Updated.Add(47*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, list[1], s)
+
+	s, err = FindSnapshotAsOf(list, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, list[2], s)
+
+	_, err = FindSnapshotAsOf(list, list[0].Updated.Add(-time.Second))
+	assert.Equal(t, ErrSnapshotNotFound, err)
+}
+
+func TestNewSnapshotCountsFiles(t *testing.T) {
+	m := NewManifest([]file.File{mockFile(), mockFile()})
+	m.Update([]file.File{mockFile()})
+
+	s := newSnapshot(&m)
+	assert.Equal(t, m.LastSet, s.ID)
+	assert.Equal(t, 3, s.Files)
+	assert.EqualValues(t, 1234, s.Added)
+}
+
+func TestWriteOnlyBackup(t *testing.T) {
+	test.RandSeed(55)
+	defer func(p string) { defaultCachePath = p }(defaultCachePath)
+	defaultCachePath = test.CreateTempDir(t)
+	dir := test.CreateTempDir(t)
+	test.AppendToFile(t, path.Join(dir, "a.txt"), "some notes\n")
+	test.AppendToFile(t, path.Join(dir, "b.txt"), "other notes\n")
+	scanner := file.NewScanner().IncludePath(dir)
+
+	layer := storage.NewMockStorage()
+	bucket := store.NewStore(layer, "test")
+	keys, err := bucket.Wipe([]byte("secret"))
+	assert.NoError(t, err)
+	wk, err := keys.WriteOnly()
+	assert.NoError(t, err)
+	writer := store.NewStore(layer, "test")
+	assert.NoError(t, writer.OpenWriteOnly(wk))
+
+	// The second backup carries on from the (cached) manifest of the first.
+	l := Lineage{Host: "server", BackupSet: DefaultBackupSet}
+	assert.NoError(t, ScanAndBackupLineage(writer, l, scanner))
+	test.AppendToFile(t, path.Join(dir, "a.txt"), "more notes\n")
+	assert.NoError(t, ScanAndBackupLineage(writer, l, scanner))
+	_, err = ListSnapshots(writer)
+	assert.Equal(t, store.ErrWriteOnly, err)
+	pending, err := layer.List(c_PENDING_SNAPSHOTS)
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+
+	// The full keys read both snapshots, and merge them into the index.
+	bucket = store.NewStore(layer, "test")
+	assert.NoError(t, bucket.Open(keys))
+	list, err := ListSnapshots(bucket)
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	m, err := getLineageManifest(bucket, l)
+	assert.NoError(t, err)
+	assert.Equal(t, l, m.Lineage)
+	_, err = bucket.GetMetadata("manifest/latest")
+	assert.Equal(t, store.ErrMissingMetadata, err, "write-only hosts only touch their own lineage")
+	sets := map[string]bool{}
+	for _, e := range m.Entries {
+		if e.Set != "" && !e.IsDir() {
+			sets[e.Set] = true
+		}
+	}
+	assert.Len(t, sets, 2, "unchanged files point at the first snapshot")
+	report, err := Verify(bucket, &m, 100)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+
+	assert.NoError(t, putSnapshots(bucket, list))
+	pending, err = layer.List(c_PENDING_SNAPSHOTS)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	list, err = ListSnapshots(bucket)
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+}
@@ -0,0 +1,240 @@
+package backup
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/aviddiviner/inc/file/archive"
+	"github.com/aviddiviner/inc/store"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Error when verifying the store finds missing or corrupt data.
+var ErrVerifyFailed = errors.New("verify failed; store has missing or corrupt data")
+
+// VerifyReport lists the problems found when verifying a snapshot.
+type VerifyReport struct {
+	Objects int      // objects read
+	Files   int      // files checked
+	Missing []string // objects (or files in objects) that weren't found
+	Corrupt []string // objects that couldn't be read, or files with the wrong checksum
+	Extra   []string // blob and chunk objects which no snapshot refers to (see Prune); for information only
+}
+
+// OK returns true if nothing was missing or corrupt. Extra objects are left by any failed backup or forgotten
+// snapshot, until they're pruned, so they don't count.
+func (r VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0
+}
+
+// Pick a random sample of some percentage of keys (at least 1, if any).
+func sampleKeys(keys []string, percent float64) []string {
+	if percent >= 100 || len(keys) == 0 {
+		return keys
+	}
+	n := int(float64(len(keys))*percent/100 + 0.5)
+	if n < 1 {
+		n = 1
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var sample []string
+	for _, i := range rnd.Perm(len(keys))[:n] {
+		sample = append(sample, keys[i])
+	}
+	sort.Strings(sample)
+	return sample
+}
+
+// Verify reads back the objects referenced by a manifest (or some percentage of
+// them), checking that each one decrypts, decompresses and unpacks, and that
+// the files inside have the SHA1 recorded in the manifest. It also lists the
+// objects in the store which no snapshot refers to; these are left by failed
+// backups or forgotten snapshots, until they're pruned.
+func Verify(bucket *store.Store, m *Manifest, percent float64) (report VerifyReport, err error) {
+	targets := make(map[string]map[string][]*ManifestEntry)
+	chunked := make(map[string]*ManifestEntry)
+	for _, e := range m.Entries {
+		if e.Deleted || e.IsDir() || len(e.Parts) == 0 {
+			continue
+		}
+		if e.isChunked() {
+			chunked[e.Path()] = e
+			continue
+		}
+		key, name := e.objectKey(e.Parts[0]), e.archiveName(e.Parts[0])
+		if targets[key] == nil {
+			targets[key] = make(map[string][]*ManifestEntry)
+		}
+		targets[key][name] = append(targets[key][name], e)
+	}
+	var keys []string
+	for key := range targets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	keys = sampleKeys(keys, percent)
+	log.Printf("verify: checking %d of %d objects in snapshot %s\n", len(keys), len(targets), m.LastSet)
+
+	for _, key := range keys {
+		report.Objects += 1
+		verifyObject(bucket, key, targets[key], &report)
+	}
+
+	var paths []string
+	for p := range chunked {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	paths = sampleKeys(paths, percent)
+	log.Printf("verify: checking %d of %d chunked files\n", len(paths), len(chunked))
+
+	for _, p := range paths {
+		verifyChunks(bucket, chunked[p], &report)
+	}
+
+	list, err := ListSnapshots(bucket)
+	if err != nil {
+		return
+	}
+	extra, _, err := unreferencedObjects(bucket, list)
+	if err != nil {
+		return
+	}
+	for key := range extra {
+		report.Extra = append(report.Extra, key)
+	}
+	sort.Strings(report.Extra)
+	log.Printf("verify: done. %d objects, %d files checked. %d missing, %d corrupt, %d extra.\n",
+		report.Objects, report.Files, len(report.Missing), len(report.Corrupt), len(report.Extra))
+	return
+}
+
+func verifyObject(bucket *store.Store, key string, expected map[string][]*ManifestEntry, report *VerifyReport) {
+	// Only read the parts of the object we expect, if we know where they are.
+	ranges := make(map[store.ByteRange]bool)
+	whole := false
+	for _, list := range expected {
+		for _, e := range list {
+			if rng := e.Parts[0].Range; rng != emptyRange {
+				ranges[rng] = true
+			} else {
+				whole = true
+			}
+		}
+	}
+	var r io.Reader
+	var err error
+	if whole {
+		r, err = bucket.GetReader(key)
+	} else {
+		r, err = bucket.GetReaderParts(key, sortedRanges(ranges))
+	}
+	if bucket.IsNotExist(err) {
+		report.Missing = append(report.Missing, key)
+		return
+	}
+	if err != nil {
+		report.Corrupt = append(report.Corrupt, fmt.Sprintf("%s (%s)", key, err))
+		return
+	}
+
+	// Older tarballs only have the file names, not their full paths, but all the
+	// files in them have the same root. (See archive.UnpackReader.)
+	var root string
+	for name := range expected {
+		root = filepath.Dir(name)
+	}
+
+	found := make(map[string]bool)
+	tr := archive.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, fmt.Sprintf("%s (%s)", key, err))
+			return
+		}
+		name := hdr.Name
+		if filepath.Base(name) == name {
+			name = filepath.Join(root, name)
+		}
+
+		sum := sha1.New()
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			io.WriteString(sum, hdr.Linkname)
+		case tar.TypeDir:
+		default:
+			if _, err := io.Copy(sum, tr); err != nil {
+				report.Corrupt = append(report.Corrupt, fmt.Sprintf("%s (%s)", key, err))
+				return
+			}
+		}
+
+		list, ok := expected[name]
+		if !ok {
+			continue // superseded by a newer version, or deleted since
+		}
+		found[name] = true
+		var actual [sha1.Size]byte
+		copy(actual[:], sum.Sum(nil))
+		for _, e := range list {
+			report.Files += 1
+			if e.HasChecksum() && e.SHA1 != actual {
+				report.Corrupt = append(report.Corrupt, fmt.Sprintf("%s: %s (checksum mismatch)", key, e.Path()))
+			}
+		}
+	}
+
+	// The HMAC is only checked once the whole object has been read, and the tar
+	// reader stops at the end of the archive, so drain what's left.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		report.Corrupt = append(report.Corrupt, fmt.Sprintf("%s (%s)", key, err))
+		return
+	}
+
+	for name := range expected {
+		if !found[name] {
+			report.Missing = append(report.Missing, key+": "+name)
+		}
+	}
+}
+
+func verifyChunks(bucket *store.Store, e *ManifestEntry, report *VerifyReport) {
+	sum := sha1.New()
+	ok := true
+	for _, p := range e.Parts {
+		key := e.objectKey(p)
+		report.Objects += 1
+		data, err := readChunk(bucket, e, p)
+		if bucket.IsNotExist(err) {
+			report.Missing = append(report.Missing, key)
+			ok = false
+			continue
+		}
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, fmt.Sprintf("%s (%s)", key, err))
+			ok = false
+			continue
+		}
+		sum.Write(data)
+	}
+	report.Files += 1
+	if !ok {
+		return
+	}
+	var actual [sha1.Size]byte
+	copy(actual[:], sum.Sum(nil))
+	if e.HasChecksum() && e.SHA1 != actual {
+		report.Corrupt = append(report.Corrupt, fmt.Sprintf("%s (checksum mismatch)", e.Path()))
+	}
+}
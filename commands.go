@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aviddiviner/inc/backup"
+	"github.com/aviddiviner/inc/file"
+	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/util"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Commands that are dispatched on after the store has been set up.
+var commands = []string{"init", "backup", "restore", "snapshots", "ls", "find", "diff", "verify", "prune", "forget", "pin", "unpin", "unlock", "key"}
+
+// Subcommands of the key command.
+var keyCommands = []string{"list", "add", "remove", "passwd", "upgrade-kdf", "upgrade-metadata", "export", "import"}
+
+const c_TIME_FORMAT = "2006-01-02 15:04:05"
+
+// Commands which only read from the store can share it with one another; the rest need it to themselves.
+func needsExclusiveLock(opt options) bool {
+	switch opt.command {
+	case "restore", "snapshots", "ls", "find", "diff", "verify":
+		return false
+	case "key":
+		return opt.keyCommand != "list" && opt.keyCommand != "export" && opt.keyCommand != "import"
+	case "prune", "forget":
+		return !opt.dryRun
+	}
+	return true
+}
+
+// Error when running a command which reads from the store, with only write-only keys.
+var ErrWriteOnlyCommand = errors.New("only backup can be run with write-only keys; use --pass to read the store")
+
+// Error when the store metadata has no MAC, though we've seen it authenticated before.
+var ErrMetadataRolledBack = errors.New("the store metadata isn't authenticated, but it was before; it may have been rolled back to an old copy")
+
+// With write-only keys, we can back up (and remove stale locks), but nothing else.
+func allowsWriteOnly(opt options) bool {
+	return opt.command == "backup" || opt.command == "unlock"
+}
+
+// The lineage to back up to; this host's default backup set, unless others are given.
+func backupLineage(opt options) backup.Lineage {
+	l := backup.LocalLineage(opt.lineage.BackupSet)
+	if opt.lineage.Host != "" {
+		l.Host = opt.lineage.Host
+	}
+	return l
+}
+
+// Back up the scanned files. The first Ctrl-C (or SIGTERM) stops the backup
+// cleanly, writing a checkpoint to carry on from next time; a second one quits.
+func backupFiles(bucket *store.Store, l backup.Lineage, scanner *file.PathScanner) error {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		<-signals
+		log.Println("interrupted; finishing uploads in progress and writing a checkpoint (again to quit now)")
+		backup.Interrupt()
+		<-signals
+		os.Exit(130)
+	}()
+	return backup.ScanAndBackupLineage(bucket, l, scanner)
+}
+
+// Restore files from the latest snapshot of a lineage (this host's default one, unless --host or --set say otherwise),
+// or from the one selected by ID or time.
+func restoreFiles(bucket *store.Store, opt options) error {
+	if opt.snapshotID == "" && opt.asOf.IsZero() {
+		l := backupLineage(opt)
+		err := backup.RestoreLineageToPath(bucket, l, opt.restoreRoot, opt.includePaths)
+		if err == backup.ErrSnapshotNotFound {
+			return fmt.Errorf("no snapshots of %s; choose some with --host and --set (see inc snapshots)", l)
+		}
+		return err
+	}
+	snap, err := backup.SelectSnapshot(bucket, opt.lineage, opt.snapshotID, opt.asOf)
+	if err != nil {
+		return err
+	}
+	return backup.RestoreSnapshotToPath(bucket, snap.ID, opt.restoreRoot, opt.includePaths)
+}
+
+// Print a table of the snapshots in the store (of some lineage), oldest first.
+func listSnapshots(bucket *store.Store, opt options) error {
+	list, err := backup.ListSnapshots(bucket)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tHOST\tSET\tCREATED\tUPDATED\tFILES\tADDED\t")
+	for _, s := range backup.FilterSnapshots(list, opt.lineage) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", s.ID, orDash(s.Host), orDash(s.BackupSet),
+			formatTime(s.Created), formatTime(s.Time()), s.Files, util.ByteCount(s.Added), pinnedLabel(s))
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(c_TIME_FORMAT)
+}
+
+// List (or find) files in a snapshot. Prints a tree of the files found for ls,
+// a plain list of paths for find, or a long listing for either.
+func listFiles(bucket *store.Store, opt options) error {
+	m, err := backup.GetSnapshotManifest(bucket, opt.snapshotID, opt.asOf)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, p := range opt.includePaths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, abs)
+	}
+	entries := m.FindEntries(paths, opt.filter)
+	switch {
+	case opt.longListing:
+		return printLongListing(os.Stdout, entries)
+	case opt.command == "find":
+		for _, e := range entries {
+			fmt.Println(e.Path())
+		}
+	default:
+		printTree(os.Stdout, entries)
+	}
+	return nil
+}
+
+// Print entries with their mode, owner, size, mod time and backup set.
+func printLongListing(out io.Writer, entries []*backup.ManifestEntry) error {
+	w := tabwriter.NewWriter(out, 0, 4, 1, ' ', tabwriter.AlignRight)
+	for _, e := range entries {
+		size := "-"
+		if !e.IsDir() {
+			size = strconv.FormatInt(e.Size, 10)
+		}
+		fmt.Fprintf(w, "%s\t %d\t %d\t %s\t %s\t %s\t %s\n", e.Mode, e.UID, e.GID, size,
+			formatTime(e.ModTime), e.Set, e.Path())
+	}
+	return w.Flush()
+}
+
+type treeNode struct {
+	name     string
+	children map[string]*treeNode
+}
+
+func (n *treeNode) child(name string) *treeNode {
+	if n.children == nil {
+		n.children = make(map[string]*treeNode)
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &treeNode{name: name}
+		n.children[name] = c
+	}
+	return c
+}
+
+func (n *treeNode) sortedChildren() (list []*treeNode) {
+	for _, c := range n.children {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return
+}
+
+// Print entries as a tree, starting from the deepest folder they all share.
+func printTree(out io.Writer, entries []*backup.ManifestEntry) {
+	root := &treeNode{name: "/"}
+	for _, e := range entries {
+		n := root
+		for _, name := range strings.Split(strings.Trim(e.Path(), "/"), "/") {
+			n = n.child(name)
+		}
+	}
+	for len(root.children) == 1 {
+		only := root.sortedChildren()[0]
+		if len(only.children) == 0 {
+			break
+		}
+		only.name = filepath.Join(root.name, only.name)
+		root = only
+	}
+
+	var walk func(n *treeNode, indent string)
+	walk = func(n *treeNode, indent string) {
+		children := n.sortedChildren()
+		for i, c := range children {
+			branch, next := "├── ", "│   "
+			if i == len(children)-1 {
+				branch, next = "└── ", "    "
+			}
+			fmt.Fprintln(out, indent+branch+c.name)
+			walk(c, indent+next)
+		}
+	}
+	fmt.Fprintln(out, root.name)
+	walk(root, "")
+}
+
+// Get a snapshot manifest by ID, where "latest" means the latest snapshot.
+func getManifest(bucket *store.Store, id string) (backup.Manifest, error) {
+	if id == "latest" {
+		id = ""
+	}
+	return backup.GetSnapshotManifest(bucket, id, time.Time{})
+}
+
+// Show the changes between two snapshots, or from a snapshot to the files on disk.
+func diffSnapshots(bucket *store.Store, opt options) error {
+	from, err := getManifest(bucket, opt.diffFrom)
+	if err != nil {
+		return err
+	}
+	var diff backup.Diff
+	if opt.diffTo != "" {
+		to, err := getManifest(bucket, opt.diffTo)
+		if err != nil {
+			return err
+		}
+		diff = backup.DiffManifests(&from, &to)
+	} else {
+		diff = backup.DiffDisk(&from, scanFiles(LocalConfigPaths{}, opt))
+	}
+	if opt.jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(diff)
+	}
+	printDiff(os.Stdout, diff)
+	return nil
+}
+
+func printDiff(out io.Writer, diff backup.Diff) {
+	for _, c := range diff.Changes {
+		fmt.Fprintf(out, "%-9s %s\n", c.Kind, c.Path)
+	}
+	fmt.Fprintf(out, "%d added, %d removed, %d modified, %d metadata only\n",
+		diff.Summary[backup.Added], diff.Summary[backup.Removed],
+		diff.Summary[backup.Modified], diff.Summary[backup.Metadata])
+}
+
+// Verify the data in a snapshot (by default the latest) can be restored.
+func verifySnapshot(bucket *store.Store, opt options) error {
+	m, err := backup.GetSnapshotManifest(bucket, opt.snapshotID, time.Time{})
+	if err != nil {
+		return err
+	}
+	report, err := backup.Verify(bucket, &m, opt.samplePercent)
+	if err != nil {
+		return err
+	}
+	printVerifyReport(os.Stdout, report)
+	if !report.OK() {
+		return backup.ErrVerifyFailed
+	}
+	return nil
+}
+
+func printVerifyReport(out io.Writer, report backup.VerifyReport) {
+	for _, key := range report.Missing {
+		fmt.Fprintf(out, "missing  %s\n", key)
+	}
+	for _, key := range report.Corrupt {
+		fmt.Fprintf(out, "corrupt  %s\n", key)
+	}
+	for _, key := range report.Extra {
+		fmt.Fprintf(out, "extra    %s\n", key)
+	}
+	fmt.Fprintf(out, "%d objects, %d files checked: %d missing, %d corrupt, %d extra\n",
+		report.Objects, report.Files, len(report.Missing), len(report.Corrupt), len(report.Extra))
+	if len(report.Extra) > 0 {
+		fmt.Fprintln(out, "(extra objects aren't used by any snapshot; inc prune deletes them)")
+	}
+}
+
+// Forget the snapshots not kept by the retention policy, or report which would be.
+func forgetSnapshots(bucket *store.Store, opt options) error {
+	keep, forget, err := backup.Forget(bucket, opt.lineage, opt.retention, time.Now(), opt.dryRun)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, s := range keep {
+		fmt.Fprintf(w, "keep\t%s\t%s\t%s\t%s\n", s.ID, s.Lineage, formatTime(s.Time()), pinnedLabel(s))
+	}
+	for _, s := range forget {
+		fmt.Fprintf(w, "forget\t%s\t%s\t%s\t%s\n", s.ID, s.Lineage, formatTime(s.Time()), pinnedLabel(s))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if opt.dryRun {
+		fmt.Printf("would forget %d snapshots, keeping %d\n", len(forget), len(keep))
+	} else {
+		fmt.Printf("forgot %d snapshots, kept %d; run prune to delete data no longer needed\n", len(forget), len(keep))
+	}
+	return nil
+}
+
+func pinnedLabel(s backup.Snapshot) string {
+	if s.Pinned {
+		return "pinned"
+	}
+	return ""
+}
+
+// Pin or unpin a snapshot.
+func pinSnapshot(bucket *store.Store, opt options) error {
+	snap, err := backup.PinSnapshot(bucket, opt.snapshotID, opt.command == "pin")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%sned snapshot %s\n", opt.command, snap.ID)
+	return nil
+}
+
+// Delete unreferenced data from the store, or report what would be deleted.
+func pruneStore(bucket *store.Store, opt options) error {
+	report, err := backup.Prune(bucket, opt.dryRun)
+	if err != nil {
+		return err
+	}
+	if opt.dryRun {
+		for _, key := range report.Unreferenced {
+			fmt.Println(key)
+		}
+		fmt.Printf("%d unreferenced objects; %s reclaimable\n", len(report.Unreferenced), util.ByteCount(report.Bytes))
+	} else {
+		fmt.Printf("deleted %d unreferenced objects; %s reclaimed\n", report.Deleted, util.ByteCount(report.Bytes))
+	}
+	return nil
+}
+
+// Remove stale locks from the store (or all of them), and list those left.
+func unlockStore(bucket *store.Store, opt options) error {
+	removed, err := bucket.RemoveLocks(opt.unlockAll)
+	if err != nil {
+		return err
+	}
+	for _, l := range removed {
+		fmt.Printf("removed lock held by %s\n", l)
+	}
+	locks, err := bucket.ListLocks()
+	if err != nil {
+		return err
+	}
+	for _, l := range locks {
+		fmt.Printf("still locked by %s\n", l)
+	}
+	return nil
+}
+
+// Set up the store config from a recovery kit, before the store is opened. Settings given on the command line are
+// kept; the rest come from the kit. Without the master key in the kit, the store is unlocked with the password.
+// Returns the ID of the store the kit is for, to check against the store opened.
+func importRecoveryKit(cfg *LocalConfig, opt *options) (storeID string, err error) {
+	f, err := os.Open(opt.kitPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	kit, err := ParseRecoveryKit(f)
+	if err != nil {
+		return
+	}
+	opt.storageType = kit.Storage
+	if opt.fsRootFolder == "" {
+		opt.fsRootFolder = kit.FSRoot
+	}
+	if opt.s3Region == "" {
+		cfg.Store.S3Region = kit.S3Region
+	}
+	if opt.s3Bucket == "" {
+		cfg.Store.S3Bucket = kit.S3Bucket
+	}
+	cfg.Store.Keys, cfg.Store.WriteOnlyKeys = kit.Keys, store.WriteOnlyKeys{}
+	if !kit.HasKeys() && kit.Hint != "" {
+		fmt.Fprintf(os.Stderr, "Password hint: %s\n", kit.Hint)
+	}
+	return kit.StoreID, nil
+}
+
+// Check that the store opened with an imported recovery kit is the one the kit is for; else settings given on the
+// command line pointed us somewhere else, and we'd save the kit's keys in the config of the wrong store.
+func checkKitStore(bucket *store.Store, storeID string) error {
+	if storeID != "" && kitStoreLocation(bucket.ID()) != kitStoreLocation(storeID) {
+		return fmt.Errorf("the recovery kit is for store %s, not %s", storeID, bucket.ID())
+	}
+	return nil
+}
+
+// Write out a recovery kit for the store, to print (or to a file only we can read).
+func exportRecoveryKit(bucket *store.Store, cfg LocalConfig, opt options) error {
+	kit := RecoveryKit{StoreID: bucket.ID(), Created: time.Now(), Storage: opt.storageType, Hint: opt.keyHint}
+	if opt.storageType == "fs" {
+		kit.FSRoot = opt.fsRootFolder
+	} else {
+		kit.S3Region, kit.S3Bucket = cfg.Store.S3Region, cfg.Store.S3Bucket
+	}
+	if !opt.noKey {
+		kit.Keys = cfg.Store.Keys
+	}
+	if opt.kitPath == "" {
+		_, err := kit.WriteTo(os.Stdout)
+		return err
+	}
+	var buf bytes.Buffer
+	kit.WriteTo(&buf)
+	if err := file.WritePrivateFile(opt.kitPath, buf.Bytes()); err != nil {
+		return err
+	}
+	fmt.Printf("wrote recovery kit to %s; print it, then delete the file\n", opt.kitPath)
+	return nil
+}
+
+// List, add, remove, upgrade or change the passwords of the store's key slots, or export and import recovery kits.
+func manageKeys(bucket *store.Store, cfg LocalConfig, opt options) error {
+	switch opt.keyCommand {
+	case "add":
+		slot, err := bucket.AddKeySlot(opt.keyLabel, []byte(opt.newSecret))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("added key slot %s\n", slot.ID)
+	case "remove":
+		if err := bucket.RemoveKeySlot(opt.keySlot); err != nil {
+			return err
+		}
+		fmt.Printf("removed key slot %s\n", opt.keySlot)
+	case "passwd":
+		slot, err := bucket.ChangePassword([]byte(opt.storeSecret), []byte(opt.newSecret))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("changed password; key slot is now %s\n", slot.ID)
+	case "upgrade-kdf":
+		slot, err := bucket.UpgradeKDF([]byte(opt.storeSecret))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("upgraded to %s; key slot is now %s\n", slot.KDF, slot.ID)
+	case "upgrade-metadata":
+		if err := bucket.UpgradeMetadata(); err != nil {
+			return err
+		}
+		// Refuse metadata without a MAC from now on, even to upgrade it.
+		cfg.Store.AuthenticatedMetadata = true
+		if err := cfg.WriteToFile(opt.configPath); err != nil {
+			return err
+		}
+		fmt.Println("authenticated the store metadata")
+	case "export":
+		return exportRecoveryKit(bucket, cfg, opt)
+	case "import":
+		fmt.Printf("imported the recovery kit of %s\n", bucket.ID())
+		if opt.storageType == "fs" {
+			fmt.Printf("it's kept on the filesystem; give --storage fs --fs-root %s to other commands\n", opt.fsRootFolder)
+		}
+	default:
+		slots, err := bucket.KeySlots()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCREATED\tKDF\tLABEL")
+		for _, k := range slots {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", k.ID, formatTime(k.Created), k.KDF.Algorithm, k.Label)
+		}
+		return w.Flush()
+	}
+	return nil
+}
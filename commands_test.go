@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"github.com/aviddiviner/inc/backup"
+	"github.com/aviddiviner/inc/file"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestPrintTree(t *testing.T) {
+	entry := func(root, name string, mode os.FileMode) *backup.ManifestEntry {
+		return &backup.ManifestEntry{File: file.File{Root: root, Name: name, Mode: mode}}
+	}
+	entries := []*backup.ManifestEntry{
+		entry("/home/code", "inc", os.ModeDir|0755),
+		entry("/home/code/inc", "README.md", 0644),
+		entry("/home/code/inc", "backup", os.ModeDir|0755),
+		entry("/home/code/inc/backup", "core.go", 0644),
+		entry("/home/code/inc", "main.go", 0644),
+	}
+
+	var buf bytes.Buffer
+	printTree(&buf, entries)
+	assert.Equal(t, `/home/code/inc
+├── README.md
+├── backup
+│   └── core.go
+└── main.go
+`, buf.String())
+}
+
+func TestPrintVerifyReport(t *testing.T) {
+	report := backup.VerifyReport{Objects: 2, Files: 5, Extra: []string{"blob/14b4e1d6c34a79c0/0"}}
+	assert.True(t, report.OK(), "extra objects alone don't fail verify")
+
+	var buf bytes.Buffer
+	printVerifyReport(&buf, report)
+	assert.Equal(t, `extra    blob/14b4e1d6c34a79c0/0
+2 objects, 5 files checked: 0 missing, 0 corrupt, 1 extra
+(extra objects aren't used by any snapshot; inc prune deletes them)
+`, buf.String())
+}
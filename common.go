@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"github.com/aviddiviner/inc/file"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // De-dupe, clean and sort a list of file paths.
@@ -46,3 +50,66 @@ func scanFiles(paths LocalConfigPaths, opt options) *file.PathScanner {
 
 	return scanner
 }
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Parse a time given on the command line; either an absolute (local) time, or a
+// duration (e.g. 36h) before now.
+func parseTime(val string, now time.Time) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, val, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if d, err := time.ParseDuration(val); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("unable to parse time: %q", val)
+}
+
+// Parse a duration given on the command line. As well as the units allowed by
+// time.ParseDuration, this allows days (d) and weeks (w), e.g. 14d or 2w.
+func parseDuration(val string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(val, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(val, suffix), 64)
+			if err != nil || n < 0 {
+				break
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	if d, err := time.ParseDuration(val); err == nil && d >= 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("unable to parse duration: %q", val)
+}
+
+var sizeUnits = map[string]float64{"": 1, "B": 1, "K": 1e3, "M": 1e6, "G": 1e9, "T": 1e12}
+
+// Parse a size given on the command line, in bytes or with a unit suffix (e.g. 20M).
+func parseSize(val string) (int64, error) {
+	num := strings.TrimRight(strings.ToUpper(val), "KMGTB")
+	unit := strings.TrimSuffix(strings.ToUpper(val)[len(num):], "B")
+	n, err := strconv.ParseFloat(num, 64)
+	mult, ok := sizeUnits[unit]
+	if err != nil || !ok || n < 0 {
+		return 0, fmt.Errorf("unable to parse size: %q", val)
+	}
+	return int64(n * mult), nil
+}
+
+// Parse a percentage given on the command line (e.g. 10 or 2.5%), between 0 and 100.
+func parsePercent(val string) (float64, error) {
+	n, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+	if err != nil || n <= 0 || n > 100 {
+		return 0, fmt.Errorf("unable to parse percentage: %q", val)
+	}
+	return n, nil
+}
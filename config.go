@@ -4,30 +4,65 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/aviddiviner/inc/backup"
 	"github.com/aviddiviner/inc/file"
 	"github.com/aviddiviner/inc/store"
 	"github.com/aviddiviner/inc/util"
+	"os"
+	"runtime"
+	"time"
 )
 
 type options struct {
-	storeInit    bool
-	forceInit    bool
-	storeSecret  string
-	storageType  string
-	awsAccessKey string
-	awsSecretKey string
-	s3Region     string
-	s3Bucket     string
-	fsRootFolder string
-	configPath   string
-	includePaths []string
-	excludePaths []string
-	restoreRoot  string
-
-	scanOnly bool
+	storeInit     bool
+	forceInit     bool
+	storeSecret   string
+	passFile      string
+	passCommand   string
+	keyFile       string
+	storageType   string
+	awsAccessKey  string
+	awsSecretKey  string
+	s3Region      string
+	s3Bucket      string
+	fsRootFolder  string
+	configPath    string
+	includePaths  []string
+	excludePaths  []string
+	restoreRoot   string
+	snapshotID    string
+	asOf          time.Time
+	longListing   bool
+	filter        backup.EntryFilter
+	jsonOutput    bool
+	diffFrom      string
+	diffTo        string
+	samplePercent float64
+	dryRun        bool
+	retention     backup.RetentionPolicy
+	unlockAll     bool
+	writeOnly     bool
+	compression   string
+	retryAttempts int
+	retryDelay    string
+	lineage       backup.Lineage
+	newSecret     string
+	newPassFile   string
+	newPassCmd    string
+	keyLabel      string
+	keySlot       string
+	keyHint       string
+	noKey         bool
+	kitPath       string
+
+	command    string
+	keyCommand string
+	scanOnly   bool
 }
 
 var ErrMalformedConfig = errors.New("malformed config data")
+var ErrMalformedKeyFile = errors.New("malformed key file")
 var ErrBadVersion = errors.New("bad version")
 
 type LocalConfig struct {
@@ -38,7 +73,22 @@ type LocalConfig struct {
 
 type LocalConfigStore struct {
 	store.S3Config
+	KeyFile     string `json:"keyFile,omitempty"`     // where the keys are kept, if not in the config file
+	Compression string `json:"compression,omitempty"` // codec and level for new objects (see zip.ParseConfig)
+	// How often to try requests to the storage, and how long to wait before the first retry. (see store.RetryPolicy)
+	RetryAttempts int    `json:"retryAttempts,omitempty"`
+	RetryDelay    string `json:"retryDelay,omitempty"`
+	// The store metadata has been seen authenticated; from then on, metadata without a MAC is refused.
+	AuthenticatedMetadata bool `json:"authenticatedMetadata,omitempty"`
 	store.Keys
+	store.WriteOnlyKeys // instead of the keys, on hosts which only back up
+}
+
+// LocalKeyFile holds the keys, when they're kept apart from the config.
+type LocalKeyFile struct {
+	Version int `json:"version"`
+	store.Keys
+	store.WriteOnlyKeys
 }
 
 type LocalConfigPaths struct {
@@ -71,12 +121,100 @@ func LoadConfigFile(filePath string) (cfg LocalConfig, err error) {
 	return
 }
 
+// Write the config (and the key file, if it has one) so that only we can read them.
 func (cfg *LocalConfig) WriteToFile(path string) error {
-	data, err := json.Marshal(cfg)
+	out := *cfg
+	if out.Store.KeyFile != "" {
+		data, err := json.Marshal(LocalKeyFile{1, out.Store.Keys, out.Store.WriteOnlyKeys})
+		if err != nil {
+			return err
+		}
+		if err = file.WritePrivateFile(out.Store.KeyFile, data); err != nil {
+			return err
+		}
+		out.Store.Keys, out.Store.WriteOnlyKeys = store.Keys{}, store.WriteOnlyKeys{}
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	return file.WritePrivateFile(path, data)
+}
+
+// HasKeys returns true if there are any keys (full or write-only) in the config.
+func (cfg LocalConfigStore) HasKeys() bool {
+	return cfg.EncKey != nil || !cfg.WriteOnlyKeys.IsEmpty()
+}
+
+// RetryPolicy returns the policy for retrying requests to the storage; the default one, with any settings in the
+// config. They're checked here too, since the config file may have been edited by hand.
+func (cfg LocalConfigStore) RetryPolicy() (p store.RetryPolicy, err error) {
+	p = store.DefaultRetryPolicy
+	if cfg.RetryAttempts != 0 {
+		if cfg.RetryAttempts < 1 {
+			return p, fmt.Errorf("bad retryAttempts in config: %d (must be at least 1)", cfg.RetryAttempts)
+		}
+		p.Attempts = cfg.RetryAttempts
+	}
+	if cfg.RetryDelay != "" {
+		d, err := parseDuration(cfg.RetryDelay)
+		if err != nil || d <= 0 {
+			return p, fmt.Errorf("bad retryDelay in config: %q (must be longer than 0)", cfg.RetryDelay)
+		}
+		p.BaseDelay = d
+		if p.MaxDelay < d {
+			p.MaxDelay = d
+		}
+	}
+	return
+}
+
+// LoadKeys reads the keys from the key file, if the config has one (and it exists yet); otherwise they're kept in
+// the config file itself. Either way, we refuse to use keys from a file which other users can read.
+func (cfg *LocalConfigStore) LoadKeys(configPath string) error {
+	if cfg.HasKeys() {
+		if err := checkPrivateFile(configPath); err != nil {
+			return err
+		}
+	}
+	if cfg.KeyFile == "" {
+		return nil
+	}
+	cfg.KeyFile = file.CleanPath(cfg.KeyFile)
+	data, err := file.ReadFile(cfg.KeyFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	return file.WriteFile(path, data)
+	if err = checkPrivateFile(cfg.KeyFile); err != nil {
+		return err
+	}
+	if ver, ok := util.ParseVersionJSON(data); ok {
+		if ver != 1 {
+			return ErrBadVersion
+		}
+		var keys LocalKeyFile
+		if err = json.Unmarshal(data, &keys); err != nil {
+			return ErrMalformedKeyFile
+		}
+		cfg.Keys, cfg.WriteOnlyKeys = keys.Keys, keys.WriteOnlyKeys
+		return nil
+	}
+	return ErrMalformedKeyFile
+}
+
+// Check that no other users can read (or write) a file holding keys or passwords.
+func checkPrivateFile(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("other users can access %q, which holds keys or passwords; only you should (chmod 600 it)", path)
+	}
+	return nil
 }
 
 func (cfg *LocalConfig) Equal(other LocalConfig) bool {
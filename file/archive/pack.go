@@ -2,6 +2,7 @@ package archive
 
 import (
 	"archive/tar"
+	"bufio"
 	"errors"
 	"github.com/aviddiviner/inc/file"
 	"github.com/aviddiviner/inc/util"
@@ -121,6 +122,155 @@ func UnpackReader(root string, tarball io.Reader, only map[string]file.File) err
 	return nil
 }
 
+// Reader reads the files from a stream of tarballs, one after the other, as if
+// they were one tarball. (Objects in the store may hold a tarball per file, so
+// that each file can be read on its own.)
+type Reader struct {
+	*tar.Reader
+	br *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	br := bufio.NewReader(r)
+	return &Reader{tar.NewReader(br), br}
+}
+
+// Next advances to the next file, moving on to the next tarball at the end of
+// each one. Returns io.EOF at the end of the stream.
+func (r *Reader) Next() (*tar.Header, error) {
+	for {
+		hdr, err := r.Reader.Next()
+		if err != io.EOF {
+			return hdr, err
+		}
+		if _, err := r.br.Peek(1); err != nil {
+			return nil, err // io.EOF at the end of the stream
+		}
+		r.Reader = tar.NewReader(r.br)
+	}
+}
+
+// UnpackReaderTo restores files from a tarball, where targets maps the names of
+// files in the tarball to the files to restore from them (relative to root).
+// One file in the tarball may be restored to many files, with different paths
+// and metadata to the original. Files not in targets are skipped. The tarball
+// may also be a stream of tarballs (see Reader).
+func UnpackReaderTo(root string, tarball io.Reader, targets map[string][]file.File) error {
+	var subdir string
+	// Iterate through the files in the archive.
+	tr := NewReader(tarball)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break // end of tarball
+		}
+		if err != nil {
+			return err
+		}
+		// Old style tarballs only have the filename, and all their files are from
+		// the same folder. (See UnpackReader.)
+		if subdir == "" && filepath.Base(hdr.Name) == hdr.Name {
+			log.Println("unpack: old-style tarball detected.")
+			for name := range targets {
+				if subdir == "" {
+					subdir = filepath.Dir(name)
+				} else if subdir != filepath.Dir(name) { // Sanity check.
+					return errors.New("tarball shouldn't contain files from different roots")
+				}
+			}
+		}
+		if subdir != "" {
+			hdr.Name = filepath.Join(subdir, hdr.Name)
+		}
+		list, ok := targets[hdr.Name]
+		if !ok {
+			log.Printf("unpack: skipping file, not selected %s\n", hdr.Name)
+			continue
+		}
+		if err := unpackFileTo(root, hdr, tr, list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreFile restores a regular file (relative to root) from its contents.
+func RestoreFile(root string, f file.File, r io.Reader) error {
+	hdr := &tar.Header{Name: f.Path(), Typeflag: tar.TypeReg}
+	return unpackFileTo(root, hdr, r, []file.File{f})
+}
+
+// Restore the current file in a tarball to each of a list of files.
+func unpackFileTo(root string, hdr *tar.Header, r io.Reader, list []file.File) error {
+	var restored []file.File
+	var writers []io.Writer
+	var handles []io.Closer
+	defer func() {
+		for _, fh := range handles {
+			fh.Close()
+		}
+	}()
+
+	for _, f := range list {
+		path := filepath.Join(root, f.Path())
+		// Ensure the folder exists.
+		if err := file.MakeDir(filepath.Dir(path)); err != nil {
+			return err
+		}
+		if _, err := fs.Lstat(path); !fs.IsNotExist(err) {
+			log.Printf("unpack: skipping, already exists %s\n", path)
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			log.Printf("unpack: %s (%s)\n", path, f.Mode)
+			if err := fs.Mkdir(path, f.Mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			log.Printf("unpack: %s (%s) (%s)\n", path, f.Mode, util.ByteCount(len(hdr.Linkname)))
+			if err := fs.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		default:
+			fh, err := fs.OpenWrite(path, f.Mode.Perm())
+			if err != nil {
+				return err
+			}
+			handles = append(handles, fh)
+			writers = append(writers, fh)
+		}
+		restored = append(restored, f)
+	}
+
+	if len(writers) > 0 {
+		n, err := io.Copy(io.MultiWriter(writers...), r)
+		if err != nil {
+			return err
+		}
+		log.Printf("unpack: %s (%s) to %d files\n", hdr.Name, util.ByteCount(n), len(writers))
+		for _, fh := range handles {
+			if err := fh.Close(); err != nil {
+				return err
+			}
+		}
+		handles = nil
+	}
+
+	for _, f := range restored {
+		path := filepath.Join(root, f.Path())
+		// Set the owner uid/gid.
+		if err := fs.Lchown(path, f.UID, f.GID); err != nil {
+			// TODO: Handle this better.
+		}
+		// Set the access/modification times.
+		if err := fs.Chtimes(path, f.ModTime, f.ModTime); err != nil {
+			// TODO: Handle this better.
+		}
+	}
+	return nil
+}
+
 // -----------------------------------------------------------------------------
 
 const c_FLUSH_SIZE = 65535
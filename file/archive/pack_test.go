@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io"
 	"io/ioutil"
+	"path/filepath"
 	"sort"
 	"testing"
 	"time"
@@ -111,3 +112,62 @@ func TestFlushMidFileWorks(t *testing.T) {
 	assert.EqualValues(t, len(tarball), buf.Len(), "same number of bytes")
 	assert.EqualValues(t, tarball, buf.Bytes(), "archives are the same")
 }
+
+func TestUnpackReaderTo(t *testing.T) {
+	testFiles := []file.File{createTestFile(t), createTestFile(t)}
+	tarball, err := pack(testFiles...)
+	assert.NoError(t, err)
+
+	// Restore the first file twice, under other names, and skip the second.
+	copies := []file.File{testFiles[0], testFiles[0]}
+	copies[0].Name = "copy-1"
+	copies[1].Name = "copy-2"
+	copies[1].Mode = 0600
+	copies[1].ModTime = time.Date(2016, 1, 5, 12, 0, 0, 0, time.UTC)
+
+	tempDir := test.CreateTempDir(t)
+	targets := map[string][]file.File{testFiles[0].Path(): copies}
+	assert.NoError(t, UnpackReaderTo(tempDir, bytes.NewReader(tarball), targets))
+
+	var found []file.File
+	for _, f := range file.NewScanner().IncludePath(tempDir).ScanRelativeTo(tempDir) {
+		if !f.IsDir() {
+			f.Root = test.TempDir
+			found = append(found, f)
+		}
+	}
+	sort.Sort(file.ByPath(found))
+	assertFilesEqual(t, copies, found)
+	orig, err := ioutil.ReadFile(testFiles[0].Path())
+	assert.NoError(t, err)
+	for _, f := range copies {
+		data, err := ioutil.ReadFile(filepath.Join(tempDir, f.Path()))
+		assert.NoError(t, err)
+		assert.Equal(t, orig, data)
+	}
+}
+
+func TestReaderOverManyTarballs(t *testing.T) {
+	testFiles := []file.File{createTestFile(t), createTestFile(t), createTestFile(t)}
+	var stream bytes.Buffer
+	for _, f := range testFiles {
+		tarball, err := pack(f)
+		assert.NoError(t, err)
+		stream.Write(tarball)
+	}
+
+	var names []string
+	tr := NewReader(&stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(tr)
+		assert.NoError(t, err)
+		assert.Equal(t, hdr.Size, int64(len(data)))
+		names = append(names, hdr.Name)
+	}
+	assert.Equal(t, []string{testFiles[0].Path(), testFiles[1].Path(), testFiles[2].Path()}, names)
+}
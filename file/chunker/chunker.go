@@ -0,0 +1,107 @@
+// Package chunker splits data into content-defined chunks, so that a small
+// change to a large file only changes the chunks around it.
+//
+// Chunk boundaries are found with a gear-based rolling hash, in the style of
+// FastCDC (https://www.usenix.org/conference/atc16/technical-sessions/presentation/xia),
+// including its normalized chunking to keep chunk sizes close to the average.
+package chunker
+
+import (
+	"io"
+)
+
+const (
+	MinSize = 256 << 10 // chunks are at least 256KB (except the last)
+	AvgSize = 1 << 20   // and around 1MB on average
+	MaxSize = 4 << 20   // but never more than 4MB
+)
+
+// Masks checked against the rolling hash. Before the average size we use a
+// harder mask (more bits), after it an easier one, to normalize chunk sizes.
+const (
+	c_MASK_HARD uint64 = (1<<22 - 1) << (64 - 22)
+	c_MASK_EASY uint64 = (1<<18 - 1) << (64 - 18)
+)
+
+// Random values for each byte, used by the rolling hash. These must never
+// change, otherwise the same data would be chunked differently.
+var gear [256]uint64
+
+func init() {
+	// SplitMix64, seeded with a fixed value.
+	seed := uint64(0x696e632d63646321) // "inc-cdc!"
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Find the length of the next chunk at the start of some data.
+func cut(data []byte) int {
+	n := len(data)
+	if n <= MinSize {
+		return n
+	}
+	if n > MaxSize {
+		n = MaxSize
+	}
+	normal := AvgSize
+	if n < normal {
+		normal = n
+	}
+	var fp uint64
+	i := MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c_MASK_HARD == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c_MASK_EASY == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// -----------------------------------------------------------------------------
+
+// Chunker reads data from an io.Reader and splits it into chunks.
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int // bytes of data in buf
+	eof bool
+}
+
+// New returns a Chunker reading from r.
+func New(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, MaxSize)}
+}
+
+// Next returns the next chunk of data, or io.EOF once all the data has been read.
+func (c *Chunker) Next() ([]byte, error) {
+	// Fill the buffer, so we have enough data to find a boundary.
+	for !c.eof && c.n < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.n:])
+		c.n += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+	size := cut(c.buf[:c.n])
+	chunk := make([]byte, size)
+	copy(chunk, c.buf[:size])
+	c.n = copy(c.buf, c.buf[size:c.n])
+	return chunk, nil
+}
@@ -0,0 +1,76 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+func randData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func chunkAll(t *testing.T, r io.Reader) (chunks [][]byte) {
+	c := New(r)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return
+		}
+		assert.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+}
+
+func chunkSums(chunks [][]byte) map[[sha1.Size]byte]bool {
+	sums := make(map[[sha1.Size]byte]bool)
+	for _, c := range chunks {
+		sums[sha1.Sum(c)] = true
+	}
+	return sums
+}
+
+func TestChunkSizes(t *testing.T) {
+	data := randData(1, 20<<20)
+	chunks := chunkAll(t, bytes.NewReader(data))
+
+	assert.Equal(t, data, bytes.Join(chunks, nil), "chunks add up to the data")
+	assert.InDelta(t, len(data)/AvgSize, len(chunks), 10, "around the average size")
+	for i, c := range chunks {
+		assert.True(t, len(c) <= MaxSize)
+		if i < len(chunks)-1 {
+			assert.True(t, len(c) >= MinSize)
+		}
+	}
+
+	// Reading in small bits gives the same chunks.
+	assert.Equal(t, chunks, chunkAll(t, iotest.HalfReader(bytes.NewReader(data))))
+	assert.Empty(t, chunkAll(t, bytes.NewReader(nil)))
+	assert.Len(t, chunkAll(t, bytes.NewReader(data[:1000])), 1)
+}
+
+func TestChunksSurviveEdits(t *testing.T) {
+	data := randData(2, 20<<20)
+	before := chunkSums(chunkAll(t, bytes.NewReader(data)))
+
+	// Insert a few bytes in the middle; only the chunks around it change.
+	edited := append(append(append([]byte{}, data[:10<<20]...), "hello"...), data[10<<20:]...)
+	after := chunkAll(t, bytes.NewReader(edited))
+	changed := 0
+	for sum := range chunkSums(after) {
+		if !before[sum] {
+			changed += 1
+		}
+	}
+	assert.True(t, changed <= 2, "changed %d of %d chunks", changed, len(after))
+
+	// Data without any boundaries is cut at the max size.
+	chunks := chunkAll(t, bytes.NewReader(make([]byte, 3*MaxSize)))
+	assert.Len(t, chunks, 3)
+}
@@ -9,18 +9,25 @@ import (
 	"time"
 )
 
-func checksumFile(fs fs.FileSystem, path string) (out [sha1.Size]byte, length int) {
+// Checksum a file, reading the start of it into head on the way; head is cut down to what was read.
+func checksumFile(fs fs.FileSystem, path string, head *[]byte) (out [sha1.Size]byte, length int) {
 	f, err := fs.OpenRead(path)
 	if err != nil {
 		log.Fatal("check: file read error. ", err, path)
 	}
 	defer f.Close()
 	sum := sha1.New()
+	h, err := io.ReadFull(f, *head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Fatal("check: file read error. ", err, path)
+	}
+	*head = (*head)[:h]
+	sum.Write(*head)
 	n, err := io.Copy(sum, f)
 	if err != nil {
 		log.Fatal("check: file read error. ", err, path)
 	}
-	length = int(n)
+	length = h + int(n)
 	copy(out[:], sum.Sum(nil))
 	return
 }
@@ -41,6 +48,18 @@ func ChecksumFiles(groups ...[]File) {
 // ChecksumFilesFS scans the contents of a list of files, calculating their SHA1
 // checksums and populating the File details.
 func ChecksumFilesFS(fs fs.FileSystem, groups ...[]File) {
+	checksumFiles(fs, 0, nil, groups...)
+}
+
+// ChecksumFilesSniff is ChecksumFiles, also handing the first n bytes (or fewer,
+// if that's all there is) of each regular file it reads to sniff; so callers
+// can look at the contents without reading the files again. The head slice is
+// reused, and mustn't be kept after sniff returns.
+func ChecksumFilesSniff(n int, sniff func(f File, head []byte), groups ...[]File) {
+	checksumFiles(DefaultFileSystem, n, sniff, groups...)
+}
+
+func checksumFiles(fs fs.FileSystem, n int, sniff func(File, []byte), groups ...[]File) {
 	start := time.Now()
 
 	totalFiles := 0
@@ -63,6 +82,7 @@ func ChecksumFilesFS(fs fs.FileSystem, groups ...[]File) {
 
 	doneFiles := 0
 	doneBytes := util.ByteCount(0)
+	buf := make([]byte, n)
 
 	timer := util.NewTimer(1800, func() {
 		progress := doneBytes / totalBytes * 100
@@ -75,7 +95,11 @@ func ChecksumFilesFS(fs fs.FileSystem, groups ...[]File) {
 			var hash [sha1.Size]byte
 			var length int
 			if f.IsRegular() {
-				hash, length = checksumFile(fs, f.Path())
+				head := buf
+				hash, length = checksumFile(fs, f.Path(), &head)
+				if sniff != nil {
+					sniff(f, head)
+				}
 			} else if f.IsSymlink() {
 				hash, length = checksumSymlink(fs, f.Path())
 			} else {
@@ -50,6 +50,25 @@ func WriteFileFS(fs fs.FileSystem, filename string, data []byte) error {
 	return fs.WriteFile(filename, data, 0644)
 }
 
+// WritePrivateFile writes data to a file which only its owner can read or write
+// (0600 -rw-------). If the file exists, its permissions are changed before it is
+// truncated and written.
+func WritePrivateFile(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err = f.Chmod(0600); err == nil {
+		if err = f.Truncate(0); err == nil {
+			_, err = f.Write(data)
+		}
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
 // ReadFile reads the contents of a file.
 func ReadFile(filename string) ([]byte, error) {
 	return ReadFileFS(DefaultFileSystem, filename)
@@ -58,3 +77,8 @@ func ReadFile(filename string) ([]byte, error) {
 func ReadFileFS(fs fs.FileSystem, filename string) ([]byte, error) {
 	return fs.ReadFile(filename)
 }
+
+// IsWithin checks if a path is the same as, or is inside of, some directory.
+func IsWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -94,6 +94,22 @@ func (s *PathScanner) ExcludePath(path string) *PathScanner {
 	return s
 }
 
+// Covers returns true if a path would be found by the scan; that is, it is
+// within one of the included paths and not within any of the excluded paths.
+func (s *PathScanner) Covers(path string) bool {
+	for dir := range s.excl {
+		if IsWithin(path, dir) {
+			return false
+		}
+	}
+	for _, dir := range s.incl {
+		if IsWithin(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
 // Walk the contents of a folder and send the results over the channels.
 func (s *PathScanner) walkDir(pwd string, chDir, chAll chan File) {
 	fd, err := s.fs.OpenRead(pwd)
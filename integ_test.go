@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"github.com/aviddiviner/inc/backup"
 	"github.com/aviddiviner/inc/file"
 	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/store/crypto"
 	"github.com/aviddiviner/inc/store/storage"
 	"github.com/aviddiviner/inc/util/test"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"path"
 	"sort"
@@ -23,6 +29,9 @@ var testPassword = "mysupersecretpassword"
 
 var testRequestFault = errors.New("general test fault")
 
+// Retry quickly in tests.
+var testRetryPolicy = store.RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
 // Create a callback that will fail every n-th request.
 func newRequestFaultEveryN(n int) storage.MockRequestFault {
 	reqCount := 0
@@ -58,6 +67,8 @@ func setupMockStore(t *testing.T, opt options) (vault *store.Store, layer *stora
 	layer.PutString("metadata", `{"version":1,"storeFormat":1,"salt":"5+ZOMGkPADM="}`)
 
 	vault = store.NewStore(layer, "test")
+	vault.SetRetryPolicy(testRetryPolicy)
+	vault.AllowLegacyMetadata()
 	assert.NoError(t, err)
 
 	if opt.storeInit {
@@ -117,6 +128,90 @@ func TestLoadingAndSavingConfig(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestConfigWithKeyFile(t *testing.T) {
+	test.RandSeed(56)
+	dir := test.CreateTempDir(t)
+	cfgPath, keyPath := path.Join(dir, "inc.cfg"), path.Join(dir, "inc.keys")
+	cfg, err := LoadConfigFile(testConfigPath)
+	assert.NoError(t, err)
+	keys := cfg.Store.Keys
+
+	// Configs holding keys are only written for us to read, and refused otherwise.
+	assert.NoError(t, ioutil.WriteFile(cfgPath, nil, 0644))
+	assert.NoError(t, cfg.WriteToFile(cfgPath))
+	fi, err := os.Stat(cfgPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	loaded, err := LoadConfigFile(cfgPath)
+	assert.NoError(t, err)
+	assert.NoError(t, loaded.Store.LoadKeys(cfgPath))
+	assert.NoError(t, os.Chmod(cfgPath, 0640))
+	assert.Error(t, loaded.Store.LoadKeys(cfgPath))
+
+	// With a key file, the keys are kept there instead.
+	cfg.Store.KeyFile = keyPath
+	assert.NoError(t, cfg.WriteToFile(cfgPath))
+	data, _ := ioutil.ReadFile(cfgPath)
+	assert.NotContains(t, string(data), `"encKey":"`)
+	loaded, err = LoadConfigFile(cfgPath)
+	assert.NoError(t, err)
+	assert.Empty(t, loaded.Store.EncKey)
+	assert.NoError(t, loaded.Store.LoadKeys(cfgPath))
+	assert.Equal(t, keys, loaded.Store.Keys)
+	assert.True(t, cfg.Equal(loaded))
+
+	assert.NoError(t, os.Chmod(keyPath, 0644))
+	assert.Error(t, loaded.Store.LoadKeys(cfgPath))
+}
+
+func TestPasswordSources(t *testing.T) {
+	test.RandSeed(57)
+	dir := test.CreateTempDir(t)
+	passPath := path.Join(dir, "inc.pass")
+	assert.NoError(t, ioutil.WriteFile(passPath, []byte("from a file\nand not this\n"), 0600))
+
+	pass, err := readPassword(options{storeSecret: "given", passFile: passPath}, LocalConfigStore{})
+	assert.NoError(t, err)
+	assert.Equal(t, "given", pass)
+	pass, err = readPassword(options{passFile: passPath}, LocalConfigStore{})
+	assert.NoError(t, err)
+	assert.Equal(t, "from a file", pass)
+	pass, err = readPassword(options{passCommand: "printf 'from a command\\r\\n'"}, LocalConfigStore{})
+	assert.NoError(t, err)
+	assert.Equal(t, "from a command", pass)
+
+	_, err = readPassword(options{passCommand: "true"}, LocalConfigStore{})
+	assert.Equal(t, ErrEmptyPassword, err)
+	_, err = readPassword(options{passCommand: "exit 1"}, LocalConfigStore{})
+	assert.Error(t, err)
+	assert.NoError(t, os.Chmod(passPath, 0604))
+	_, err = readPassword(options{passFile: passPath}, LocalConfigStore{})
+	assert.Error(t, err)
+
+	// Without a terminal to ask at, commands which need a password fail without one.
+	if !isTerminal(os.Stdin) {
+		_, err = readPassword(options{command: "init"}, LocalConfigStore{})
+		assert.Equal(t, ErrNoPassword, err)
+		pass, err = readPassword(options{command: "restore"}, LocalConfigStore{})
+		assert.NoError(t, err)
+		assert.Equal(t, "", pass)
+		_, err = readNewPassword(options{command: "key", keyCommand: "passwd"})
+		assert.Equal(t, ErrNoNewPassword, err)
+	}
+
+	// The new password (of key add and passwd) comes from the same places.
+	assert.NoError(t, os.Chmod(passPath, 0600))
+	pass, err = readNewPassword(options{newPassFile: passPath})
+	assert.NoError(t, err)
+	assert.Equal(t, "from a file", pass)
+	pass, err = readNewPassword(options{newPassCmd: "echo new"})
+	assert.NoError(t, err)
+	assert.Equal(t, "new", pass)
+	pass, err = readNewPassword(options{newSecret: "given", newPassFile: passPath})
+	assert.NoError(t, err)
+	assert.Equal(t, "given", pass)
+}
+
 func TestStoreSetup(t *testing.T) {
 	_, _, o, cfg := setupMockStore(t, options{})
 	assert.Equal(t, o, cfg)
@@ -128,6 +223,49 @@ func TestStoreSetup(t *testing.T) {
 	assert.NotEqual(t, o, cfg)
 }
 
+func TestUpgradeLegacyMetadata(t *testing.T) {
+	dir := test.CreateTempDir(t)
+	root := path.Join(dir, "store")
+	legacy := `{"version":1,"storeFormat":1,"salt":"5+ZOMGkPADM="}`
+	layer := storage.NewFileStorage(root)
+	assert.NoError(t, layer.Create())
+	_, err := layer.PutReader("metadata", strings.NewReader(legacy))
+	assert.NoError(t, err)
+	salt, _ := base64.StdEncoding.DecodeString("5+ZOMGkPADM=")
+	enc, _ := crypto.NewCrypter(crypto.DeriveKeys([]byte(testPassword), salt))
+	manifest, _ := enc.Encrypt([]byte("manifest"))
+	_, err = layer.PutReader("manifest/latest", bytes.NewReader(manifest))
+	assert.NoError(t, err)
+
+	// The store can't be used until its metadata is upgraded, which happens once.
+	cfg := NewConfig()
+	opts := options{command: "snapshots", storageType: "fs", fsRootFolder: root, storeSecret: testPassword,
+		configPath: path.Join(dir, "inc.cfg")}
+	_, err = setupStore(&cfg.Store, opts)
+	assert.Equal(t, store.ErrLegacyMetadata, err)
+	opts.command, opts.keyCommand = "key", "upgrade-metadata"
+	bucket, err := setupStore(&cfg.Store, opts)
+	assert.NoError(t, err)
+	assert.False(t, cfg.Store.AuthenticatedMetadata)
+	assert.NoError(t, manageKeys(bucket, cfg, opts))
+	saved, err := LoadConfigFile(opts.configPath)
+	assert.NoError(t, err)
+	assert.True(t, saved.Store.AuthenticatedMetadata)
+
+	opts.command, opts.keyCommand = "snapshots", ""
+	_, err = setupStore(&saved.Store, opts)
+	assert.NoError(t, err)
+
+	// Put the old metadata back; it's refused, even to upgrade it again.
+	_, err = layer.PutReader("metadata", strings.NewReader(legacy))
+	assert.NoError(t, err)
+	_, err = setupStore(&saved.Store, opts)
+	assert.Equal(t, ErrMetadataRolledBack, err)
+	opts.command, opts.keyCommand = "key", "upgrade-metadata"
+	_, err = setupStore(&saved.Store, opts)
+	assert.Equal(t, ErrMetadataRolledBack, err)
+}
+
 // Get a list of files, sorted by path, ready for comparing.
 func lsFiles(path string) []file.File {
 	ls := file.NewScanner().IncludePath(path).ScanRelativeTo(path)
@@ -188,6 +326,61 @@ func TestRestoreSelectedPaths(t *testing.T) {
 	assert.Equal(t, 1, len(lsRestore), "only 1 file restored")
 }
 
+// Counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *int
+}
+
+func (c countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	*c.n += n
+	return n, err
+}
+
+func TestRestoreOneFileReadsOnlyItsRange(t *testing.T) {
+	test.RandSeed(51)
+	backupPath := test.CreateTempDir(t)
+	rnd := rand.New(rand.NewSource(51))
+	contents := make(map[string][]byte)
+	for _, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin"} {
+		contents[name] = make([]byte, 10<<10)
+		rnd.Read(contents[name])
+		assert.NoError(t, ioutil.WriteFile(path.Join(backupPath, name), contents[name], 0644))
+	}
+
+	var cfg LocalConfig
+	opts := options{includePaths: []string{backupPath}}
+	vault, layer, _, _ := setupMockStore(t, opts)
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+
+	// All the files are bundled in one object.
+	blobs, err := layer.List("blob/")
+	assert.NoError(t, err)
+	assert.Len(t, blobs, 1)
+	var size int
+	for _, n := range blobs {
+		size = n
+	}
+
+	var read int
+	layer.InjectReaderWrapper(func(r io.Reader) io.Reader { return countingReader{r, &read} })
+	restoreDir := test.CreateTempDir(t)
+	assert.NoError(t, backup.RestoreToPath(vault, restoreDir, []string{path.Join(backupPath, "c.bin")}))
+	layer.ClearReaderWrappers()
+
+	assert.True(t, read < size/2, "read %d of %d bytes", read, size)
+	data, err := ioutil.ReadFile(path.Join(restoreDir, backupPath, "c.bin"))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(contents["c.bin"], data))
+	assert.Len(t, lsFiles(path.Join(restoreDir, backupPath)), 1)
+
+	report, err := backup.Verify(vault, mustGetLatestManifest(t, vault), 100)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 4, report.Files)
+}
+
 func TestAnotherBackupOverBrokenNetwork(t *testing.T) {
 	test.RandSeed(43)
 	tempTestDir := test.CreateTempDir(t)
@@ -217,7 +410,7 @@ func TestAnotherBackupOverBrokenNetwork(t *testing.T) {
 	}
 
 	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
-	assert.Error(t, backup.RestoreToPath(vault, tempTestDir, restorePaths)) // Injected fault.
+	assert.NoError(t, backup.RestoreToPath(vault, tempTestDir, restorePaths)) // Injected faults are retried.
 	assert.NoError(t, backup.RestoreToPath(vault, tempTestDir, restorePaths))
 	assert.NoError(t, backup.RestoreToPath(vault, tempTestDir, restorePaths)) // No files changed.
 
@@ -227,6 +420,453 @@ func TestAnotherBackupOverBrokenNetwork(t *testing.T) {
 	assert.NoError(t, backup.RestoreToPath(vault, nextTestDir, restorePaths))
 }
 
+func TestBackupDefersFilesWhenRetriesRunOut(t *testing.T) {
+	test.RandSeed(52)
+	backupPath := test.CreateTempDir(t)
+	test.AppendToFile(t, path.Join(backupPath, "first.txt"), "first\n")
+
+	var cfg LocalConfig
+	opts := options{includePaths: []string{backupPath}}
+	vault, layer, _, _ := setupMockStore(t, opts)
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+
+	// Fail every other request; these get retried.
+	layer.InjectRequestFault(newRequestFaultEveryN(2))
+	test.AppendToFile(t, path.Join(backupPath, "second.txt"), "second\n")
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+	layer.ClearRequestFaults()
+
+	// Fail every put of file data, until we run out of retries.
+	var puts int
+	layer.InjectRequestFault(func(key string) error {
+		if strings.HasPrefix(key, "blob/") {
+			puts += 1
+			return testRequestFault
+		}
+		return nil
+	})
+	test.AppendToFile(t, path.Join(backupPath, "third.txt"), "third\n")
+	err := backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts))
+	assert.IsType(t, &backup.DeferredError{}, err)
+	if deferred, ok := err.(*backup.DeferredError); ok {
+		assert.Equal(t, []string{path.Join(backupPath, "third.txt")}, deferred.Paths)
+	}
+	assert.Equal(t, testRetryPolicy.Attempts, puts)
+	layer.ClearRequestFaults()
+
+	// The rest of the backup was saved, and the next backup picks up the file.
+	paths := func() (list []string) {
+		for _, e := range mustGetLatestManifest(t, vault).Entries {
+			list = append(list, e.Path())
+		}
+		sort.Strings(list)
+		return
+	}
+	assert.Equal(t, []string{backupPath, path.Join(backupPath, "first.txt"), path.Join(backupPath, "second.txt")}, paths())
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+	assert.Contains(t, paths(), path.Join(backupPath, "third.txt"))
+
+	// Some errors aren't worth retrying.
+	puts = 0
+	layer.InjectRequestFault(func(key string) error {
+		if strings.HasPrefix(key, "blob/") {
+			puts += 1
+			return storage.MockErrAccessDenied
+		}
+		return nil
+	})
+	test.AppendToFile(t, path.Join(backupPath, "fourth.txt"), "fourth\n")
+	assert.IsType(t, &backup.DeferredError{}, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+	assert.Equal(t, 1, puts)
+
+	// A changed file which fails to store keeps its entry from before, pointing at the data stored then.
+	first := func() backup.ManifestEntry {
+		for _, e := range mustGetLatestManifest(t, vault).Entries {
+			if e.Path() == path.Join(backupPath, "first.txt") {
+				return *e
+			}
+		}
+		return backup.ManifestEntry{}
+	}
+	before := first()
+	test.AppendToFile(t, path.Join(backupPath, "first.txt"), "changed\n")
+	err = backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts))
+	assert.IsType(t, &backup.DeferredError{}, err)
+	if deferred, ok := err.(*backup.DeferredError); ok {
+		assert.Contains(t, deferred.Paths, path.Join(backupPath, "first.txt"))
+	}
+	assert.Equal(t, before, first())
+	layer.ClearRequestFaults()
+	restoreDir := test.CreateTempDir(t)
+	assert.NoError(t, backup.RestoreToPath(vault, restoreDir, []string{path.Join(backupPath, "first.txt")}))
+	restored, err := ioutil.ReadFile(path.Join(restoreDir, backupPath, "first.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "first\n", string(restored))
+}
+
+func TestRestoreOlderSnapshot(t *testing.T) {
+	test.RandSeed(44)
+	tempTestDir := test.CreateTempDir(t)
+	backupPath := test.CreateTempDir(t)
+	filePath := path.Join(backupPath, "notes.txt")
+	test.AppendToFile(t, filePath, "first version\n")
+
+	var cfg LocalConfig
+	opts := options{includePaths: []string{backupPath}}
+	vault, _, _, _ := setupMockStore(t, opts)
+
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts))) // First snapshot.
+	test.AppendToFile(t, filePath, "first version\nsecond version\n")
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts))) // Second snapshot.
+
+	list, err := backup.ListSnapshots(vault)
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+
+	snap, err := backup.SelectSnapshot(vault, backup.Lineage{}, list[0].ID, time.Time{})
+	assert.NoError(t, err)
+	assert.NoError(t, backup.RestoreSnapshotToPath(vault, snap.ID, tempTestDir, []string{backupPath}))
+
+	data, err := ioutil.ReadFile(path.Join(tempTestDir, filePath))
+	assert.NoError(t, err)
+	assert.Equal(t, "first version\n", string(data))
+}
+
+func TestRestoreSnapshotWithDeletedFiles(t *testing.T) {
+	test.RandSeed(45)
+	backupPath := test.CreateTempDir(t)
+	keptPath := path.Join(backupPath, "kept.txt")
+	deletedPath := path.Join(backupPath, "deleted.txt")
+	test.AppendToFile(t, keptPath, "kept\n")
+	test.AppendToFile(t, deletedPath, "deleted\n")
+
+	var cfg LocalConfig
+	opts := options{includePaths: []string{backupPath}}
+	vault, _, _, _ := setupMockStore(t, opts)
+
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts))) // Both files.
+	assert.NoError(t, os.Remove(deletedPath))
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts))) // One file deleted.
+
+	list, err := backup.ListSnapshots(vault)
+	assert.NoError(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, 2, list[0].Files)
+	assert.Equal(t, 1, list[1].Files)
+
+	// The latest snapshot doesn't bring back the deleted file.
+	latestDir := test.CreateTempDir(t)
+	assert.NoError(t, backup.RestoreToPath(vault, latestDir, []string{backupPath}))
+	assert.Equal(t, lsFiles(backupPath), lsFiles(path.Join(latestDir, backupPath)))
+
+	// The first snapshot still has it.
+	firstDir := test.CreateTempDir(t)
+	assert.NoError(t, backup.RestoreSnapshotToPath(vault, list[0].ID, firstDir, []string{backupPath}))
+	_, err = os.Stat(path.Join(firstDir, deletedPath))
+	assert.NoError(t, err)
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	test.RandSeed(46)
+	backupPath := test.CreateTempDir(t)
+	test.AppendToFile(t, path.Join(backupPath, "first.txt"), "first\n")
+
+	var cfg LocalConfig
+	opts := options{includePaths: []string{backupPath}}
+	vault, layer, _, _ := setupMockStore(t, opts)
+
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+	test.AppendToFile(t, path.Join(backupPath, "second.txt"), "second\n")
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+
+	report, err := backup.Verify(vault, mustGetLatestManifest(t, vault), 100)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 2, report.Objects)
+	assert.Equal(t, 2, report.Files)
+
+	// Sampling checks fewer objects, but always at least one.
+	sample, err := backup.Verify(vault, mustGetLatestManifest(t, vault), 1)
+	assert.NoError(t, err)
+	assert.True(t, sample.OK())
+	assert.Equal(t, 1, sample.Objects)
+
+	// Objects no snapshot refers to are reported, until they're pruned; but they're no failure.
+	orphan := "blob/" + fmt.Sprintf("%016x", time.Now().Add(-time.Hour).UnixNano()) + "/0"
+	_, err = vault.Put(orphan, []byte("left behind by a failed backup"))
+	assert.NoError(t, err)
+	report, err = backup.Verify(vault, mustGetLatestManifest(t, vault), 100)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, []string{orphan}, report.Extra)
+	_, err = backup.Prune(vault, false)
+	assert.NoError(t, err)
+
+	// Corrupt one object and lose another.
+	var keys []string
+	for _, e := range mustGetLatestManifest(t, vault).Entries {
+		if !e.IsDir() {
+			keys = append(keys, "blob/"+e.Set+"/"+e.Parts[0].Key)
+		}
+	}
+	sort.Strings(keys)
+	corrupt, missing := keys[0], keys[len(keys)-1]
+	assert.NotEqual(t, corrupt, missing)
+	data, err := layer.GetReader(corrupt)
+	assert.NoError(t, err)
+	tampered, _ := ioutil.ReadAll(data)
+	tampered[len(tampered)/2] ^= 0xff
+	layer.PutString(corrupt, string(tampered))
+	layer.InjectRequestFault(func(key string) error {
+		if key == missing {
+			return storage.MockErrNoSuchKey
+		}
+		return nil
+	})
+
+	report, err = backup.Verify(vault, mustGetLatestManifest(t, vault), 100)
+	assert.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, []string{missing}, report.Missing)
+	assert.Len(t, report.Corrupt, 1)
+	assert.True(t, strings.HasPrefix(report.Corrupt[0], corrupt))
+}
+
+func TestPruneUnreferencedBlobs(t *testing.T) {
+	test.RandSeed(47)
+
+	var cfg LocalConfig
+	opts := options{includePaths: []string{"testdata/sample_files/"}}
+	vault, layer, _, _ := setupMockStore(t, opts)
+
+	orphan := "blob/" + fmt.Sprintf("%016x", time.Now().UnixNano()) + "/0"
+	_, err := vault.Put(orphan, []byte("left behind by a failed backup"))
+	assert.NoError(t, err)
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+	running := "blob/" + fmt.Sprintf("%016x", time.Now().UnixNano()) + "/0"
+	_, err = vault.Put(running, []byte("written by a backup still in progress"))
+	assert.NoError(t, err)
+
+	before, err := layer.List("")
+	assert.NoError(t, err)
+
+	report, err := backup.Prune(vault, true) // Dry run.
+	assert.NoError(t, err)
+	assert.Equal(t, []string{orphan}, report.Unreferenced)
+	assert.EqualValues(t, before[orphan], report.Bytes)
+	assert.Zero(t, report.Deleted)
+	after, err := layer.List("")
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	report, err = backup.Prune(vault, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Deleted)
+	after, err = layer.List("")
+	assert.NoError(t, err)
+	assert.Len(t, after, len(before)-1)
+	assert.NotContains(t, after, orphan)
+	assert.Contains(t, after, running)
+
+	restoreDir := test.CreateTempDir(t)
+	backupPath, err := file.DefaultFileSystem.AbsPath("testdata/sample_files/")
+	assert.NoError(t, err)
+	assert.NoError(t, backup.RestoreToPath(vault, restoreDir, []string{backupPath}))
+	assert.Equal(t, lsFiles(backupPath), lsFiles(path.Join(restoreDir, backupPath)))
+}
+
+func TestForgetKeepsDataOfNewerSnapshots(t *testing.T) {
+	test.RandSeed(48)
+	backupPath := test.CreateTempDir(t)
+	changedPath := path.Join(backupPath, "changed.txt")
+	test.AppendToFile(t, changedPath, "first version\n")
+
+	var cfg LocalConfig
+	opts := options{includePaths: []string{backupPath}}
+	vault, layer, _, _ := setupMockStore(t, opts)
+
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts))) // One file.
+	test.AppendToFile(t, changedPath, "first version\nsecond version\n")
+	test.AppendToFile(t, path.Join(backupPath, "unchanged.txt"), "unchanged\n")
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts))) // One changed, one added.
+	test.AppendToFile(t, path.Join(backupPath, "added.txt"), "added\n")
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts))) // One more added.
+
+	list, err := backup.ListSnapshots(vault)
+	assert.NoError(t, err)
+	assert.Len(t, list, 3)
+
+	// Keep the pinned snapshot, and the latest.
+	_, err = backup.PinSnapshot(vault, list[1].ID, true)
+	assert.NoError(t, err)
+	keep, forget, err := backup.Forget(vault, backup.Lineage{}, backup.RetentionPolicy{Last: 1}, time.Now(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{list[1].ID, list[2].ID}, []string{keep[0].ID, keep[1].ID})
+	assert.Equal(t, []string{list[0].ID}, []string{forget[0].ID})
+
+	_, err = backup.GetManifest(vault, list[0].ID)
+	assert.True(t, vault.IsNotExist(err))
+	_, err = backup.SelectSnapshot(vault, backup.Lineage{}, list[0].ID, time.Time{})
+	assert.Equal(t, backup.ErrSnapshotNotFound, err)
+
+	// Only the first version of the changed file is gone.
+	report, err := backup.Prune(vault, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Deleted)
+
+	// The latest snapshot still needs the files stored with the one before it.
+	_, err = backup.PinSnapshot(vault, list[1].ID, false)
+	assert.NoError(t, err)
+	_, forget, err = backup.Forget(vault, backup.Lineage{}, backup.RetentionPolicy{Last: 1}, time.Now(), false)
+	assert.NoError(t, err)
+	assert.Len(t, forget, 1)
+	report, err = backup.Prune(vault, false)
+	assert.NoError(t, err)
+	assert.Zero(t, report.Deleted)
+	blobs, err := layer.List("blob/")
+	assert.NoError(t, err)
+	assert.Len(t, blobs, 2)
+
+	restoreDir := test.CreateTempDir(t)
+	assert.NoError(t, backup.RestoreToPath(vault, restoreDir, []string{backupPath}))
+	assert.Equal(t, lsFiles(backupPath), lsFiles(path.Join(restoreDir, backupPath)))
+}
+
+func TestBackupDedupsRenamesAndCopies(t *testing.T) {
+	test.RandSeed(49)
+	backupPath := test.CreateTempDir(t)
+	origPath := path.Join(backupPath, "pics", "photo.jpg")
+	assert.NoError(t, os.MkdirAll(path.Dir(origPath), 0755))
+	test.AppendToFile(t, origPath, strings.Repeat("a photo of a cat\n", 100))
+
+	var cfg LocalConfig
+	opts := options{includePaths: []string{backupPath}}
+	vault, layer, _, _ := setupMockStore(t, opts)
+
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+	blobs, err := layer.List("blob/")
+	assert.NoError(t, err)
+
+	// Move the folder, and copy the file twice. Nothing new needs storing.
+	assert.NoError(t, os.Rename(path.Join(backupPath, "pics"), path.Join(backupPath, "photos")))
+	data, err := ioutil.ReadFile(path.Join(backupPath, "photos", "photo.jpg"))
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(backupPath, "copy-1.jpg"), data, 0644))
+	assert.NoError(t, ioutil.WriteFile(path.Join(backupPath, "copy-2.jpg"), data, 0600))
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+
+	after, err := layer.List("blob/")
+	assert.NoError(t, err)
+	assert.Equal(t, blobs, after)
+	report, err := backup.Verify(vault, mustGetLatestManifest(t, vault), 100)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+
+	restoreDir := test.CreateTempDir(t)
+	assert.NoError(t, backup.RestoreToPath(vault, restoreDir, []string{backupPath}))
+	assert.Equal(t, lsFiles(backupPath), lsFiles(path.Join(restoreDir, backupPath)))
+}
+
+func TestBackupChunksLargeFiles(t *testing.T) {
+	test.RandSeed(50)
+	backupPath := test.CreateTempDir(t)
+	bigPath := path.Join(backupPath, "disk.img")
+	data := make([]byte, 6<<20)
+	rand.New(rand.NewSource(50)).Read(data)
+	assert.NoError(t, ioutil.WriteFile(bigPath, data, 0644))
+
+	var cfg LocalConfig
+	opts := options{includePaths: []string{backupPath}}
+	vault, layer, _, _ := setupMockStore(t, opts)
+
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+	before, err := layer.List("chunk/")
+	assert.NoError(t, err)
+	assert.True(t, len(before) > 1)
+
+	// Insert a few bytes in the middle; only the chunks around them are new.
+	edited := append(append(append([]byte{}, data[:3<<20]...), "hello"...), data[3<<20:]...)
+	assert.NoError(t, ioutil.WriteFile(bigPath, edited, 0644))
+	assert.NoError(t, backup.ScanAndBackup(vault, scanFiles(cfg.Paths, opts)))
+
+	after, err := layer.List("chunk/")
+	assert.NoError(t, err)
+	assert.True(t, len(after)-len(before) <= 2, "%d new chunks", len(after)-len(before))
+	report, err := backup.Verify(vault, mustGetLatestManifest(t, vault), 100)
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+
+	restoreDir := test.CreateTempDir(t)
+	assert.NoError(t, backup.RestoreToPath(vault, restoreDir, []string{backupPath}))
+	restored, err := ioutil.ReadFile(path.Join(restoreDir, bigPath))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(edited, restored))
+}
+
+func TestLineagesShareOneStore(t *testing.T) {
+	test.RandSeed(54)
+	laptopPath := test.CreateTempDir(t)
+	desktopPath := test.CreateTempDir(t)
+	test.AppendToFile(t, path.Join(laptopPath, "notes.txt"), "laptop notes\n")
+	test.AppendToFile(t, path.Join(desktopPath, "games.txt"), "desktop games\n")
+
+	var cfg LocalConfig
+	laptopOpts := options{includePaths: []string{laptopPath}}
+	desktopOpts := options{includePaths: []string{desktopPath}}
+	vault, _, _, _ := setupMockStore(t, laptopOpts)
+	laptop := backup.Lineage{Host: "laptop", BackupSet: "default"}
+	desktop := backup.Lineage{Host: "desktop", BackupSet: "default"}
+
+	// Each host carries on from its own latest snapshot, not the other's.
+	assert.NoError(t, backup.ScanAndBackupLineage(vault, laptop, scanFiles(cfg.Paths, laptopOpts)))
+	assert.NoError(t, backup.ScanAndBackupLineage(vault, desktop, scanFiles(cfg.Paths, desktopOpts)))
+	assert.NoError(t, backup.ScanAndBackupLineage(vault, laptop, scanFiles(cfg.Paths, laptopOpts))) // No changes.
+	test.AppendToFile(t, path.Join(laptopPath, "notes.txt"), "more notes\n")
+	assert.NoError(t, backup.ScanAndBackupLineage(vault, laptop, scanFiles(cfg.Paths, laptopOpts)))
+
+	list, err := backup.ListSnapshots(vault)
+	assert.NoError(t, err)
+	assert.Len(t, list, 3)
+	assert.Len(t, backup.FilterSnapshots(list, laptop), 2)
+	assert.Len(t, backup.FilterSnapshots(list, backup.Lineage{BackupSet: "default"}), 3)
+
+	snap, err := backup.SelectSnapshot(vault, desktop, "", time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, desktop, snap.Lineage)
+	m, err := backup.GetManifest(vault, snap.ID)
+	assert.NoError(t, err)
+	assert.Len(t, m.FindEntries(nil, backup.EntryFilter{}), 2) // dir and file
+	assert.Empty(t, m.FindEntries([]string{laptopPath}, backup.EntryFilter{}))
+
+	restoreDir := test.CreateTempDir(t)
+	assert.NoError(t, backup.RestoreSnapshotToPath(vault, snap.ID, restoreDir, []string{desktopPath}))
+	assert.Equal(t, lsFiles(desktopPath), lsFiles(path.Join(restoreDir, desktopPath)))
+
+	// Restoring without a snapshot uses the latest of one lineage; this host's, unless it's given. (The laptop
+	// backed up last, but that's no use to this host or the desktop.)
+	restoreDir = test.CreateTempDir(t)
+	desktopOpts.lineage, desktopOpts.restoreRoot = backup.Lineage{Host: "desktop"}, restoreDir
+	assert.NoError(t, restoreFiles(vault, desktopOpts))
+	assert.Equal(t, lsFiles(desktopPath), lsFiles(path.Join(restoreDir, desktopPath)))
+	assert.Error(t, restoreFiles(vault, options{restoreRoot: restoreDir, includePaths: []string{laptopPath}}))
+	assert.NoDirExists(t, path.Join(restoreDir, laptopPath))
+
+	// Forgetting keeps the latest snapshot of every lineage.
+	keep, forget, err := backup.Forget(vault, backup.Lineage{}, backup.RetentionPolicy{Last: 1}, time.Now(), false)
+	assert.NoError(t, err)
+	assert.Len(t, keep, 2)
+	assert.Equal(t, []string{list[0].ID}, []string{forget[0].ID})
+	_, forget, err = backup.Forget(vault, desktop, backup.RetentionPolicy{Within: time.Nanosecond}, time.Now(), false)
+	assert.NoError(t, err)
+	assert.Empty(t, forget)
+}
+
+func mustGetLatestManifest(t *testing.T, vault *store.Store) *backup.Manifest {
+	m, err := backup.GetSnapshotManifest(vault, "", time.Time{})
+	assert.NoError(t, err)
+	return &m
+}
+
 // -----------------------------------------------------------------------------
 
 func TestLoadingV1ManifestFile(t *testing.T) {
@@ -281,3 +921,22 @@ func TestLoadingV3ManifestFile(t *testing.T) {
 	assert.NoError(t, err)
 	ioutil.WriteFile("testdata/manifest.v3.json~", json, 0644)
 }
+
+func TestLoadingV4ManifestFile(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/manifest.v4.json")
+	assert.NoError(t, err)
+
+	m, err := backup.ReadManifestData(data)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, m)
+
+	assert.Equal(t, 13, len(m.Entries))
+	assert.Equal(t, "142709a5d2c41b00", m.LastSet)
+	assert.True(t, m.Entries[1].Deleted)
+	assert.Equal(t, m.LastSet, m.Entries[1].Set)
+	assert.Empty(t, m.Entries[1].Parts)
+
+	json, err := m.JSON()
+	assert.NoError(t, err)
+	ioutil.WriteFile("testdata/manifest.v4.json~", json, 0644)
+}
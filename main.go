@@ -6,25 +6,114 @@ import (
 	"github.com/aviddiviner/inc/backup"
 	"github.com/aviddiviner/inc/file"
 	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/store/zip"
 	"github.com/docopt/docopt-go"
 	"log"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var usage = `Incremental remote backup utility.
 
 Usage:
-  inc init    [--cfg FILE] --pass SECRET [--storage TYPE] [--s3-key KEY]
-              [--s3-secret KEY] [--s3-region NAME] [--s3-bucket NAME]
-              [--fs-root PATH] [-f]
-  inc backup  [--cfg FILE] [--pass SECRET] [--storage TYPE] [--s3-key KEY]
-              [--s3-secret KEY] [--s3-region NAME] [--s3-bucket NAME]
-              [--fs-root PATH] <path>...
-  inc restore [--cfg FILE] [--pass SECRET] [--storage TYPE] [--s3-key KEY]
-              [--s3-secret KEY] [--s3-region NAME] [--s3-bucket NAME]
-              [--fs-root PATH] --dest DIR <path>...
+  inc init    [--cfg FILE] [--key-file FILE]
+              [--pass SECRET | --pass-file FILE | --pass-command CMD]
+              [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+              [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+              [--compress CODEC] [-f]
+  inc backup  [--cfg FILE] [--key-file FILE]
+              [--pass SECRET | --pass-file FILE | --pass-command CMD]
+              [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+              [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+              [--host NAME] [--set NAME] [--write-only] [--compress CODEC] <path>...
+  inc restore [--cfg FILE] [--key-file FILE]
+              [--pass SECRET | --pass-file FILE | --pass-command CMD]
+              [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+              [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+              [--host NAME] [--set NAME] [--snapshot ID | --as-of TIME] --dest DIR <path>...
+  inc snapshots [--cfg FILE] [--key-file FILE]
+                [--pass SECRET | --pass-file FILE | --pass-command CMD]
+                [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+                [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+                [--host NAME] [--set NAME]
+  inc ls      [--cfg FILE] [--key-file FILE]
+              [--pass SECRET | --pass-file FILE | --pass-command CMD]
+              [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+              [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+              [--snapshot ID | --as-of TIME] [-l] [<path>...]
+  inc find    [--cfg FILE] [--key-file FILE]
+              [--pass SECRET | --pass-file FILE | --pass-command CMD]
+              [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+              [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+              [--snapshot ID | --as-of TIME] [-l] [--name GLOB]
+              [--min-size SIZE] [--max-size SIZE] [--newer TIME] [--older TIME] [--changed-in SET]
+              [<path>...]
+  inc diff    [--cfg FILE] [--key-file FILE]
+              [--pass SECRET | --pass-file FILE | --pass-command CMD]
+              [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+              [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+              [--json] <from> (<to> | --disk <path>...)
+  inc verify  [--cfg FILE] [--key-file FILE]
+              [--pass SECRET | --pass-file FILE | --pass-command CMD]
+              [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+              [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+              [--snapshot ID] [--sample PERCENT]
+  inc prune   [--cfg FILE] [--key-file FILE]
+              [--pass SECRET | --pass-file FILE | --pass-command CMD]
+              [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+              [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION] [--dry-run]
+  inc forget  [--cfg FILE] [--key-file FILE]
+              [--pass SECRET | --pass-file FILE | --pass-command CMD]
+              [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+              [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+              [--keep-last N] [--keep-daily N] [--keep-weekly N] [--keep-monthly N] [--keep-within DURATION]
+              [--host NAME] [--set NAME] [--dry-run]
+  inc (pin | unpin) [--cfg FILE] [--key-file FILE]
+                    [--pass SECRET | --pass-file FILE | --pass-command CMD]
+                    [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+                    [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION] <snapshot>
+  inc unlock  [--cfg FILE] [--key-file FILE]
+              [--pass SECRET | --pass-file FILE | --pass-command CMD]
+              [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+              [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION] [--all]
+  inc key list [--cfg FILE] [--key-file FILE]
+               [--pass SECRET | --pass-file FILE | --pass-command CMD]
+               [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+               [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+  inc key add  [--cfg FILE] [--key-file FILE]
+               [--pass SECRET | --pass-file FILE | --pass-command CMD]
+               [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+               [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION] [--label TEXT]
+               [--new-pass SECRET | --new-pass-file FILE | --new-pass-command CMD]
+  inc key remove [--cfg FILE] [--key-file FILE]
+                 [--pass SECRET | --pass-file FILE | --pass-command CMD]
+                 [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+                 [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION] <slot>
+  inc key passwd [--cfg FILE] [--key-file FILE]
+                 [--pass SECRET | --pass-file FILE | --pass-command CMD]
+                 [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+                 [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+                 [--new-pass SECRET | --new-pass-file FILE | --new-pass-command CMD]
+  inc key upgrade-kdf [--cfg FILE] [--key-file FILE]
+                      [--pass SECRET | --pass-file FILE | --pass-command CMD]
+                      [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+                      [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+  inc key upgrade-metadata [--cfg FILE] [--key-file FILE]
+                           [--pass SECRET | --pass-file FILE | --pass-command CMD]
+                           [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+                           [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+  inc key export [--cfg FILE] [--key-file FILE]
+                 [--pass SECRET | --pass-file FILE | --pass-command CMD]
+                 [--storage TYPE] [--s3-key KEY] [--s3-secret KEY] [--s3-region NAME]
+                 [--s3-bucket NAME] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+                 [--hint TEXT] [--no-key] [--out FILE]
+  inc key import [--cfg FILE] [--key-file FILE]
+                 [--pass SECRET | --pass-file FILE | --pass-command CMD]
+                 [--s3-key KEY] [--s3-secret KEY] [--fs-root PATH] [--retry-attempts N] [--retry-delay DURATION]
+                 <kit>
   inc scan <path>...
   inc -h | --help
   inc --version
@@ -33,31 +122,137 @@ Commands:
   init              Initialize the store for first use. Will create the S3 bucket or folder as required.
   backup            Back up files to the store.
   restore           Restore files from the store.
+  snapshots         List the snapshots (manifests) kept in the store.
+  ls                List the files in a snapshot, as a tree or long listing.
+  find              Search for files in a snapshot.
+  diff              Show the changes between two snapshots, or between a snapshot and the files on disk.
+                    Snapshots are given by ID (or unique ID prefix), or "latest" for the latest snapshot.
+  verify            Check that the files in a snapshot can be read back from the store, decrypted and
+                    unpacked, and that their checksums match. Also lists the objects no snapshot refers to
+                    (until prune deletes them). Exits non-zero if any data is missing or corrupt.
+  forget            Forget old snapshots, keeping only those matching the --keep rules given (and the latest
+                    snapshot). Their file data is deleted afterwards by prune, once no snapshot needs it.
+  pin               Pin a snapshot, so that it is never forgotten.
+  unpin             Unpin a snapshot.
+  prune             Delete stored data which isn't needed by any snapshot anymore.
+  key list          List the store's key slots; each holds the store's master key, encrypted by some password.
+  key add           Add a key slot, so the store can also be unlocked with another password.
+  key remove        Remove a key slot, so its password can't unlock the store anymore.
+  key passwd        Change the password of the key slot opened by --pass.
+  key upgrade-kdf   Move the store onto the current key derivation function (Argon2id); the key slot opened by
+                    --pass is rewrapped with it, and so are new key slots from then on.
+  key upgrade-metadata
+                    Authenticate the metadata of a store made by an older version of inc, which is refused
+                    until then. Once done, metadata without a MAC is always refused on this machine.
+  key export        Write out a recovery kit to print and keep offline; the store's settings and its master key
+                    (or with --no-key, just a hint to the password).
+  key import        Set up the config of this machine from a recovery kit (typed into a file), so it can use the
+                    store again.
+  unlock            Remove the stale locks left in the store by commands which crashed or were killed.
   scan              Scan files and generate a manifest.json file. Don't perform any backup/restore.
 
 Options:
   --cfg FILE        Config file to read (if it exists) or write to. [default: ~/.inc.cfg]
   -f --force        Force initialization. (WARNING: This will overwrite existing data in the store.)
-  --pass SECRET     Encryption password. Used on first initialization, or when unlocking the store.
+  --key-file FILE   Keep the crypto keys in this file, rather than in the config file. (Either one holding
+                    keys must only be readable by you.)
+  --pass SECRET     Encryption password. Used on first initialization, or when unlocking the store. If it's
+                    needed but not given (by this or the options below), it's asked for at the terminal.
+  --pass-file FILE  Read the password from the first line of a file, which must only be readable by you.
+  --pass-command CMD
+                    Run a shell command, and use the first line of its output as the password. (e.g.
+                    "pass show inc")
+  --new-pass-file FILE
+                    Read the new password, for the key slot being added or changed, like --pass-file. If it's
+                    not given (by this or the options below), it's asked for twice at the terminal.
+  --new-pass-command CMD
+                    Run a shell command for the new password, like --pass-command.
+  --new-pass SECRET New password, given on the command line. (Not recommended; other users can see it.)
+  --label TEXT      Label for a new key slot, to tell it apart from others. (e.g. whose password it is)
+  --hint TEXT       A hint to the password, to write in the recovery kit.
+  --no-key          Leave the master key out of the recovery kit; the password is needed to import it then.
+  --out FILE        Write the recovery kit to a file, rather than printing it.
   --storage TYPE    Storage medium to use (s3, fs). [default: s3]
   --s3-key KEY      AWS access key. (defaults to $AWS_ACCESS_KEY, or reads $HOME/.aws/credentials)
   --s3-secret KEY   AWS secret key. (defaults to $AWS_SECRET_KEY, or reads $HOME/.aws/credentials)
   --s3-region NAME  AWS region where S3 bucket should be located. (e.g. us-west-2)
   --s3-bucket NAME  S3 bucket name. Note: bucket names are globally unique.
   --fs-root PATH    Root path to store files when using filesystem (fs) as storage.
+  --retry-attempts N
+                    How many times to try each request to the storage, before giving up on it; failures which
+                    are likely to pass (e.g. timeouts or throttling) are retried. (defaults to 5; saved to the
+                    config)
+  --retry-delay DURATION
+                    How long to wait before the first retry; the wait doubles after each one, up to at least
+                    30s. (e.g. 200ms or 2s; defaults to 500ms; saved to the config)
+  --host NAME       Host whose snapshots to use. When backing up, the host name to back up as. (defaults to
+                    this host's name when backing up, or restoring without --snapshot or --as-of; any host
+                    otherwise)
+  --set NAME        Backup set whose snapshots to use. When backing up, the backup set to add a snapshot to.
+                    (defaults to "default" when backing up, or restoring without --snapshot or --as-of; any set
+                    otherwise)
+  --write-only      Save only the write-only keys (derived from --pass) to the config; with these, this host can
+                    back up, but not read anything from the store.
+  --compress CODEC  How to compress new objects (zstd, gzip or none), and at which level. (e.g. zstd:19 or gzip:9;
+                    defaults to zstd at its default level; saved to the config) Stores made before inc could
+                    choose are always gzip; any other choice is an error there.
   --dest DIR        Destination path to restore files to.
+  --snapshot ID     Snapshot to use, by ID or unique ID prefix. (defaults to the latest)
+  --as-of TIME      Use the newest snapshot taken at or before this time. (e.g. 2016-01-05,
+                    "2016-01-05 18:30", or a duration ago like 36h)
+  -l --long         Show a long listing (mode, owner, size, mtime and set) of files.
+  --name GLOB       Only files with names matching a glob pattern. (e.g. "*.jpg")
+  --min-size SIZE   Only files of at least this size. (e.g. 500K, 20M, 1G)
+  --max-size SIZE   Only files of at most this size.
+  --newer TIME      Only files modified at or after this time.
+  --older TIME      Only files modified before this time.
+  --changed-in SET  Only files which were stored in this backup set (snapshot ID or prefix).
+  --disk            Compare against the files on disk, scanned from the paths given.
+  --json            Print the output as JSON.
+  --sample PERCENT  Only verify a random sample of this percentage of the objects in the store. [default: 100]
+  --keep-last N     Keep the last N snapshots.
+  --keep-daily N    Keep the last snapshot of each of the last N days that have snapshots.
+  --keep-weekly N   Keep the last snapshot of each of the last N weeks that have snapshots.
+  --keep-monthly N  Keep the last snapshot of each of the last N months that have snapshots.
+  --keep-within DURATION
+                    Keep all snapshots taken within this long ago. (e.g. 36h, 14d, 2w)
+  --dry-run         Only report what would be deleted, and how much space that would free up.
+  --all             Remove all locks, even those of commands which may still be running.
   -h --help         Show this screen.
   --version         Show version.
 
 Backup examples:
   inc init --pass foobar --s3-bucket myspecialbucket --s3-region us-west-2
+  inc init --key-file ~/.inc.keys --pass-command "pass show inc" --s3-bucket myspecialbucket
   inc backup ~/code ~/pics ~/movies
+  inc backup --set photos ~/pics
+  inc backup --pass foobar --write-only /var/www
 
 Any path with a leading colon (:) will be excluded from the backup. For example:
   inc backup ~/pics ~/movies :~/movies/Hellboy.mkv
 
+Browsing examples:
+  inc ls -l ~/code/inc
+  inc find --as-of 36h --name "*.go" --newer 2016-01-01 ~/code
+  inc diff --json latest --disk ~/code
+
+Maintenance examples:
+  inc verify --sample 10
+  inc verify --snapshot 1426f9f4
+  inc forget --keep-daily 7 --keep-weekly 5 --keep-monthly 12 --dry-run
+  inc pin 1426f9f4
+  inc prune --dry-run
+  inc unlock
+  inc key add --label alice
+  inc key passwd --pass-command "pass show inc" --new-pass-file ~/.inc.newpass
+  inc key upgrade-kdf --pass foobar
+  inc key export --out ~/inc-recovery.txt
+  inc key import --s3-key KEY --s3-secret KEY ~/inc-recovery.txt
+
 Restore examples:
-  inc restore --dest /tmp/restore ~/code ~/pics`
+  inc restore --dest /tmp/restore ~/code ~/pics
+  inc restore --as-of 2016-01-05 --dest /tmp/restore ~/code
+  inc restore --host old-laptop --set photos --dest /tmp/restore ~/pics`
 
 var buildTag = fmt.Sprintf("%s [%s] %s/%s", BUILD_DATE, BUILD_COMMIT, runtime.GOOS, runtime.GOARCH)
 
@@ -107,6 +302,159 @@ func parseFlags(argv []string, exit ...bool) (opt options, err error) {
 	if val, ok := args["--pass"].(string); ok {
 		opt.storeSecret = val
 	}
+	if val, ok := args["--pass-file"].(string); ok {
+		opt.passFile = file.CleanPath(val)
+	}
+	if val, ok := args["--pass-command"].(string); ok {
+		opt.passCommand = val
+	}
+	if val, ok := args["--key-file"].(string); ok {
+		opt.keyFile = file.CleanPath(val)
+	}
+	if val, ok := args["--snapshot"].(string); ok {
+		opt.snapshotID = val
+	}
+	if val, ok := args["--as-of"].(string); ok {
+		if opt.asOf, err = parseTime(val, time.Now()); err != nil {
+			return
+		}
+	}
+	if val, ok := args["--long"].(bool); ok {
+		opt.longListing = val
+	}
+	if val, ok := args["--name"].(string); ok {
+		opt.filter.Name = val
+	}
+	if val, ok := args["--min-size"].(string); ok {
+		if opt.filter.MinSize, err = parseSize(val); err != nil {
+			return
+		}
+	}
+	if val, ok := args["--max-size"].(string); ok {
+		if opt.filter.MaxSize, err = parseSize(val); err != nil {
+			return
+		}
+	}
+	if val, ok := args["--newer"].(string); ok {
+		if opt.filter.Newer, err = parseTime(val, time.Now()); err != nil {
+			return
+		}
+	}
+	if val, ok := args["--older"].(string); ok {
+		if opt.filter.Older, err = parseTime(val, time.Now()); err != nil {
+			return
+		}
+	}
+	if val, ok := args["--changed-in"].(string); ok {
+		opt.filter.Set = val
+	}
+	if val, ok := args["--json"].(bool); ok {
+		opt.jsonOutput = val
+	}
+	if val, ok := args["<from>"].(string); ok {
+		opt.diffFrom = val
+	}
+	if val, ok := args["<to>"].(string); ok {
+		opt.diffTo = val
+	}
+	if val, ok := args["--dry-run"].(bool); ok {
+		opt.dryRun = val
+	}
+	if val, ok := args["--host"].(string); ok {
+		opt.lineage.Host = val
+	}
+	if val, ok := args["--set"].(string); ok {
+		opt.lineage.BackupSet = val
+	}
+	if val, ok := args["--all"].(bool); ok {
+		opt.unlockAll = val
+	}
+	if val, ok := args["--write-only"].(bool); ok {
+		opt.writeOnly = val
+	}
+	if val, ok := args["--compress"].(string); ok {
+		if _, err = zip.ParseConfig(val); err != nil {
+			return
+		}
+		opt.compression = val
+	}
+	if val, ok := args["--retry-attempts"].(string); ok {
+		if opt.retryAttempts, err = strconv.Atoi(val); err != nil || opt.retryAttempts < 1 {
+			err = fmt.Errorf("unable to parse --retry-attempts: %q (must be at least 1)", val)
+			return
+		}
+	}
+	if val, ok := args["--retry-delay"].(string); ok {
+		var d time.Duration
+		if d, err = parseDuration(val); err != nil || d <= 0 {
+			err = fmt.Errorf("unable to parse --retry-delay: %q (must be longer than 0)", val)
+			return
+		}
+		opt.retryDelay = val
+	}
+	for flag, n := range map[string]*int{
+		"--keep-last":    &opt.retention.Last,
+		"--keep-daily":   &opt.retention.Daily,
+		"--keep-weekly":  &opt.retention.Weekly,
+		"--keep-monthly": &opt.retention.Monthly,
+	} {
+		if val, ok := args[flag].(string); ok {
+			if *n, err = strconv.Atoi(val); err != nil || *n < 0 {
+				err = fmt.Errorf("unable to parse %s: %q", flag, val)
+				return
+			}
+		}
+	}
+	if val, ok := args["--keep-within"].(string); ok {
+		if opt.retention.Within, err = parseDuration(val); err != nil {
+			return
+		}
+	}
+	if val, ok := args["--new-pass"].(string); ok {
+		opt.newSecret = val
+	}
+	if val, ok := args["--new-pass-file"].(string); ok {
+		opt.newPassFile = file.CleanPath(val)
+	}
+	if val, ok := args["--new-pass-command"].(string); ok {
+		opt.newPassCmd = val
+	}
+	if val, ok := args["--label"].(string); ok {
+		opt.keyLabel = val
+	}
+	if val, ok := args["<slot>"].(string); ok {
+		opt.keySlot = val
+	}
+	if val, ok := args["--hint"].(string); ok {
+		opt.keyHint = val
+	}
+	if val, ok := args["--no-key"].(bool); ok {
+		opt.noKey = val
+	}
+	if val, ok := args["--out"].(string); ok {
+		opt.kitPath = file.CleanPath(val)
+	}
+	if val, ok := args["<kit>"].(string); ok {
+		opt.kitPath = file.CleanPath(val)
+	}
+	if val, ok := args["<snapshot>"].(string); ok {
+		opt.snapshotID = val
+	}
+	if val, ok := args["--sample"].(string); ok {
+		if opt.samplePercent, err = parsePercent(val); err != nil {
+			return
+		}
+	}
+	for _, cmd := range commands {
+		if val, ok := args[cmd].(bool); ok && val {
+			opt.command = cmd
+		}
+	}
+	for _, cmd := range keyCommands {
+		if val, ok := args[cmd].(bool); ok && val && opt.command == "key" {
+			opt.keyCommand = cmd
+		}
+	}
 
 	for _, p := range args["<path>"].([]string) {
 		if strings.HasPrefix(p, ":") {
@@ -120,15 +468,22 @@ func parseFlags(argv []string, exit ...bool) (opt options, err error) {
 	return
 }
 
-// Load the config file (or default path), then set any specific command line overrides provided.
-func loadConfig(opt options) (original, cfg LocalConfig) {
-	cfg, err := LoadConfigFile(opt.configPath)
+// Load the config file (or default path) and its keys, then set any specific command line overrides provided.
+func loadConfig(opt options) (original, cfg LocalConfig, err error) {
+	cfg, err = LoadConfigFile(opt.configPath)
 	if err != nil {
 		log.Printf("unable to load config file: %q\n", opt.configPath)
-		cfg = NewConfig()
+		cfg, err = NewConfig(), nil
+	} else if err = cfg.Store.LoadKeys(opt.configPath); err != nil {
+		return
 	}
 	original = cfg
 
+	// Move the keys to (or from) a key file, if one is given.
+	if opt.keyFile != "" {
+		cfg.Store.KeyFile = opt.keyFile
+	}
+
 	// Override any store specific settings.
 	if opt.s3Region != "" {
 		cfg.Store.S3Region = opt.s3Region
@@ -142,6 +497,15 @@ func loadConfig(opt options) (original, cfg LocalConfig) {
 	if opt.awsSecretKey != "" {
 		cfg.Store.AWSSecretKey = opt.awsSecretKey
 	}
+	if opt.compression != "" {
+		cfg.Store.Compression = opt.compression
+	}
+	if opt.retryAttempts != 0 {
+		cfg.Store.RetryAttempts = opt.retryAttempts
+	}
+	if opt.retryDelay != "" {
+		cfg.Store.RetryDelay = opt.retryDelay
+	}
 
 	return
 }
@@ -164,7 +528,44 @@ func setupStore(cfg *LocalConfigStore, opt options) (bucket *store.Store, err er
 		err = errors.New("invalid storage type")
 		return
 	}
+	if cfg.Compression != "" {
+		c, err := zip.ParseConfig(cfg.Compression)
+		if err != nil {
+			return nil, err
+		}
+		bucket.SetCompression(c)
+	}
+	policy, err := cfg.RetryPolicy()
+	if err != nil {
+		return nil, err
+	}
+	bucket.SetRetryPolicy(policy)
+	// Metadata without a MAC is only opened to upgrade it, and never once we've seen it authenticated; then it's an
+	// old copy put back, which would roll the store back.
+	if opt.command == "key" && opt.keyCommand == "upgrade-metadata" && !cfg.AuthenticatedMetadata {
+		bucket.AllowLegacyMetadata()
+	}
+	if err = openStore(bucket, cfg, opt); err != nil {
+		if err == store.ErrLegacyMetadata && cfg.AuthenticatedMetadata {
+			err = ErrMetadataRolledBack
+		}
+		return
+	}
+	if bucket.MetadataAuthenticated() {
+		cfg.AuthenticatedMetadata = true
+	}
+	// Only new stores can choose their compression; say so, rather than ignore the flag.
+	if opt.compression != "" {
+		c, _ := zip.ParseConfig(opt.compression)
+		if err = bucket.CheckCompression(c); err != nil {
+			err = fmt.Errorf("unable to use --compress %s: %s", opt.compression, err)
+		}
+	}
+	return
+}
 
+// Open the store; initialize it, unlock it with the password given, or use the keys in the config.
+func openStore(bucket *store.Store, cfg *LocalConfigStore, opt options) (err error) {
 	// If we tried to initialize the store, check that a password was provided. Otherwise,
 	// if a password was given, derive new crypto keys, or else just try the existing keys.
 	if opt.storeInit {
@@ -182,7 +583,32 @@ func setupStore(cfg *LocalConfigStore, opt options) (bucket *store.Store, err er
 	}
 	if opt.storeSecret != "" {
 		log.Println("attempting to access the store with the password provided")
-		cfg.Keys, err = bucket.Unlock([]byte(opt.storeSecret))
+		if cfg.Keys, err = bucket.Unlock([]byte(opt.storeSecret)); err != nil {
+			return
+		}
+		cfg.WriteOnlyKeys = store.WriteOnlyKeys{}
+		if opt.writeOnly {
+			// Keep only the write-only keys, so the config can't be used to read the store.
+			log.Println("saving only the write-only keys to config")
+			if cfg.WriteOnlyKeys, err = cfg.Keys.WriteOnly(); err != nil {
+				return
+			}
+			cfg.Keys = store.Keys{}
+			err = bucket.OpenWriteOnly(cfg.WriteOnlyKeys)
+		}
+		return
+	}
+	if opt.writeOnly {
+		err = errors.New("You must provide a password to save write-only keys.")
+		return
+	}
+	if cfg.Keys.EncKey == nil && !cfg.WriteOnlyKeys.IsEmpty() {
+		log.Println("using the write-only keys from config to write to the store")
+		err = bucket.OpenWriteOnly(cfg.WriteOnlyKeys)
+		return
+	}
+	if !cfg.HasKeys() {
+		err = ErrNoPassword
 		return
 	}
 	log.Println("using the crypto keys from config to read the store")
@@ -197,6 +623,36 @@ func exitIfError(err error) {
 	}
 }
 
+// Run a command, once the store is set up and locked.
+func runCommand(bucket *store.Store, cfg LocalConfig, opts options) error {
+	switch opts.command {
+	case "restore":
+		return restoreFiles(bucket, opts)
+	case "snapshots":
+		return listSnapshots(bucket, opts)
+	case "ls", "find":
+		return listFiles(bucket, opts)
+	case "diff":
+		return diffSnapshots(bucket, opts)
+	case "verify":
+		return verifySnapshot(bucket, opts)
+	case "prune":
+		return pruneStore(bucket, opts)
+	case "forget":
+		return forgetSnapshots(bucket, opts)
+	case "pin", "unpin":
+		return pinSnapshot(bucket, opts)
+	case "key":
+		return manageKeys(bucket, cfg, opts)
+	default:
+		scanner := scanFiles(cfg.Paths, opts)
+		if cfg.Store.KeyFile != "" {
+			scanner.ExcludePath(cfg.Store.KeyFile)
+		}
+		return backupFiles(bucket, backupLineage(opts), scanner)
+	}
+}
+
 func main() {
 	opts, err := parseFlags(os.Args[1:])
 	exitIfError(err)
@@ -209,9 +665,22 @@ func main() {
 		return
 	}
 
-	original, cfg := loadConfig(opts)
+	original, cfg, err := loadConfig(opts)
+	exitIfError(err)
+	var kitStoreID string
+	if opts.command == "key" && opts.keyCommand == "import" {
+		kitStoreID, err = importRecoveryKit(&cfg, &opts)
+		exitIfError(err)
+	}
+	opts.storeSecret, err = readPassword(opts, cfg.Store)
+	exitIfError(err)
+	if needsNewPassword(opts) {
+		opts.newSecret, err = readNewPassword(opts)
+		exitIfError(err)
+	}
 	bucket, err := setupStore(&cfg.Store, opts)
 	exitIfError(err)
+	exitIfError(checkKitStore(bucket, kitStoreID))
 
 	// Save the config if it changed.
 	if !original.Equal(cfg) {
@@ -219,10 +688,20 @@ func main() {
 		exitIfError(cfg.WriteToFile(opts.configPath))
 	}
 
-	if opts.restoreRoot != "" {
-		exitIfError(backup.RestoreToPath(bucket, opts.restoreRoot, opts.includePaths))
+	if bucket.IsWriteOnly() && !allowsWriteOnly(opts) {
+		exitIfError(ErrWriteOnlyCommand)
+	}
+
+	if opts.command == "unlock" {
+		exitIfError(unlockStore(bucket, opts))
 	} else {
-		exitIfError(backup.ScanAndBackup(bucket, scanFiles(cfg.Paths, opts)))
+		lock, err := bucket.Lock(needsExclusiveLock(opts))
+		exitIfError(err)
+		err = runCommand(bucket, cfg, opts)
+		if e := lock.Unlock(); e != nil {
+			log.Printf("failed to release lock: %s\n", e)
+		}
+		exitIfError(err)
 	}
 
 	fmt.Println("<exited normally>")
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/store/crypto"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error when a recovery kit can't be read; it isn't one, or it's missing something.
+var ErrMalformedKit = errors.New("malformed recovery kit")
+
+// The master key is written out in lines of this many bytes, each followed by a checksum, so that a line typed in
+// wrong (or two lines swapped) is caught, and we can say which.
+const c_KIT_LINE_BYTES = 8
+const c_KIT_CHECKSUM_BYTES = 2
+
+// Base32, without padding; it's case-insensitive, and has no 0, 1, 8 or 9 to mistake for O, I or B.
+var kitEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Digits which are easily typed in for letters of the encoding (and the separators between groups).
+var kitTypos = strings.NewReplacer("0", "O", "1", "I", "8", "B", "-", "", " ", "")
+
+// RecoveryKit has what it takes to rebuild the config of a store on a new machine; the store's settings, and its
+// master key or a hint to the password. (The AWS credentials are left out; they're given again when importing.)
+type RecoveryKit struct {
+	StoreID  string
+	Created  time.Time
+	Storage  string
+	S3Region string
+	S3Bucket string
+	FSRoot   string
+	Hint     string
+	Keys     store.Keys // none, if the kit only has a hint
+}
+
+// The kit fields, in the order they're written.
+var kitFields = []string{"Store", "Created", "Storage", "S3 region", "S3 bucket", "FS root", "Password hint"}
+
+func (k *RecoveryKit) field(name string) *string {
+	switch name {
+	case "Store":
+		return &k.StoreID
+	case "Storage":
+		return &k.Storage
+	case "S3 region":
+		return &k.S3Region
+	case "S3 bucket":
+		return &k.S3Bucket
+	case "FS root":
+		return &k.FSRoot
+	case "Password hint":
+		return &k.Hint
+	}
+	return nil
+}
+
+// Where the store with an ID is kept. The IDs of S3 stores include the AWS access key, which is left out; a kit may
+// be imported with other credentials than it was exported with.
+func kitStoreLocation(id string) string {
+	if parts := strings.SplitN(id, "/", 3); len(parts) == 3 && parts[0] == "s3" {
+		return "s3/" + parts[2]
+	}
+	return id
+}
+
+// HasKeys returns true if the kit holds the master key.
+func (k RecoveryKit) HasKeys() bool {
+	return k.Keys.EncKey != nil
+}
+
+// The checksum of a line of the master key; its line number is included, so lines can't be swapped.
+func kitChecksum(n int, data []byte) []byte {
+	sum := sha256.Sum256(append([]byte{byte(n)}, data...))
+	return sum[:c_KIT_CHECKSUM_BYTES]
+}
+
+// Encode the master key in lines of base32, in groups of four letters.
+func encodeKitKeys(keys store.Keys) (lines []string) {
+	data := append(append([]byte{}, keys.EncKey...), keys.AuthKey...)
+	for n := 1; len(data) > 0; n++ {
+		size := c_KIT_LINE_BYTES
+		if len(data) < size {
+			size = len(data)
+		}
+		text := kitEncoding.EncodeToString(append(append([]byte{}, data[:size]...), kitChecksum(n, data[:size])...))
+		var groups []string
+		for i := 0; i < len(text); i += 4 {
+			end := i + 4
+			if end > len(text) {
+				end = len(text)
+			}
+			groups = append(groups, text[i:end])
+		}
+		lines = append(lines, fmt.Sprintf("%02d  %s", n, strings.Join(groups, " ")))
+		data = data[size:]
+	}
+	return
+}
+
+// Decode the lines of the master key, by line number.
+func decodeKitKeys(lines map[int]string) (keys store.Keys, err error) {
+	var data []byte
+	last := 0
+	for n := range lines {
+		if n > last {
+			last = n
+		}
+	}
+	for n := 1; n <= last; n++ {
+		text, ok := lines[n]
+		if !ok {
+			return keys, fmt.Errorf("recovery kit: line %02d of the master key is missing", n)
+		}
+		line, err := kitEncoding.DecodeString(kitTypos.Replace(strings.ToUpper(text)))
+		if err != nil || len(line) <= c_KIT_CHECKSUM_BYTES {
+			return keys, fmt.Errorf("recovery kit: line %02d of the master key is mistyped", n)
+		}
+		body, sum := line[:len(line)-c_KIT_CHECKSUM_BYTES], line[len(line)-c_KIT_CHECKSUM_BYTES:]
+		if !bytes.Equal(sum, kitChecksum(n, body)) {
+			return keys, fmt.Errorf("recovery kit: line %02d of the master key is mistyped", n)
+		}
+		data = append(data, body...)
+	}
+	if keys.EncKey, keys.AuthKey, err = crypto.SplitKeys(data); err != nil {
+		err = ErrMalformedKit
+	}
+	return
+}
+
+// WriteTo writes out the kit as text, to be printed and kept somewhere safe.
+func (k RecoveryKit) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, "inc recovery kit")
+	fmt.Fprintln(&buf, "================")
+	fmt.Fprintln(&buf)
+	if k.HasKeys() {
+		fmt.Fprintln(&buf, "This kit holds the master key of the store below. Anyone who has it (and access to the")
+		fmt.Fprintln(&buf, "store) can read your backups, so keep it somewhere safe, offline.")
+	} else {
+		fmt.Fprintln(&buf, "This kit holds the settings of the store below, and a hint to its password; you'll need")
+		fmt.Fprintln(&buf, "the password to import it.")
+	}
+	fmt.Fprintln(&buf)
+	for _, name := range kitFields {
+		val := ""
+		if name == "Created" {
+			val = k.Created.Local().Format(c_TIME_FORMAT)
+		} else {
+			val = *k.field(name)
+		}
+		if val != "" {
+			fmt.Fprintf(&buf, "%-15s%s\n", name+":", val)
+		}
+	}
+	if k.HasKeys() {
+		fmt.Fprintln(&buf)
+		fmt.Fprintln(&buf, "Master key:")
+		for _, line := range encodeKitKeys(k.Keys) {
+			fmt.Fprintf(&buf, "  %s\n", line)
+		}
+	}
+	fmt.Fprintln(&buf)
+	fmt.Fprintln(&buf, "To set up a new machine, type this kit into a file (just the lines above will do), then run:")
+	fmt.Fprintln(&buf, "  inc key import [--s3-key KEY --s3-secret KEY] FILE")
+	return buf.WriteTo(w)
+}
+
+var kitFieldLine = regexp.MustCompile(`^([A-Za-z0-9 ]+):\s*(.*)$`)
+var kitKeyLine = regexp.MustCompile(`^(\d+)[.:]?\s+([A-Za-z0-9 -]+)$`)
+
+// ParseRecoveryKit reads a kit written by WriteTo (or typed in from a printout of one).
+func ParseRecoveryKit(r io.Reader) (k RecoveryKit, err error) {
+	lines := make(map[int]string)
+	inKey := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if m := kitKeyLine.FindStringSubmatch(line); inKey && m != nil {
+			n, _ := strconv.Atoi(m[1])
+			lines[n] = m[2]
+			continue
+		}
+		inKey = false
+		m := kitFieldLine.FindStringSubmatch(line)
+		switch {
+		case m == nil:
+		case strings.EqualFold(m[1], "Master key"):
+			inKey = true
+		case strings.EqualFold(m[1], "Created"):
+			k.Created, _ = time.ParseInLocation(c_TIME_FORMAT, m[2], time.Local)
+		default:
+			for _, name := range kitFields {
+				if strings.EqualFold(m[1], name) && k.field(name) != nil {
+					*k.field(name) = m[2]
+				}
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if k.Storage == "" {
+		return k, ErrMalformedKit
+	}
+	if len(lines) > 0 {
+		k.Keys, err = decodeKitKeys(lines)
+	}
+	return
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"github.com/aviddiviner/inc/store"
+	"github.com/aviddiviner/inc/util/test"
+	"github.com/stretchr/testify/assert"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoveryKit(t *testing.T) {
+	test.RandSeed(58)
+	keys := store.Keys{EncKey: test.RandBytes(32), AuthKey: test.RandBytes(64)}
+	kit := RecoveryKit{StoreID: "s3/KEY/us-west-2/bucket", Created: time.Now().Truncate(time.Second),
+		Storage: "s3", S3Region: "us-west-2", S3Bucket: "bucket", Hint: "the usual, with: a colon", Keys: keys}
+
+	var buf bytes.Buffer
+	_, err := kit.WriteTo(&buf)
+	assert.NoError(t, err)
+	text := buf.String()
+	got, err := ParseRecoveryKit(strings.NewReader(text))
+	assert.NoError(t, err)
+	assert.Equal(t, kit.Created.Unix(), got.Created.Unix())
+	got.Created = kit.Created
+	assert.Equal(t, kit, got)
+
+	// Typed in from a printout; just the lines that matter, in lower case, with some digits for letters.
+	lines := encodeKitKeys(keys)
+	assert.Len(t, lines, 12)
+	typed := "storage: s3\nMaster key:\n"
+	for _, line := range lines {
+		typed += strings.NewReplacer("O", "0", "I", "1").Replace(strings.ToLower(line)) + "\n"
+	}
+	got, err = ParseRecoveryKit(strings.NewReader(typed))
+	assert.NoError(t, err)
+	assert.Equal(t, keys, got.Keys)
+
+	// Mistyped, missing and swapped lines are caught.
+	mistyped := strings.Replace(text, lines[3][4:8], "ZZZZ", 1)
+	_, err = ParseRecoveryKit(strings.NewReader(mistyped))
+	assert.EqualError(t, err, "recovery kit: line 04 of the master key is mistyped")
+	_, err = ParseRecoveryKit(strings.NewReader(strings.Replace(text, lines[6], "", 1)))
+	assert.EqualError(t, err, "recovery kit: line 07 of the master key is missing")
+	swapped := strings.Replace(text, lines[1][4:], lines[2][4:], 1)
+	_, err = ParseRecoveryKit(strings.NewReader(swapped))
+	assert.EqualError(t, err, "recovery kit: line 02 of the master key is mistyped")
+
+	_, err = ParseRecoveryKit(strings.NewReader("some other file\n"))
+	assert.Equal(t, ErrMalformedKit, err)
+}
+
+func TestExportAndImportRecoveryKit(t *testing.T) {
+	test.RandSeed(59)
+	dir := test.CreateTempDir(t)
+	kitPath := path.Join(dir, "kit.txt")
+	root := test.CreateTempDir(t)
+
+	// Set up a store, then export its kit, with and without the master key.
+	cfg := NewConfig()
+	opts := options{command: "init", storeInit: true, storeSecret: testPassword, storageType: "fs", fsRootFolder: root}
+	bucket, err := setupStore(&cfg.Store, opts)
+	assert.NoError(t, err)
+	opts = options{command: "key", keyCommand: "export", storageType: "fs", fsRootFolder: root, kitPath: kitPath}
+	assert.NoError(t, exportRecoveryKit(bucket, cfg, opts))
+
+	// On a new machine, the kit is enough to open the store.
+	imported := NewConfig()
+	opts = options{command: "key", keyCommand: "import", storageType: "s3", kitPath: kitPath}
+	storeID, err := importRecoveryKit(&imported, &opts)
+	assert.NoError(t, err)
+	assert.Equal(t, bucket.ID(), storeID)
+	assert.Equal(t, "fs", opts.storageType)
+	assert.Equal(t, root, opts.fsRootFolder)
+	assert.Equal(t, cfg.Store.Keys, imported.Store.Keys)
+	opened, err := setupStore(&imported.Store, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, checkKitStore(opened, storeID))
+
+	// Without the master key, the password is needed too.
+	opts = options{command: "key", keyCommand: "export", storageType: "fs", fsRootFolder: root, kitPath: kitPath,
+		keyHint: "the usual", noKey: true}
+	assert.NoError(t, exportRecoveryKit(bucket, cfg, opts))
+	imported = NewConfig()
+	opts = options{command: "key", keyCommand: "import", storageType: "s3", kitPath: kitPath}
+	_, err = importRecoveryKit(&imported, &opts)
+	assert.NoError(t, err)
+	assert.False(t, imported.Store.HasKeys())
+	_, err = setupStore(&imported.Store, opts)
+	assert.Equal(t, ErrNoPassword, err)
+	opts.storeSecret = testPassword
+	_, err = setupStore(&imported.Store, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.Store.Keys, imported.Store.Keys)
+
+	// Another store, with the same password, given on the command line; it isn't the store of the kit.
+	other := test.CreateTempDir(t)
+	opts = options{command: "init", storeInit: true, storeSecret: testPassword, storageType: "fs", fsRootFolder: other}
+	otherCfg := NewConfig()
+	_, err = setupStore(&otherCfg.Store, opts)
+	assert.NoError(t, err)
+	imported = NewConfig()
+	opts = options{command: "key", keyCommand: "import", storageType: "s3", fsRootFolder: other, kitPath: kitPath,
+		storeSecret: testPassword}
+	storeID, err = importRecoveryKit(&imported, &opts)
+	assert.NoError(t, err)
+	opened, err = setupStore(&imported.Store, opts)
+	assert.NoError(t, err)
+	assert.Error(t, checkKitStore(opened, storeID))
+}
+
+func TestKitStoreLocation(t *testing.T) {
+	assert.Equal(t, "s3/us-east-1/backups", kitStoreLocation("s3/AKIAOLD/us-east-1/backups"))
+	assert.Equal(t, kitStoreLocation("s3/AKIAOLD/us-east-1/backups"), kitStoreLocation("s3/AKIANEW/us-east-1/backups"))
+	assert.Equal(t, "fs/tmp/store", kitStoreLocation("fs/tmp/store"))
+}
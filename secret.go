@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/aviddiviner/inc/file"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Error when a password is read from a file or command, but it's empty.
+var ErrEmptyPassword = errors.New("the password given is empty")
+
+// Error when a command needs a password, but none was given (and we can't ask for one).
+var ErrNoPassword = errors.New("You must provide a password (with --pass, --pass-file or --pass-command).")
+
+// Error when a command needs a new password, but none was given (and we can't ask for one).
+var ErrNoNewPassword = errors.New("You must provide a new password (with --new-pass-file or --new-pass-command).")
+
+// Error when the password typed in again doesn't match the first.
+var ErrPasswordMismatch = errors.New("the passwords typed in don't match")
+
+// Commands which always need a password, rather than the keys in the config.
+func needsPassword(opt options) bool {
+	switch opt.command {
+	case "init":
+		return true
+	case "key":
+		return opt.keyCommand == "passwd" || opt.keyCommand == "upgrade-kdf"
+	}
+	return opt.writeOnly
+}
+
+// Read the password from wherever it was given; the command line, a file, or the output of a command. If none was
+// given, but one is needed (or there are no keys in the config to use instead), it's asked for at the terminal.
+func readPassword(opt options, cfg LocalConfigStore) (string, error) {
+	switch {
+	case opt.storeSecret != "":
+		return opt.storeSecret, nil
+	case opt.passFile != "":
+		return readPasswordFile(opt.passFile)
+	case opt.passCommand != "":
+		return runPasswordCommand(opt.passCommand)
+	case (needsPassword(opt) || !cfg.HasKeys()) && isTerminal(os.Stdin):
+		return promptPassword("Password", opt.command == "init")
+	case needsPassword(opt):
+		return "", ErrNoPassword
+	}
+	return "", nil
+}
+
+// Commands which set a new password, for a key slot.
+func needsNewPassword(opt options) bool {
+	return opt.command == "key" && (opt.keyCommand == "add" || opt.keyCommand == "passwd")
+}
+
+// Read the new password like readPassword does the password; from a file, the output of a command, or else at the
+// terminal, twice. It can also be given on the command line, but then it shows up in ps and the shell history.
+func readNewPassword(opt options) (string, error) {
+	switch {
+	case opt.newSecret != "":
+		fmt.Fprintln(os.Stderr, "Warning: a password given with --new-pass can be seen by other users of this "+
+			"machine, and is kept in your shell history; use --new-pass-file or --new-pass-command instead.")
+		return opt.newSecret, nil
+	case opt.newPassFile != "":
+		return readPasswordFile(opt.newPassFile)
+	case opt.newPassCmd != "":
+		return runPasswordCommand(opt.newPassCmd)
+	case isTerminal(os.Stdin):
+		return promptPassword("New password", true)
+	}
+	return "", ErrNoNewPassword
+}
+
+// The first line of some text, without its line ending.
+func firstLine(data []byte) string {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		data = data[:i]
+	}
+	return strings.TrimSuffix(string(data), "\r")
+}
+
+// Read the password from the first line of a file, which only we can read.
+func readPasswordFile(path string) (string, error) {
+	if err := checkPrivateFile(path); err != nil {
+		return "", err
+	}
+	data, err := file.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if pass := firstLine(data); pass != "" {
+		return pass, nil
+	}
+	return "", ErrEmptyPassword
+}
+
+// Run a shell command (e.g. of a password manager), and read the password from the first line of its output.
+func runPasswordCommand(command string) (string, error) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("password command failed: %s", err)
+	}
+	if pass := firstLine(out); pass != "" {
+		return pass, nil
+	}
+	return "", ErrEmptyPassword
+}
+
+// Ask for a password at the terminal, without echoing it. New passwords are asked for twice.
+func promptPassword(label string, confirm bool) (string, error) {
+	in := bufio.NewReader(os.Stdin)
+	fmt.Fprintf(os.Stderr, "%s: ", label)
+	pass, err := readNoEcho(os.Stdin, in)
+	if err != nil {
+		return "", err
+	}
+	if pass == "" {
+		return "", ErrEmptyPassword
+	}
+	if confirm {
+		fmt.Fprintf(os.Stderr, "%s (again): ", label)
+		again, err := readNoEcho(os.Stdin, in)
+		if err != nil {
+			return "", err
+		}
+		if again != pass {
+			return "", ErrPasswordMismatch
+		}
+	}
+	return pass, nil
+}
@@ -0,0 +1,296 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"io/ioutil"
+)
+
+// Error when a segment of an AEAD ciphertext fails authentication.
+var ErrNotAuthentic = errors.New("ciphertext not authentic")
+
+// Error when an AEAD ciphertext ends before its final segment.
+var ErrTruncated = errors.New("ciphertext truncated")
+
+// AEAD ciphertexts start with this, so we can tell them apart from the older CBC ones (which start with a random IV).
+const c_AEAD_MAGIC = "inc\x00gcm\x01"
+
+// Plaintext is encrypted in segments of this size, each authenticated on its own.
+const c_SEGMENT_SIZE = 64 << 10
+
+// Each ciphertext is encrypted with its own key, derived from the AEAD key and a random salt of this size, so that the
+// nonces of different ciphertexts never need to be told apart (see encryptStream).
+const c_OBJECT_SALT_SIZE = 32
+
+// Nonces are made of a random prefix (one per ciphertext), the segment counter and a flag marking the last segment.
+const c_NONCE_PREFIX_SIZE = 7
+
+// The size of the GCM tag at the end of each segment.
+const c_TAG_SIZE = 16
+
+// The AEAD key is derived from the auth key with this context, so it's never the same as the CBC encryption key.
+const c_AEAD_KEY_CONTEXT = "inc.aead-key\x00"
+
+// The key of each ciphertext is derived from the AEAD key (or a data key) and its salt with this context.
+const c_OBJECT_KEY_CONTEXT = "inc.aead-object-key\x00"
+
+type aeadCrypter struct {
+	*aesCrypter // for keyed hashes, and reading the older CBC ciphertexts
+	key         []byte
+}
+
+// Encrypt and decrypt using AES-256-GCM, in the STREAM construction (https://eprint.iacr.org/2015/189.pdf). The
+// plaintext is split into segments, each encrypted and authenticated on its own, so no plaintext is released before it
+// has been authenticated. The nonce of each segment includes its position, and a flag on the last one, so segments
+// can't be reordered, and a truncated ciphertext is detected. Like Tink's streaming AEAD, each ciphertext has its own
+// key, derived with HKDF from the AEAD key and a random salt, so a nonce prefix repeated across ciphertexts is harmless.
+//
+// Our encryption envelope consists of (magic||salt||nonce prefix||segment||segment...), where each segment is up to
+// 64KB of ciphertext and its 16-byte tag. Older CBC ciphertexts (see NewCrypter) can still be decrypted.
+func NewAEADCrypter(encKey, authKey []byte) (Crypter, error) {
+	c, err := NewCrypter(encKey, authKey)
+	if err != nil {
+		return nil, err
+	}
+	return &aeadCrypter{c.(*aesCrypter), deriveKey(authKey, c_AEAD_KEY_CONTEXT)}, nil
+}
+
+// Encrypt and authenticate plaintext.
+func (e *aeadCrypter) Encrypt(plaintext []byte) ([]byte, error) {
+	r, err := e.EncryptReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Authenticate and decrypt ciphertext.
+func (e *aeadCrypter) Decrypt(ciphertext []byte) ([]byte, error) {
+	r, err := e.DecryptReader(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func (e *aeadCrypter) EncryptReader(plaintext io.Reader) (ciphertext io.Reader, err error) {
+	return encryptStream(e.key, plaintext)
+}
+
+func (e *aeadCrypter) DecryptReader(ciphertext io.Reader) (plaintext io.Reader, err error) {
+	text := bufio.NewReaderSize(ciphertext, c_SEGMENT_SIZE+c_TAG_SIZE)
+	magic, err := text.Peek(len(c_AEAD_MAGIC))
+	if err != nil || string(magic) != c_AEAD_MAGIC {
+		return e.aesCrypter.DecryptReader(text)
+	}
+	return decryptStream(e.key, text)
+}
+
+// Encrypt a plaintext in segments, under a key of its own derived from the given key, returning the whole envelope
+// (magic||salt||nonce prefix||segment||segment...).
+func encryptStream(key []byte, plaintext io.Reader) (ciphertext io.Reader, err error) {
+	header := make([]byte, c_OBJECT_SALT_SIZE+c_NONCE_PREFIX_SIZE)
+	if _, err = rand.Read(header); err != nil {
+		return
+	}
+	aead, err := newGCM(objectKey(key, header[:c_OBJECT_SALT_SIZE]))
+	if err != nil {
+		return
+	}
+	r := &aeadEncryptReader{
+		text:  bufio.NewReader(plaintext),
+		aead:  aead,
+		nonce: newSegmentNonce(header[c_OBJECT_SALT_SIZE:]),
+		plain: make([]byte, c_SEGMENT_SIZE),
+	}
+	r.buf.WriteString(c_AEAD_MAGIC)
+	r.buf.Write(header)
+	return r, nil
+}
+
+// Authenticate and decrypt an envelope made by encryptStream, segment by segment as it's read.
+func decryptStream(key []byte, text *bufio.Reader) (plaintext io.Reader, err error) {
+	header := make([]byte, len(c_AEAD_MAGIC)+c_OBJECT_SALT_SIZE+c_NONCE_PREFIX_SIZE)
+	if _, err = io.ReadFull(text, header); err != nil {
+		return nil, ErrTruncated
+	}
+	if string(header[:len(c_AEAD_MAGIC)]) != c_AEAD_MAGIC {
+		return nil, ErrNotAuthentic
+	}
+	header = header[len(c_AEAD_MAGIC):]
+	aead, err := newGCM(objectKey(key, header[:c_OBJECT_SALT_SIZE]))
+	if err != nil {
+		return
+	}
+	return &aeadDecryptReader{
+		text:   text,
+		aead:   aead,
+		nonce:  newSegmentNonce(header[c_OBJECT_SALT_SIZE:]),
+		sealed: make([]byte, c_SEGMENT_SIZE+c_TAG_SIZE),
+	}, nil
+}
+
+// The key of a single ciphertext; HKDF-SHA256 of the key it's encrypted under, with its salt.
+func objectKey(key, salt []byte) []byte {
+	subkey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(c_OBJECT_KEY_CONTEXT)), subkey); err != nil {
+		panic(err) // only if we ask for more than 255 hashes' worth
+	}
+	return subkey
+}
+
+// AES-256-GCM with some 32-byte key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	bc, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(bc)
+}
+
+// Derive a key from the auth key, for some purpose named by the context.
+func deriveKey(authKey []byte, context string) []byte {
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write([]byte(context))
+	return mac.Sum(nil)
+}
+
+// -----------------------------------------------------------------------------
+
+// The nonce of a segment; (prefix||counter||last flag).
+type segmentNonce []byte
+
+func newSegmentNonce(prefix []byte) segmentNonce {
+	n := make(segmentNonce, c_NONCE_PREFIX_SIZE+5)
+	copy(n, prefix)
+	return n
+}
+
+func (n segmentNonce) next(last bool) ([]byte, error) {
+	counter := n[c_NONCE_PREFIX_SIZE : c_NONCE_PREFIX_SIZE+4]
+	if n[len(n)-1] != 0 {
+		return nil, errors.New("segment after the last")
+	}
+	if last {
+		n[len(n)-1] = 1
+	}
+	nonce := append([]byte(nil), n...)
+	c := binary.BigEndian.Uint32(counter) + 1
+	if c == 0 {
+		return nil, errors.New("too many segments")
+	}
+	binary.BigEndian.PutUint32(counter, c)
+	return nonce, nil
+}
+
+type aeadEncryptReader struct {
+	text  *bufio.Reader
+	aead  cipher.AEAD
+	nonce segmentNonce
+	plain []byte
+	buf   bytes.Buffer
+	fin   bool
+}
+
+// Implement io.Reader.
+func (e *aeadEncryptReader) Read(b []byte) (n int, err error) {
+	for e.buf.Len() == 0 {
+		if e.fin {
+			return 0, io.EOF
+		}
+		if err = e.seal(); err != nil {
+			return
+		}
+	}
+	return e.buf.Read(b)
+}
+
+// Encrypt the next segment. It's the last if there's no more plaintext after it.
+func (e *aeadEncryptReader) seal() error {
+	n, err := io.ReadFull(e.text, e.plain)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		e.fin = true
+	case nil:
+		if _, err = e.text.Peek(1); err == io.EOF {
+			e.fin = true
+		} else if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	nonce, err := e.nonce.next(e.fin)
+	if err != nil {
+		return err
+	}
+	e.buf.Write(e.aead.Seal(nil, nonce, e.plain[:n], nil))
+	return nil
+}
+
+type aeadDecryptReader struct {
+	text   *bufio.Reader
+	aead   cipher.AEAD
+	nonce  segmentNonce
+	sealed []byte
+	buf    []byte // plaintext of the current segment, not yet read
+	fin    bool
+}
+
+// Implement io.Reader.
+func (e *aeadDecryptReader) Read(b []byte) (n int, err error) {
+	for len(e.buf) == 0 {
+		if e.fin {
+			return 0, io.EOF
+		}
+		if err = e.open(); err != nil {
+			return
+		}
+	}
+	n = copy(b, e.buf)
+	e.buf = e.buf[n:]
+	return
+}
+
+// Authenticate and decrypt the next segment. It's the last if there's no more ciphertext after it.
+func (e *aeadDecryptReader) open() error {
+	n, err := io.ReadFull(e.text, e.sealed)
+	switch err {
+	case io.EOF:
+		return ErrTruncated // no more segments, but we haven't seen the last
+	case io.ErrUnexpectedEOF:
+		e.fin = true
+	case nil:
+		if _, err = e.text.Peek(1); err == io.EOF {
+			e.fin = true
+		} else if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	nonce, err := e.nonce.next(e.fin)
+	if err != nil {
+		return err
+	}
+	if e.buf, err = e.aead.Open(nil, nonce, e.sealed[:n], nil); err != nil {
+		// If what we took for the last segment is authentic as any other, the rest was cut off.
+		if e.fin && n == len(e.sealed) {
+			nonce[len(nonce)-1] = 0
+			if _, failed := e.aead.Open(nil, nonce, e.sealed[:n], nil); failed == nil {
+				return ErrTruncated
+			}
+		}
+		return ErrNotAuthentic
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package crypto
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func newTestAEADCrypter() Crypter {
+	salt, _ := Salt()
+	enc, _ := NewAEADCrypter(DeriveKeys([]byte("some password"), salt))
+	return enc
+}
+
+// Samples spanning a few segments, including exact multiples of the segment size.
+func segmentSamples() (list [][]byte) {
+	for _, n := range []int{c_SEGMENT_SIZE - 1, c_SEGMENT_SIZE, c_SEGMENT_SIZE + 1, 3 * c_SEGMENT_SIZE} {
+		list = append(list, bytes.Repeat([]byte{byte(n)}, n))
+	}
+	return append(list, samples...)
+}
+
+func TestAEADCrypto(t *testing.T) {
+	enc := newTestAEADCrypter()
+	for _, plaintext := range segmentSamples() {
+		ciphertext, err := enc.Encrypt(plaintext)
+		assert.NoError(t, err)
+		assert.Equal(t, c_AEAD_MAGIC, string(ciphertext[:len(c_AEAD_MAGIC)]))
+		decrypted, err := enc.Decrypt(ciphertext)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(plaintext, decrypted), "decrypted plaintext is the same")
+
+		e, _ := enc.EncryptReader(iotest.OneByteReader(bytes.NewReader(plaintext)))
+		d, _ := enc.DecryptReader(iotest.DataErrReader(e))
+		decrypted, err = ioutil.ReadAll(iotest.OneByteReader(d))
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(plaintext, decrypted), "decrypted plaintext is the same")
+	}
+}
+
+func TestAEADReadsCBCCiphertexts(t *testing.T) {
+	salt, _ := Salt()
+	keys := func() ([]byte, []byte) { return DeriveKeys([]byte("some password"), salt) }
+	cbc, _ := NewCrypter(keys())
+	aead, _ := NewAEADCrypter(keys())
+
+	for _, plaintext := range samples {
+		ciphertext, _ := cbc.Encrypt(plaintext)
+		decrypted, err := aead.Decrypt(ciphertext)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted, "decrypted plaintext is the same")
+		assert.Equal(t, cbc.Hash(plaintext), aead.Hash(plaintext), "hashes don't change")
+	}
+}
+
+func TestAEADCryptoErrors(t *testing.T) {
+	enc := newTestAEADCrypter()
+	plaintext := segmentSamples()[3] // three segments
+	ciphertext, _ := enc.Encrypt(plaintext)
+	header := len(c_AEAD_MAGIC) + c_OBJECT_SALT_SIZE + c_NONCE_PREFIX_SIZE
+	segment := c_SEGMENT_SIZE + 16
+
+	// Flip a bit in the second segment. The first is still released.
+	tampered := append([]byte{}, ciphertext...)
+	tampered[header+segment+10] ^= 1
+	d, _ := enc.DecryptReader(bytes.NewReader(tampered))
+	decrypted, err := ioutil.ReadAll(d)
+	assert.Equal(t, ErrNotAuthentic, err)
+	assert.Equal(t, plaintext[:c_SEGMENT_SIZE], decrypted)
+
+	// Cut off the last segment, or part of it.
+	_, err = enc.Decrypt(ciphertext[:header+2*segment])
+	assert.Equal(t, ErrTruncated, err)
+	_, err = enc.Decrypt(ciphertext[:len(ciphertext)-1])
+	assert.Equal(t, ErrNotAuthentic, err)
+	_, err = enc.Decrypt(ciphertext[:header])
+	assert.Equal(t, ErrTruncated, err)
+
+	// Swap the first two segments around.
+	swapped := append([]byte{}, ciphertext[:header]...)
+	swapped = append(swapped, ciphertext[header+segment:header+2*segment]...)
+	swapped = append(swapped, ciphertext[header:header+segment]...)
+	swapped = append(swapped, ciphertext[header+2*segment:]...)
+	_, err = enc.Decrypt(swapped)
+	assert.Equal(t, ErrNotAuthentic, err)
+
+	// Add some bytes on the end.
+	_, err = enc.Decrypt(append(append([]byte{}, ciphertext...), "abc"...))
+	assert.Equal(t, ErrNotAuthentic, err)
+}
+
+func TestAEADKeyPerCiphertext(t *testing.T) {
+	enc := newTestAEADCrypter()
+	key := enc.(*aeadCrypter).key
+	salt := func(ciphertext []byte) []byte {
+		return ciphertext[len(c_AEAD_MAGIC) : len(c_AEAD_MAGIC)+c_OBJECT_SALT_SIZE]
+	}
+
+	// The same plaintext, twice, is encrypted under two different keys.
+	plaintext := []byte("the same plaintext")
+	a, _ := enc.Encrypt(plaintext)
+	b, _ := enc.Encrypt(plaintext)
+	assert.NotEqual(t, salt(a), salt(b))
+	assert.NotEqual(t, objectKey(key, salt(a)), objectKey(key, salt(b)))
+	assert.Equal(t, objectKey(key, salt(a)), objectKey(key, salt(a)))
+	assert.NotEqual(t, key, objectKey(key, salt(a)))
+
+	// The salt is bound to the ciphertext; change it, and the key is wrong.
+	tampered := append([]byte{}, a...)
+	tampered[len(c_AEAD_MAGIC)] ^= 1
+	_, err := enc.Decrypt(tampered)
+	assert.Equal(t, ErrNotAuthentic, err)
+}
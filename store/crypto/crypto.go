@@ -7,6 +7,7 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"golang.org/x/crypto/pbkdf2"
 	"hash"
@@ -36,6 +37,23 @@ func DeriveKeys(secret, salt []byte) (encKey, authKey []byte) {
 	return key[:c_ENC_KEY_SIZE], key[c_ENC_KEY_SIZE:]
 }
 
+// Create new random encryption and auth keys, for keys which aren't derived from any secret.
+func RandomKeys() (encKey, authKey []byte, err error) {
+	key := make([]byte, c_ENC_KEY_SIZE+c_HMAC_KEY_SIZE)
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+	return SplitKeys(key)
+}
+
+// Split the encryption and auth keys, stored one after the other.
+func SplitKeys(key []byte) (encKey, authKey []byte, err error) {
+	if len(key) != c_ENC_KEY_SIZE+c_HMAC_KEY_SIZE {
+		return nil, nil, errors.New("invalid key length")
+	}
+	return key[:c_ENC_KEY_SIZE], key[c_ENC_KEY_SIZE:], nil
+}
+
 // -----------------------------------------------------------------------------
 
 // Pad a plaintext to the next whole block size. We use PKCS7-style padding.
@@ -73,6 +91,9 @@ type Crypter interface {
 	Decrypt(ciphertext []byte) (plaintext []byte, err error)
 	EncryptReader(plaintext io.Reader) (ciphertext io.Reader, err error)
 	DecryptReader(ciphertext io.Reader) (plaintext io.Reader, err error)
+	// Hash returns a keyed hash of some data, for naming objects by their
+	// contents without revealing anything about them.
+	Hash(data []byte) []byte
 }
 
 type aesCrypter struct {
@@ -115,6 +136,18 @@ func (e *aesCrypter) Decrypt(ciphertext []byte) ([]byte, error) {
 	return ioutil.ReadAll(r)
 }
 
+// Keyed hashes are prefixed with this, so they can never be mistaken for the
+// HMAC of some ciphertext.
+const c_HASH_CONTEXT = "inc.content-hash\x00"
+
+// Hash data with HMAC-SHA256, keyed by the auth key.
+func (e *aesCrypter) Hash(data []byte) []byte {
+	mac := hmac.New(sha256.New, e.authKey)
+	mac.Write([]byte(c_HASH_CONTEXT))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
 // -----------------------------------------------------------------------------
 
 type encryptReader struct {
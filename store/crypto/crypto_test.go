@@ -49,6 +49,18 @@ func TestCrypto(t *testing.T) {
 	}
 }
 
+func TestHash(t *testing.T) {
+	salt, _ := Salt()
+	enc, _ := NewCrypter(DeriveKeys([]byte("some password"), salt))
+	other, _ := NewCrypter(DeriveKeys([]byte("another password"), salt))
+
+	for _, plaintext := range samples[2:] {
+		assert.Equal(t, enc.Hash(plaintext), enc.Hash(plaintext), "hashes are the same")
+		assert.NotEqual(t, enc.Hash(plaintext), other.Hash(plaintext), "hashes are keyed")
+		assert.NotEqual(t, enc.Hash(plaintext), enc.Hash(samples[1]), "hashes differ by data")
+	}
+}
+
 func TestCryptoReaders(t *testing.T) {
 	salt, _ := Salt()
 	pass := []byte("some password")
@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Error when a KDF is unknown, or its parameters are out of range.
+var ErrBadKDF = errors.New("unknown or invalid key derivation function")
+
+const (
+	KDF_PBKDF2   = "pbkdf2-sha1"
+	KDF_ARGON2ID = "argon2id"
+)
+
+// Salts for the memory-hard KDFs are longer than the older PBKDF2 ones.
+const c_KDF_SALT_SIZE = 16
+
+// The most memory (in KiB) we'll agree to spend deriving keys. Parameters are read from the store, so they shouldn't
+// be able to exhaust our memory.
+const c_KDF_MAX_MEMORY = 4 << 20
+
+// KDF names a key derivation function and its cost parameters, for deriving keys from a password.
+type KDF struct {
+	Algorithm string `json:"algorithm"`
+	Time      uint32 `json:"time"`              // iterations (PBKDF2) or passes over memory (Argon2id)
+	Memory    uint32 `json:"memory,omitempty"`  // in KiB (Argon2id)
+	Threads   uint8  `json:"threads,omitempty"` // (Argon2id)
+}
+
+// The KDF of stores made before the KDF was recorded; PBKDF2-SHA1 with 4096 iterations (see DeriveKeys).
+var LegacyKDF = KDF{Algorithm: KDF_PBKDF2, Time: c_HASH_ITER}
+
+// The KDF for new passwords; Argon2id, with the parameters recommended by RFC 9106 for memory-constrained
+// environments (3 passes over 64MiB, in 4 lanes).
+var DefaultKDF = KDF{Algorithm: KDF_ARGON2ID, Time: 3, Memory: 64 << 10, Threads: 4}
+
+func (k KDF) String() string {
+	switch k.Algorithm {
+	case KDF_ARGON2ID:
+		return fmt.Sprintf("%s (t=%d, m=%dKiB, p=%d)", k.Algorithm, k.Time, k.Memory, k.Threads)
+	default:
+		return fmt.Sprintf("%s (%d iterations)", k.Algorithm, k.Time)
+	}
+}
+
+// Validate returns ErrBadKDF if the KDF is unknown, or its parameters are out of range.
+func (k KDF) Validate() error {
+	switch k.Algorithm {
+	case KDF_PBKDF2:
+		if k.Time >= 1 {
+			return nil
+		}
+	case KDF_ARGON2ID:
+		if k.Time >= 1 && k.Threads >= 1 && k.Memory >= 8*uint32(k.Threads) && k.Memory <= c_KDF_MAX_MEMORY {
+			return nil
+		}
+	}
+	return ErrBadKDF
+}
+
+// Salt creates a new salt of the right size for the KDF.
+func (k KDF) Salt() ([]byte, error) {
+	if k.Algorithm == KDF_PBKDF2 {
+		return Salt()
+	}
+	buf := make([]byte, c_KDF_SALT_SIZE)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// DeriveKeys derives encryption and auth keys from a secret and salt, like the package DeriveKeys, but with the KDF.
+func (k KDF) DeriveKeys(secret, salt []byte) (encKey, authKey []byte, err error) {
+	if err = k.Validate(); err != nil {
+		return
+	}
+	var key []byte
+	switch k.Algorithm {
+	case KDF_PBKDF2:
+		key = pbkdf2.Key(secret, salt, int(k.Time), c_ENC_KEY_SIZE+c_HMAC_KEY_SIZE, sha1.New)
+	case KDF_ARGON2ID:
+		key = argon2.IDKey(secret, salt, k.Time, k.Memory, k.Threads, c_ENC_KEY_SIZE+c_HMAC_KEY_SIZE)
+	}
+	return SplitKeys(key)
+}
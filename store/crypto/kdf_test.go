@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestKDF(t *testing.T) {
+	pass := []byte("some password")
+	salt, err := DefaultKDF.Salt()
+	assert.NoError(t, err)
+	assert.Len(t, salt, 16)
+
+	// PBKDF2 derives the same keys as DeriveKeys.
+	legacySalt, err := LegacyKDF.Salt()
+	assert.NoError(t, err)
+	assert.Len(t, legacySalt, 8)
+	encKey, authKey := DeriveKeys(pass, legacySalt)
+	gotEnc, gotAuth, err := LegacyKDF.DeriveKeys(pass, legacySalt)
+	assert.NoError(t, err)
+	assert.Equal(t, encKey, gotEnc)
+	assert.Equal(t, authKey, gotAuth)
+
+	// Argon2id keys depend on the password, salt and parameters.
+	kdf := KDF{Algorithm: KDF_ARGON2ID, Time: 1, Memory: 64, Threads: 1}
+	encKey, authKey, err = kdf.DeriveKeys(pass, salt)
+	assert.NoError(t, err)
+	assert.Len(t, encKey, c_ENC_KEY_SIZE)
+	assert.Len(t, authKey, c_HMAC_KEY_SIZE)
+	again, _, _ := kdf.DeriveKeys(pass, salt)
+	assert.Equal(t, encKey, again)
+	other, _, _ := kdf.DeriveKeys([]byte("other password"), salt)
+	assert.NotEqual(t, encKey, other)
+	kdf.Time = 2
+	other, _, _ = kdf.DeriveKeys(pass, salt)
+	assert.NotEqual(t, encKey, other)
+	_, err = NewCrypter(encKey, authKey)
+	assert.NoError(t, err)
+}
+
+func TestBadKDF(t *testing.T) {
+	for _, kdf := range []KDF{
+		{},
+		{Algorithm: "md5", Time: 1},
+		{Algorithm: KDF_PBKDF2},
+		{Algorithm: KDF_ARGON2ID, Time: 1, Memory: 64},
+		{Algorithm: KDF_ARGON2ID, Time: 1, Memory: 4, Threads: 1},
+		{Algorithm: KDF_ARGON2ID, Time: 1, Memory: 1 << 30, Threads: 1},
+	} {
+		_, _, err := kdf.DeriveKeys([]byte("pass"), []byte("salt"))
+		assert.Equal(t, ErrBadKDF, err, kdf.String())
+	}
+	assert.NoError(t, DefaultKDF.Validate())
+	assert.NoError(t, LegacyKDF.Validate())
+}
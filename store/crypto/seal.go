@@ -0,0 +1,219 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// Error when decrypting without the private key; with write-only keys, or a ciphertext we can't otherwise read.
+var ErrWriteOnly = errors.New("can't decrypt with write-only keys")
+
+// Sealed ciphertexts start with this, followed by the ephemeral public key and the wrapped data key.
+const c_SEALED_MAGIC = "inc\x00x25\x01"
+
+const c_X25519_KEY_SIZE = 32
+const c_DATA_KEY_SIZE = 32
+const c_WRAPPED_KEY_SIZE = c_DATA_KEY_SIZE + c_TAG_SIZE
+
+// Contexts for deriving the key pair and the hash key from the auth key, and the key wrapping key from a shared secret.
+const c_IDENTITY_CONTEXT = "inc.x25519-key\x00"
+const c_HASH_KEY_CONTEXT = "inc.hash-key\x00"
+const c_WRAP_KEY_CONTEXT = "inc.x25519-wrap\x00"
+
+// Contexts for deriving the metadata keys from the hash key, and for MACs made with them.
+const c_METADATA_ENC_CONTEXT = "inc.metadata-enc\x00"
+const c_METADATA_AUTH_CONTEXT = "inc.metadata-auth\x00"
+const c_MAC_CONTEXT = "inc.mac\x00"
+
+// Contexts for deriving the key of the key check, and the key for the MAC of the key slots, from the auth key.
+const c_KEY_CHECK_CONTEXT = "inc.key-check\x00"
+const c_KEY_SLOTS_CONTEXT = "inc.metadata-keys\x00"
+
+type sealCrypter struct {
+	enc       Crypter          // for our own (symmetric) ciphertexts; nil with write-only keys
+	identity  *ecdh.PrivateKey // nil with write-only keys
+	recipient *ecdh.PublicKey
+	hashKey   []byte
+}
+
+// WriteOnlyKeys derives the public key that ciphertexts are sealed to, and the key for keyed hashes, from the auth key.
+// Together they're enough to encrypt data and name it by its contents, but not to decrypt anything.
+func WriteOnlyKeys(authKey []byte) (publicKey, hashKey []byte, err error) {
+	identity, err := ecdh.X25519().NewPrivateKey(deriveKey(authKey, c_IDENTITY_CONTEXT))
+	if err != nil {
+		return
+	}
+	return identity.PublicKey().Bytes(), deriveKey(authKey, c_HASH_KEY_CONTEXT), nil
+}
+
+// MetadataKeys derives keys for encrypting and authenticating the store metadata from the hash key, so that hosts
+// with the write-only keys can update the metadata too. Returns a 32-byte encryption key and 64-byte auth key.
+func MetadataKeys(hashKey []byte) (encKey, authKey []byte) {
+	mac := hmac.New(sha512.New, hashKey)
+	mac.Write([]byte(c_METADATA_AUTH_CONTEXT))
+	return deriveKey(hashKey, c_METADATA_ENC_CONTEXT), mac.Sum(nil)
+}
+
+// MAC returns an HMAC-SHA256 of data kept in the clear, keyed by the auth key, to tell if it's been changed.
+func MAC(authKey, data []byte) []byte {
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write([]byte(c_MAC_CONTEXT))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// KeySlotsKey derives the key for the MAC of the store's key slots (and the other fields which say how to open the
+// store) from the auth key. Unlike the metadata keys, hosts with only the write-only keys don't have it.
+func KeySlotsKey(authKey []byte) []byte {
+	return deriveKey(authKey, c_KEY_SLOTS_CONTEXT)
+}
+
+// KeyCheck returns a MAC of the encryption key, keyed by a key derived from the auth key, to tell if a pair of keys
+// are the ones a store was made with. It gives nothing away about either key.
+func KeyCheck(encKey, authKey []byte) []byte {
+	return MAC(deriveKey(authKey, c_KEY_CHECK_CONTEXT), encKey)
+}
+
+// Encrypt and decrypt like NewAEADCrypter, but also decrypt ciphertexts sealed to an X25519 public key (derived from
+// the auth key) by a crypter with only the write-only keys (see NewWriteOnlyCrypter). Keyed hashes use a hash key
+// derived from the auth key, so they're the same with either.
+func NewKeyPairCrypter(encKey, authKey []byte) (Crypter, error) {
+	enc, err := NewAEADCrypter(encKey, authKey)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := ecdh.X25519().NewPrivateKey(deriveKey(authKey, c_IDENTITY_CONTEXT))
+	if err != nil {
+		return nil, err
+	}
+	return &sealCrypter{enc, identity, identity.PublicKey(), deriveKey(authKey, c_HASH_KEY_CONTEXT)}, nil
+}
+
+// Encrypt by sealing each plaintext to an X25519 public key, like age (https://age-encryption.org). Each ciphertext
+// gets a random data key, which is wrapped with a key agreed between a new ephemeral key pair and the recipient's
+// public key. Only the recipient's private key can unwrap it; this crypter can't decrypt anything it encrypts.
+//
+// Our encryption envelope consists of (magic||ephemeral public key||wrapped data key||AEAD envelope), where the AEAD
+// envelope is that of NewAEADCrypter, encrypted with the data key.
+func NewWriteOnlyCrypter(publicKey, hashKey []byte) (Crypter, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(hashKey) != sha256.Size {
+		return nil, errors.New("invalid hash key length")
+	}
+	return &sealCrypter{recipient: recipient, hashKey: hashKey}, nil
+}
+
+// Encrypt (or seal) plaintext.
+func (e *sealCrypter) Encrypt(plaintext []byte) ([]byte, error) {
+	r, err := e.EncryptReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Authenticate and decrypt ciphertext.
+func (e *sealCrypter) Decrypt(ciphertext []byte) ([]byte, error) {
+	r, err := e.DecryptReader(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// Encrypt with our own keys if we have them, otherwise seal the plaintext to the recipient.
+func (e *sealCrypter) EncryptReader(plaintext io.Reader) (ciphertext io.Reader, err error) {
+	if e.enc != nil {
+		return e.enc.EncryptReader(plaintext)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	shared, err := ephemeral.ECDH(e.recipient)
+	if err != nil {
+		return
+	}
+	wrap, err := newGCM(wrapKey(shared, ephemeral.PublicKey(), e.recipient))
+	if err != nil {
+		return
+	}
+	dataKey := make([]byte, c_DATA_KEY_SIZE)
+	if _, err = rand.Read(dataKey); err != nil {
+		return
+	}
+	body, err := encryptStream(dataKey, plaintext)
+	if err != nil {
+		return
+	}
+	var header bytes.Buffer
+	header.WriteString(c_SEALED_MAGIC)
+	header.Write(ephemeral.PublicKey().Bytes())
+	header.Write(wrap.Seal(nil, make([]byte, wrap.NonceSize()), dataKey, nil)) // the wrap key is never used again
+	return io.MultiReader(&header, body), nil
+}
+
+// Decrypt a sealed ciphertext with our private key, or any other with our own keys.
+func (e *sealCrypter) DecryptReader(ciphertext io.Reader) (plaintext io.Reader, err error) {
+	text := bufio.NewReaderSize(ciphertext, c_SEGMENT_SIZE+c_TAG_SIZE)
+	magic, err := text.Peek(len(c_SEALED_MAGIC))
+	if err != nil || string(magic) != c_SEALED_MAGIC {
+		if e.enc == nil {
+			return nil, ErrWriteOnly
+		}
+		return e.enc.DecryptReader(text)
+	}
+	if e.identity == nil {
+		return nil, ErrWriteOnly
+	}
+	header := make([]byte, len(c_SEALED_MAGIC)+c_X25519_KEY_SIZE+c_WRAPPED_KEY_SIZE)
+	if _, err = io.ReadFull(text, header); err != nil {
+		return nil, ErrTruncated
+	}
+	header = header[len(c_SEALED_MAGIC):]
+	ephemeral, err := ecdh.X25519().NewPublicKey(header[:c_X25519_KEY_SIZE])
+	if err != nil {
+		return nil, ErrNotAuthentic
+	}
+	shared, err := e.identity.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrNotAuthentic
+	}
+	wrap, err := newGCM(wrapKey(shared, ephemeral, e.recipient))
+	if err != nil {
+		return
+	}
+	dataKey, err := wrap.Open(nil, make([]byte, wrap.NonceSize()), header[c_X25519_KEY_SIZE:], nil)
+	if err != nil {
+		return nil, ErrNotAuthentic
+	}
+	return decryptStream(dataKey, text)
+}
+
+// Hash data with HMAC-SHA256, keyed by the hash key.
+func (e *sealCrypter) Hash(data []byte) []byte {
+	mac := hmac.New(sha256.New, e.hashKey)
+	mac.Write([]byte(c_HASH_CONTEXT))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// The key wrapping the data key; bound to both public keys, as well as the shared secret.
+func wrapKey(shared []byte, ephemeral, recipient *ecdh.PublicKey) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte(c_WRAP_KEY_CONTEXT))
+	mac.Write(ephemeral.Bytes())
+	mac.Write(recipient.Bytes())
+	return mac.Sum(nil)
+}
@@ -0,0 +1,63 @@
+package crypto
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTestKeyPairCrypters() (full, writeOnly Crypter) {
+	salt, _ := Salt()
+	encKey, authKey := DeriveKeys([]byte("some password"), salt)
+	full, _ = NewKeyPairCrypter(encKey, authKey)
+	publicKey, hashKey, _ := WriteOnlyKeys(authKey)
+	writeOnly, _ = NewWriteOnlyCrypter(publicKey, hashKey)
+	return
+}
+
+func TestSealedCrypto(t *testing.T) {
+	full, writeOnly := newTestKeyPairCrypters()
+	for _, plaintext := range segmentSamples() {
+		sealed, err := writeOnly.Encrypt(plaintext)
+		assert.NoError(t, err)
+		assert.Equal(t, c_SEALED_MAGIC, string(sealed[:len(c_SEALED_MAGIC)]))
+		decrypted, err := full.Decrypt(sealed)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(plaintext, decrypted), "decrypted plaintext is the same")
+
+		// The write-only keys can't decrypt anything; their own ciphertexts or any other.
+		_, err = writeOnly.Decrypt(sealed)
+		assert.Equal(t, ErrWriteOnly, err)
+		ciphertext, _ := full.Encrypt(plaintext)
+		_, err = writeOnly.Decrypt(ciphertext)
+		assert.Equal(t, ErrWriteOnly, err)
+		decrypted, err = full.Decrypt(ciphertext)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(plaintext, decrypted), "decrypted plaintext is the same")
+
+		assert.Equal(t, full.Hash(plaintext), writeOnly.Hash(plaintext), "hashes are the same")
+	}
+}
+
+func TestSealedCryptoErrors(t *testing.T) {
+	full, writeOnly := newTestKeyPairCrypters()
+	other, _ := newTestKeyPairCrypters()
+	sealed, _ := writeOnly.Encrypt([]byte("exampleplaintext"))
+
+	// Sealed to some other key pair.
+	_, err := other.Decrypt(sealed)
+	assert.Equal(t, ErrNotAuthentic, err)
+
+	// Tamper with the ephemeral key, the wrapped key, or the data.
+	for _, i := range []int{len(c_SEALED_MAGIC) + 1, len(c_SEALED_MAGIC) + c_X25519_KEY_SIZE + 1, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 1
+		_, err = full.Decrypt(tampered)
+		assert.Equal(t, ErrNotAuthentic, err)
+	}
+	_, err = full.Decrypt(sealed[:len(c_SEALED_MAGIC)+10])
+	assert.Equal(t, ErrTruncated, err)
+
+	_, err = NewWriteOnlyCrypter([]byte("short"), make([]byte, 32))
+	assert.Error(t, err)
+}
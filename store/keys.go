@@ -0,0 +1,248 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/aviddiviner/inc/store/crypto"
+	"log"
+	"time"
+)
+
+// Error when there's no key slot with the ID given.
+var ErrKeySlotNotFound = errors.New("key slot not found")
+
+// Error when attempting to remove the only key slot, which would leave the store unreadable.
+var ErrLastKeySlot = errors.New("can't remove the last key slot")
+
+// The ID of the key slot listed for stores made before key slots, whose keys are derived from the password directly.
+const c_LEGACY_SLOT = "legacy"
+
+// KeySlot holds a copy of the store's master keys, encrypted with keys derived from some password. A store can have
+// many key slots, say one for each person using it, so passwords can be added, changed and removed without having to
+// re-encrypt any of the data stored with the master keys.
+type KeySlot struct {
+	ID      string      `json:"id"`
+	Label   string      `json:"label,omitempty"`
+	Created time.Time   `json:"created"`
+	Salt    []byte      `json:"salt"`          // base64 encoded
+	KDF     *crypto.KDF `json:"kdf,omitempty"` // PBKDF2 (crypto.LegacyKDF) if not set
+	Keys    []byte      `json:"keys"`          // encrypted master keys, base64 encoded
+}
+
+func newKeySlotID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Make a key slot holding the master keys, opened by some password (with keys derived by the KDF given).
+func newKeySlot(label string, secret []byte, keys Keys, kdf crypto.KDF) (slot KeySlot, err error) {
+	if slot.ID, err = newKeySlotID(); err != nil {
+		return
+	}
+	if slot.Salt, err = kdf.Salt(); err != nil {
+		return
+	}
+	if kdf != crypto.LegacyKDF {
+		slot.KDF = &kdf
+	}
+	enc, err := slot.crypter(secret)
+	if err != nil {
+		return
+	}
+	slot.Keys, err = enc.Encrypt(append(append([]byte{}, keys.EncKey...), keys.AuthKey...))
+	slot.Label = label
+	slot.Created = time.Now().UTC().Truncate(time.Second)
+	return
+}
+
+// The KDF the key slot's keys are derived with.
+func (k KeySlot) kdf() crypto.KDF {
+	if k.KDF != nil {
+		return *k.KDF
+	}
+	return crypto.LegacyKDF
+}
+
+// The crypter for the master keys, with keys derived from a password.
+func (k KeySlot) crypter(secret []byte) (crypto.Crypter, error) {
+	encKey, authKey, err := k.kdf().DeriveKeys(secret, k.Salt)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.NewCrypter(encKey, authKey)
+}
+
+// Open the key slot with a password, returning the master keys.
+func (k KeySlot) open(secret []byte) (keys Keys, err error) {
+	enc, err := k.crypter(secret)
+	if err != nil {
+		return
+	}
+	data, err := enc.Decrypt(k.Keys)
+	if err != nil {
+		err = ErrWrongKey
+		return
+	}
+	if keys.EncKey, keys.AuthKey, err = crypto.SplitKeys(data); err != nil {
+		err = ErrMalformedMetadata
+	}
+	return
+}
+
+// Find the master keys opened by a password, and the key slot which opened them. Stores made before key slots derive
+// their keys from the password directly; this is only allowed for as long as their salt is kept.
+func (md storeMetadata) openKeys(secret []byte) (keys Keys, slot int, err error) {
+	for i, k := range md.KeySlots {
+		if keys, err = k.open(secret); err == nil {
+			return keys, i, nil
+		}
+	}
+	if md.Salt != nil {
+		keys.EncKey, keys.AuthKey = crypto.DeriveKeys(secret, md.Salt)
+		return keys, -1, nil
+	}
+	return Keys{}, -1, ErrWrongKey
+}
+
+// Equal returns true if both keys are the same.
+func (k Keys) Equal(o Keys) bool {
+	return bytes.Equal(k.EncKey, o.EncKey) && bytes.Equal(k.AuthKey, o.AuthKey)
+}
+
+// -----------------------------------------------------------------------------
+
+// KeySlots returns the store's key slots (without their keys), each with the KDF it uses. The password of a store made before key slots is listed as the "legacy" slot,
+// until it's removed or changed.
+func (s *Store) KeySlots() (slots []KeySlot, err error) {
+	md, err := s.getStoreMetadata()
+	if err != nil {
+		return
+	}
+	if md.Salt != nil {
+		kdf := crypto.LegacyKDF
+		slots = append(slots, KeySlot{ID: c_LEGACY_SLOT, Label: "(original password)", KDF: &kdf})
+	}
+	for _, k := range md.KeySlots {
+		kdf := k.kdf()
+		slots = append(slots, KeySlot{ID: k.ID, Label: k.Label, Created: k.Created, KDF: &kdf})
+	}
+	return
+}
+
+// AddKeySlot adds a key slot to the (open) store, so that it can be unlocked with another password.
+func (s *Store) AddKeySlot(label string, secret []byte) (slot KeySlot, err error) {
+	if !s.isConnected() {
+		err = ErrStoreNotConnected
+		return
+	}
+	if s.writeOnly {
+		err = ErrWriteOnly
+		return
+	}
+	md, err := s.getStoreMetadata()
+	if err != nil {
+		return
+	}
+	if slot, err = newKeySlot(label, secret, s.keys, md.kdf()); err != nil {
+		return
+	}
+	md.KeySlots = append(append([]KeySlot(nil), md.KeySlots...), slot)
+	err = s.putStoreMetadata(md)
+	return
+}
+
+// RemoveKeySlot removes a key slot from the store, so its password can't unlock the store anymore.
+func (s *Store) RemoveKeySlot(id string) (err error) {
+	md, err := s.getStoreMetadata()
+	if err != nil {
+		return
+	}
+	var slots []KeySlot
+	for _, k := range md.KeySlots {
+		if k.ID != id {
+			slots = append(slots, k)
+		}
+	}
+	switch {
+	case id == c_LEGACY_SLOT && md.Salt != nil:
+		md.Salt = nil
+	case len(slots) == len(md.KeySlots):
+		return ErrKeySlotNotFound
+	}
+	if len(slots) == 0 && md.Salt == nil {
+		return ErrLastKeySlot
+	}
+	md.KeySlots = slots
+	return s.putStoreMetadata(md)
+}
+
+// ChangePassword replaces the key slot opened by an old password with one opened by a new password.
+//
+// Stores made before key slots derive their master keys from the original password. Changing it stops inc from
+// accepting it, but anyone who knows it (and the salt) can still derive the keys; only a new store is safe from that.
+func (s *Store) ChangePassword(oldSecret, newSecret []byte) (slot KeySlot, err error) {
+	md, err := s.getStoreMetadata()
+	if err != nil {
+		return
+	}
+	return s.replaceKeySlot(md, oldSecret, newSecret)
+}
+
+// UpgradeKDF moves the store onto the default KDF (see crypto.DefaultKDF); new key slots will use it, and the key slot
+// opened by the password is replaced by one using it. The other key slots keep their KDF, until they're upgraded with
+// their own passwords.
+func (s *Store) UpgradeKDF(secret []byte) (slot KeySlot, err error) {
+	md, err := s.getStoreMetadata()
+	if err != nil {
+		return
+	}
+	kdf := crypto.DefaultKDF
+	md.KDF = &kdf
+	return s.replaceKeySlot(md, secret, secret)
+}
+
+// Replace the key slot opened by an old password with a new one, using the store's KDF.
+func (s *Store) replaceKeySlot(md storeMetadata, oldSecret, newSecret []byte) (slot KeySlot, err error) {
+	if !s.isConnected() {
+		err = ErrStoreNotConnected
+		return
+	}
+	if s.writeOnly {
+		err = ErrWriteOnly
+		return
+	}
+	keys, i, err := md.openKeys(oldSecret)
+	if err != nil {
+		return
+	}
+	if !keys.Equal(s.keys) {
+		err = ErrWrongKey
+		return
+	}
+	label := ""
+	if i >= 0 {
+		label = md.KeySlots[i].Label
+	} else {
+		log.Println("store: warning: the master keys of this store were derived from its original password, so anyone who knows it can still read the store")
+	}
+	if slot, err = newKeySlot(label, newSecret, s.keys, md.kdf()); err != nil {
+		return
+	}
+	var slots []KeySlot
+	for j, k := range md.KeySlots {
+		if j != i {
+			slots = append(slots, k)
+		}
+	}
+	if i < 0 {
+		md.Salt = nil
+	}
+	md.KeySlots = append(slots, slot)
+	err = s.putStoreMetadata(md)
+	return
+}
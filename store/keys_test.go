@@ -0,0 +1,124 @@
+package store
+
+import (
+	"github.com/aviddiviner/inc/store/crypto"
+	"github.com/aviddiviner/inc/store/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestKeySlots(t *testing.T) {
+	layer := storage.NewMockStorage()
+	store := NewStore(layer, "test")
+	keys, err := store.Wipe(testSecret)
+	assert.NoError(t, err)
+	useStoreRW(t, store)
+
+	// A second password opens the same master keys.
+	slot, err := store.AddKeySlot("alice", []byte("alice's password"))
+	assert.NoError(t, err)
+	other := NewStore(layer, "test")
+	got, err := other.Unlock([]byte("alice's password"))
+	assert.NoError(t, err)
+	assert.True(t, keys.Equal(got))
+	_, err = NewStore(layer, "test").Unlock([]byte("wrong password"))
+	assert.Equal(t, ErrWrongKey, err)
+
+	// Change the first password; the old one doesn't work anymore.
+	_, err = store.ChangePassword([]byte("wrong password"), []byte("new password"))
+	assert.Equal(t, ErrWrongKey, err)
+	_, err = store.ChangePassword(testSecret, []byte("new password"))
+	assert.NoError(t, err)
+	_, err = NewStore(layer, "test").Unlock(testSecret)
+	assert.Equal(t, ErrWrongKey, err)
+	got, err = NewStore(layer, "test").Unlock([]byte("new password"))
+	assert.NoError(t, err)
+	assert.True(t, keys.Equal(got))
+
+	slots, err := store.KeySlots()
+	assert.NoError(t, err)
+	assert.Len(t, slots, 2)
+	assert.Equal(t, "alice", slots[0].Label)
+	assert.Empty(t, slots[0].Keys)
+
+	// Remove slots, but never the last.
+	assert.Equal(t, ErrKeySlotNotFound, store.RemoveKeySlot("nope"))
+	assert.NoError(t, store.RemoveKeySlot(slot.ID))
+	_, err = NewStore(layer, "test").Unlock([]byte("alice's password"))
+	assert.Equal(t, ErrWrongKey, err)
+	assert.Equal(t, ErrLastKeySlot, store.RemoveKeySlot(slots[1].ID))
+}
+
+func TestKeySlotsOfLegacyStore(t *testing.T) {
+	layer := storage.NewMockStorage()
+	putLegacyStore(t, layer)
+	store := legacyStore(layer)
+	keys, err := store.Unlock(testSecret)
+	assert.NoError(t, err)
+	assert.True(t, keys.Equal(testCryptoKeys))
+	useStoreRW(t, store)
+
+	// The original password still works alongside the new slots, until it's changed.
+	_, err = store.AddKeySlot("", []byte("another password"))
+	assert.NoError(t, err)
+	slots, err := store.KeySlots()
+	assert.NoError(t, err)
+	assert.Equal(t, c_LEGACY_SLOT, slots[0].ID)
+	assert.Len(t, slots, 2)
+	got, err := NewStore(layer, "test").Unlock(testSecret)
+	assert.NoError(t, err)
+	assert.True(t, keys.Equal(got))
+
+	_, err = store.ChangePassword(testSecret, []byte("new password"))
+	assert.NoError(t, err)
+	slots, err = store.KeySlots()
+	assert.NoError(t, err)
+	assert.Len(t, slots, 2)
+	assert.NotEqual(t, c_LEGACY_SLOT, slots[0].ID)
+	_, err = NewStore(layer, "test").Unlock(testSecret)
+	assert.Equal(t, ErrWrongKey, err)
+	got, err = NewStore(layer, "test").Unlock([]byte("new password"))
+	assert.NoError(t, err)
+	assert.True(t, keys.Equal(got))
+}
+
+func TestUpgradeKDF(t *testing.T) {
+	layer := storage.NewMockStorage()
+	putLegacyStore(t, layer)
+	store := legacyStore(layer)
+	keys, err := store.Unlock(testSecret)
+	assert.NoError(t, err)
+	useStoreRW(t, store)
+
+	// Slots added before the upgrade use PBKDF2, like the store's original password.
+	_, err = store.AddKeySlot("alice", []byte("alice's password"))
+	assert.NoError(t, err)
+	md, err := store.getStoreMetadata()
+	assert.NoError(t, err)
+	assert.Equal(t, crypto.LegacyKDF, md.kdf())
+
+	slot, err := store.UpgradeKDF(testSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, crypto.DefaultKDF, *slot.KDF)
+	assert.Len(t, slot.Salt, 16)
+	md, err = store.getStoreMetadata()
+	assert.NoError(t, err)
+	assert.Nil(t, md.Salt)
+	assert.Equal(t, crypto.DefaultKDF, md.kdf())
+
+	// Both passwords still open the same keys, but only the upgraded one uses Argon2id.
+	for _, secret := range []string{string(testSecret), "alice's password"} {
+		got, err := NewStore(layer, "test").Unlock([]byte(secret))
+		assert.NoError(t, err)
+		assert.True(t, keys.Equal(got))
+	}
+	slots, err := store.KeySlots()
+	assert.NoError(t, err)
+	assert.Equal(t, crypto.KDF_PBKDF2, slots[0].KDF.Algorithm)
+	assert.Equal(t, crypto.KDF_ARGON2ID, slots[1].KDF.Algorithm)
+
+	// New slots use Argon2id from now on.
+	slot, err = store.AddKeySlot("bob", []byte("bob's password"))
+	assert.NoError(t, err)
+	assert.Equal(t, crypto.DefaultKDF, *slot.KDF)
+}
@@ -0,0 +1,288 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Error when a lock object in the store can't be read.
+var ErrMalformedLock = errors.New("malformed lock")
+
+const c_LOCK_PREFIX = "locks/"
+
+// How long a lock is held for, unless it's refreshed. Running commands refresh
+// their locks well before then, so only the locks of crashed ones expire.
+const c_LOCK_TTL = 30 * time.Minute
+const c_LOCK_REFRESH = 5 * time.Minute
+
+// Lock is held in the store by a running command, so that others don't change the store under it. Commands which
+// change the store (like backup and prune) take an exclusive lock; those which only read from it take a shared lock.
+type Lock struct {
+	ID        string    `json:"-"`
+	Owner     string    `json:"owner"`
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Exclusive bool      `json:"exclusive"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+
+	s    *Store
+	stop chan struct{}
+	done chan struct{}
+}
+
+// LockedError is returned when the store is locked by some other command.
+type LockedError struct {
+	Lock Lock // the conflicting lock
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("store is locked by %s (run `inc unlock` if that's no longer running)", e.Lock)
+}
+
+func (l Lock) String() string {
+	mode := "shared"
+	if l.Exclusive {
+		mode = "exclusive"
+	}
+	return fmt.Sprintf("%s@%s (pid %d, %s lock, since %s)", l.Owner, l.Host, l.PID, mode, l.Created.Local().Format("2006-01-02 15:04:05"))
+}
+
+// IsStale returns true if the lock has expired, or the process holding it (on this host) is gone.
+func (l Lock) IsStale(now time.Time) bool {
+	if now.After(l.Expires) {
+		return true
+	}
+	if host, err := os.Hostname(); err == nil && host == l.Host {
+		return !processExists(l.PID)
+	}
+	return false
+}
+
+// Does a lock stop us from taking another? Exclusive locks can't be shared.
+func (l Lock) conflicts(exclusive bool) bool {
+	return l.Exclusive || exclusive
+}
+
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+func newLockID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// -----------------------------------------------------------------------------
+
+// Lock takes a lock on the store, which is held until Unlock is called. Stale locks left by crashed commands are
+// removed first. Returns a LockedError if the store is already locked by some other command.
+func (s *Store) Lock(exclusive bool) (l *Lock, err error) {
+	if err = s.breakStaleLocks(exclusive); err != nil {
+		return
+	}
+	id, err := newLockID()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	l = &Lock{ID: id, PID: os.Getpid(), Exclusive: exclusive, Created: now, s: s}
+	l.Host, _ = os.Hostname()
+	if u, e := user.Current(); e == nil {
+		l.Owner = u.Username
+	} else {
+		l.Owner = os.Getenv("USER")
+	}
+	if err = l.put(now); err != nil {
+		return nil, err
+	}
+
+	// Someone else might have taken a lock at the same time. If so, back off.
+	locks, err := s.ListLocks()
+	if err == nil {
+		for _, other := range locks {
+			if other.ID != l.ID && other.conflicts(exclusive) && !other.IsStale(time.Now()) {
+				err = &LockedError{other}
+				break
+			}
+		}
+	}
+	// Other commands may have changed the metadata since we read it; read it again now that they can't, so that we
+	// don't write back what we had before.
+	if err == nil {
+		err = s.reloadMetadata()
+	}
+	if err != nil {
+		s.removeLock(l.ID)
+		return nil, err
+	}
+
+	l.stop, l.done = make(chan struct{}), make(chan struct{})
+	go l.refresh()
+	return l, nil
+}
+
+// Write (or rewrite) the lock to the store, expiring some time from now.
+func (l *Lock) put(now time.Time) error {
+	l.Expires = now.Add(c_LOCK_TTL)
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if l.s.plainLocks() {
+		_, err = l.s.layer.PutReader(c_LOCK_PREFIX+l.ID, bytes.NewReader(data))
+	} else {
+		_, err = l.s.Put(c_LOCK_PREFIX+l.ID, data)
+	}
+	return err
+}
+
+// Locks hold nothing secret, so since store format 3 they're written unencrypted; hosts with write-only keys must be
+// able to read each other's. (Older versions of inc, which encrypt them, can't open these stores.)
+func (s *Store) plainLocks() bool {
+	md, err := s.getStoreMetadata()
+	return err == nil && md.StoreFormat >= 3
+}
+
+// Keep the lock from expiring, until it's released.
+func (l *Lock) refresh() {
+	defer close(l.done)
+	ticker := time.NewTicker(c_LOCK_REFRESH)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			if err := l.put(now); err != nil {
+				log.Printf("store: failed to refresh lock %s: %s\n", l.ID, err)
+			}
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+		l.stop = nil
+	}
+	return l.s.removeLock(l.ID)
+}
+
+// ListLocks returns all the locks held in the store, oldest first.
+func (s *Store) ListLocks() (locks []Lock, err error) {
+	objects, err := s.List(c_LOCK_PREFIX)
+	if err != nil {
+		return
+	}
+	for key := range objects {
+		var l Lock
+		l, err = s.getLock(key)
+		switch {
+		case s.IsNotExist(err):
+			err = nil // released since
+			continue
+		case err == ErrMalformedLock:
+			err = nil // treat it as expired
+		}
+		if err != nil {
+			return
+		}
+		locks = append(locks, l)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Created.Before(locks[j].Created) })
+	return
+}
+
+func (s *Store) getLock(key string) (l Lock, err error) {
+	r, err := s.layer.GetReader(key)
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	if !bytes.HasPrefix(data, []byte("{")) {
+		// Encrypted, in a store made before format 3.
+		if data, err = s.Get(key); err != nil {
+			return
+		}
+	}
+	l.ID = key[len(c_LOCK_PREFIX):]
+	if json.Unmarshal(data, &l) != nil {
+		err = ErrMalformedLock
+	}
+	return
+}
+
+// Remove the stale locks, returning an error if any other lock stops us from taking one.
+func (s *Store) breakStaleLocks(exclusive bool) error {
+	locks, err := s.ListLocks()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, l := range locks {
+		if l.IsStale(now) {
+			log.Printf("store: removing stale lock held by %s\n", l)
+			if err := s.removeLock(l.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if l.conflicts(exclusive) {
+			return &LockedError{l}
+		}
+	}
+	return nil
+}
+
+func (s *Store) removeLock(id string) error {
+	err := s.Delete(c_LOCK_PREFIX + id)
+	if s.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// RemoveLocks removes the stale locks from the store, or with all, every lock (even those of running commands).
+// Returns the locks removed.
+func (s *Store) RemoveLocks(all bool) (removed []Lock, err error) {
+	locks, err := s.ListLocks()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, l := range locks {
+		if !all && !l.IsStale(now) {
+			continue
+		}
+		if err = s.removeLock(l.ID); err != nil {
+			return
+		}
+		removed = append(removed, l)
+	}
+	return
+}
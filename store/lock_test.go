@@ -0,0 +1,116 @@
+package store
+
+import (
+	"encoding/json"
+	"github.com/aviddiviner/inc/store/storage"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) *Store {
+	s := NewStore(storage.NewMockStorage(), "test")
+	_, err := s.Wipe(testSecret)
+	assert.NoError(t, err)
+	return s
+}
+
+// Write a lock to the store as if it were held by some other process.
+func putTestLock(t *testing.T, s *Store, id string, l Lock) {
+	data, err := json.Marshal(l)
+	assert.NoError(t, err)
+	_, err = s.Put(c_LOCK_PREFIX+id, data)
+	assert.NoError(t, err)
+}
+
+func TestLockSharedAndExclusive(t *testing.T) {
+	s := openTestStore(t)
+
+	// Shared locks can be held together, but not with an exclusive one.
+	a, err := s.Lock(false)
+	assert.NoError(t, err)
+	b, err := s.Lock(false)
+	assert.NoError(t, err)
+	_, err = s.Lock(true)
+	assert.IsType(t, &LockedError{}, err)
+
+	locks, err := s.ListLocks()
+	assert.NoError(t, err)
+	assert.Len(t, locks, 2)
+	assert.Equal(t, os.Getpid(), locks[0].PID)
+
+	assert.NoError(t, a.Unlock())
+	assert.NoError(t, b.Unlock())
+	x, err := s.Lock(true)
+	assert.NoError(t, err)
+	_, err = s.Lock(false)
+	assert.IsType(t, &LockedError{}, err)
+	assert.NoError(t, x.Unlock())
+
+	locks, err = s.ListLocks()
+	assert.NoError(t, err)
+	assert.Empty(t, locks)
+}
+
+func TestLockBreaksStaleLocks(t *testing.T) {
+	s := openTestStore(t)
+	now := time.Now()
+
+	// Expired, on some other host.
+	putTestLock(t, s, "expired", Lock{Host: "elsewhere", PID: 1, Exclusive: true, Created: now.Add(-time.Hour), Expires: now.Add(-time.Minute)})
+	l, err := s.Lock(true)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Unlock())
+
+	// Held on some other host; this one we can't tell is stale.
+	putTestLock(t, s, "running", Lock{Host: "elsewhere", PID: 1, Exclusive: true, Created: now, Expires: now.Add(time.Hour)})
+	_, err = s.Lock(false)
+	if assert.IsType(t, &LockedError{}, err) {
+		assert.Equal(t, "running", err.(*LockedError).Lock.ID)
+	}
+	removed, err := s.RemoveLocks(false)
+	assert.NoError(t, err)
+	assert.Empty(t, removed)
+	removed, err = s.RemoveLocks(true)
+	assert.NoError(t, err)
+	assert.Len(t, removed, 1)
+
+	// Held by a process on this host which is gone.
+	host, _ := os.Hostname()
+	putTestLock(t, s, "crashed", Lock{Host: host, PID: 1 << 30, Exclusive: true, Created: now, Expires: now.Add(time.Hour)})
+	removed, err = s.RemoveLocks(false)
+	assert.NoError(t, err)
+	if assert.Len(t, removed, 1) {
+		assert.Equal(t, "crashed", removed[0].ID)
+	}
+}
+
+func TestLockRereadsMetadata(t *testing.T) {
+	s := openTestStore(t)
+	assert.NoError(t, s.PutMetadata("manifest/latest", "first"))
+	other := NewStore(s.layer, "test")
+	assert.NoError(t, other.Open(s.keys))
+	_, err := other.GetMetadata("manifest/latest")
+	assert.NoError(t, err)
+
+	// One commits a new manifest under its lock, while the other has the metadata as it was.
+	l, err := s.Lock(true)
+	assert.NoError(t, err)
+	assert.NoError(t, s.PutMetadata("manifest/latest", "second"))
+	assert.NoError(t, l.Unlock())
+
+	// The other takes its lock and saves something else; what was committed isn't lost.
+	l, err = other.Lock(true)
+	assert.NoError(t, err)
+	latest, err := other.GetMetadata("manifest/latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", latest)
+	assert.NoError(t, other.PutMetadata("manifest/host", "elsewhere"))
+	assert.NoError(t, l.Unlock())
+
+	assert.NoError(t, s.reloadMetadata())
+	latest, err = s.GetMetadata("manifest/latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "second", latest)
+}
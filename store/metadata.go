@@ -2,18 +2,37 @@ package store
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"encoding/json"
 	"errors"
+	"github.com/aviddiviner/inc/store/crypto"
 	"github.com/aviddiviner/inc/util"
 	"io/ioutil"
+	"log"
 )
 
 type storeMetadata struct {
 	Version     int    `json:"version"`
 	StoreFormat int    `json:"storeFormat"`
-	Salt        []byte `json:"salt"` // base64 encoded
+	Salt        []byte `json:"salt,omitempty"` // base64 encoded; keys derived from the password directly (version 1)
 
-	UserData map[string]interface{} `json:"userData"`
+	KeySlots []KeySlot              `json:"keySlots,omitempty"` // since version 2
+	KDF      *crypto.KDF            `json:"kdf,omitempty"`      // for new key slots; PBKDF2 if not set (version 3 if set)
+	UserData map[string]interface{} `json:"userData"`           // in the clear before version 4
+
+	KeyCheck       []byte `json:"keyCheck,omitempty"`       // to tell if keys are the store's, base64 encoded (since version 5)
+	KeySlotsMAC    []byte `json:"keySlotsMAC,omitempty"`    // of the fields above, with the full keys (since version 6)
+	SealedUserData []byte `json:"sealedUserData,omitempty"` // encrypted user data, base64 encoded (since version 4)
+	MAC            []byte `json:"mac,omitempty"`            // of all the rest, base64 encoded (since version 4)
+}
+
+// The fields which say how to open the store, covered by the key slots MAC.
+type keySlotsFields struct {
+	StoreFormat int         `json:"storeFormat"`
+	Salt        []byte      `json:"salt,omitempty"`
+	KeySlots    []KeySlot   `json:"keySlots,omitempty"`
+	KDF         *crypto.KDF `json:"kdf,omitempty"`
+	KeyCheck    []byte      `json:"keyCheck,omitempty"`
 }
 
 // Error when retrieving store metadata that's unreadable.
@@ -22,6 +41,10 @@ var ErrMalformedMetadata = errors.New("malformed metadata")
 // Error when retrieving store metadata that has an unknown version.
 var ErrBadVersion = errors.New("bad version")
 
+// Error when the store metadata doesn't match its MAC; it was changed by someone without the store keys, or the keys
+// are wrong.
+var ErrMetadataNotAuthentic = errors.New("store metadata failed authentication (tampered with, or the wrong keys)")
+
 // Error when attempting to read a custom metadata field which hasn't been set.
 var ErrMissingMetadata = errors.New("user metadata not set")
 
@@ -29,10 +52,154 @@ var ErrMissingMetadata = errors.New("user metadata not set")
 
 const c_METADATA_KEY = "metadata"
 
-func newMetadata(salt []byte) storeMetadata {
-	return storeMetadata{Version: 1, StoreFormat: 1, Salt: salt}
+// The format of the objects in new stores. Format 1 objects are encrypted with AES-CBC and HMAC-SHA1, format 2 with a
+// chunked AEAD (see crypto.NewAEADCrypter). Format 3 objects may also be sealed with write-only keys, and are named by
+// hashes keyed with a key of their own (see crypto.NewKeyPairCrypter). Format 4 objects start with a byte naming
+// their compression codec (see zip.Codec).
+const c_STORE_FORMAT = 4
+
+// The version of the metadata we write. Version 2 added key slots; version 3, KDFs other than PBKDF2; version 4, the
+// MAC and encrypted user data; version 5, the key check; version 6, the key slots MAC. Older versions of inc reject
+// metadata newer than they know.
+const c_METADATA_VERSION = 6
+
+func newMetadata(slot KeySlot, kdf crypto.KDF) storeMetadata {
+	return storeMetadata{Version: c_METADATA_VERSION, StoreFormat: c_STORE_FORMAT, KeySlots: []KeySlot{slot}, KDF: &kdf}
+}
+
+// Check that the keys are the ones the store was made with. Stores get a key check when the metadata is first
+// written with the full keys; until then, any keys pass.
+func (md storeMetadata) checkKeys(keys Keys) error {
+	if md.KeyCheck != nil && !hmac.Equal(md.KeyCheck, crypto.KeyCheck(keys.EncKey, keys.AuthKey)) {
+		return ErrWrongKey
+	}
+	return nil
+}
+
+// Metadata written before key slots and MACs (by inc before store format 2) is read in the clear. Anything newer
+// must be authenticated.
+func (md storeMetadata) isLegacy() bool {
+	return md.StoreFormat <= 1 && md.Version < 4 && md.KeySlots == nil && md.KDF == nil && md.KeyCheck == nil &&
+		md.KeySlotsMAC == nil && md.SealedUserData == nil
+}
+
+// The KDF for new key slots.
+func (md storeMetadata) kdf() crypto.KDF {
+	if md.KDF != nil {
+		return *md.KDF
+	}
+	return crypto.LegacyKDF
+}
+
+// -----------------------------------------------------------------------------
+
+// The keys for encrypting the user data in the store metadata, and authenticating the rest. They're derived from the
+// hash key, which hosts with write-only keys have too, so they can update the user data (the pointers to their latest
+// manifests). The fields which say how to open the store (the key slots, KDF and key check) get a MAC of their own,
+// with a key derived from the full keys, so write-only hosts can't change those.
+//
+// This leaves a host with write-only keys able to change (or roll back) all of the user data, not just its own; it's
+// only trusted not to. (inc only writes the pointers of its own lineage from such a host.)
+type metadataKeys struct {
+	enc         crypto.Crypter
+	authKey     []byte
+	keySlotsKey []byte // nil with write-only keys
+}
+
+// The metadata keys, from the hash key and the (full) auth key, if we have it.
+func newMetadataKeys(hashKey, authKey []byte) (*metadataKeys, error) {
+	encKey, mdAuthKey := crypto.MetadataKeys(hashKey)
+	enc, err := crypto.NewAEADCrypter(encKey, mdAuthKey)
+	if err != nil {
+		return nil, err
+	}
+	mk := &metadataKeys{enc: enc, authKey: mdAuthKey}
+	if authKey != nil {
+		mk.keySlotsKey = crypto.KeySlotsKey(authKey)
+	}
+	return mk, nil
+}
+
+// The metadata keys of the full keys.
+func fullMetadataKeys(keys Keys) (*metadataKeys, error) {
+	wk, err := keys.WriteOnly()
+	if err != nil {
+		return nil, err
+	}
+	return newMetadataKeys(wk.HashKey, keys.AuthKey)
+}
+
+// The MAC of the fields which say how to open the store.
+func (k *metadataKeys) keySlotsMAC(md storeMetadata) ([]byte, error) {
+	data, err := json.Marshal(keySlotsFields{md.StoreFormat, md.Salt, md.KeySlots, md.KDF, md.KeyCheck})
+	if err != nil {
+		return nil, err
+	}
+	return crypto.MAC(k.keySlotsKey, data), nil
 }
 
+// Encrypt the user data, and MAC the rest, returning the metadata to write.
+func (k *metadataKeys) seal(md storeMetadata) (data []byte, err error) {
+	md.SealedUserData, md.MAC = nil, nil
+	if len(md.UserData) > 0 {
+		var plain []byte
+		if plain, err = json.Marshal(md.UserData); err != nil {
+			return
+		}
+		if md.SealedUserData, err = k.enc.Encrypt(plain); err != nil {
+			return
+		}
+	}
+	md.UserData = nil
+	if data, err = json.Marshal(md); err != nil {
+		return
+	}
+	md.MAC = crypto.MAC(k.authKey, data)
+	return json.Marshal(md)
+}
+
+// Check the MACs of the metadata we read, and decrypt its user data. Only legacy metadata may have neither; it's
+// authenticated once it's upgraded (see Store.UpgradeMetadata).
+func (k *metadataKeys) open(md storeMetadata) (storeMetadata, error) {
+	if md.MAC == nil {
+		if !md.isLegacy() {
+			return md, ErrMetadataNotAuthentic
+		}
+		log.Println("store: warning: the store metadata isn't authenticated yet; it will be once it's upgraded")
+		return md, nil
+	}
+	mac := md.MAC
+	md.MAC = nil
+	data, err := json.Marshal(md)
+	if err != nil {
+		return md, err
+	}
+	if !hmac.Equal(mac, crypto.MAC(k.authKey, data)) {
+		return md, ErrMetadataNotAuthentic
+	}
+	if k.keySlotsKey != nil {
+		want, err := k.keySlotsMAC(md)
+		if err != nil {
+			return md, err
+		}
+		if !hmac.Equal(md.KeySlotsMAC, want) {
+			return md, ErrMetadataNotAuthentic
+		}
+	}
+	if md.SealedUserData != nil {
+		if data, err = k.enc.Decrypt(md.SealedUserData); err != nil {
+			return md, ErrMetadataNotAuthentic
+		}
+		if json.Unmarshal(data, &md.UserData) != nil {
+			return md, ErrMalformedMetadata
+		}
+		md.SealedUserData = nil
+	}
+	return md, nil
+}
+
+// -----------------------------------------------------------------------------
+
 func (s *Store) getStoreMetadata() (md storeMetadata, err error) {
 	if s.meta != nil {
 		md = *s.meta
@@ -48,7 +215,7 @@ func (s *Store) getStoreMetadata() (md storeMetadata, err error) {
 	}
 	if ver, ok := util.ParseVersionJSON(data); ok {
 		switch ver {
-		case 1:
+		case 1, 2, 3, 4, 5, 6:
 			if f := json.Unmarshal(data, &md); f == nil {
 				s.meta = &md
 				return
@@ -62,7 +229,79 @@ func (s *Store) getStoreMetadata() (md storeMetadata, err error) {
 	return
 }
 
+// Verify the store metadata we read with the metadata keys, and decrypt its user data. Legacy metadata is refused,
+// unless we're upgrading it.
+func (s *Store) openStoreMetadata(mk *metadataKeys, md storeMetadata) (storeMetadata, error) {
+	authenticated := md.MAC != nil
+	if !authenticated && md.isLegacy() && !s.allowLegacy {
+		s.meta = nil
+		return md, ErrLegacyMetadata
+	}
+	md, err := mk.open(md)
+	if err != nil {
+		s.meta = nil
+		return md, err
+	}
+	s.meta = &md
+	s.authenticated = authenticated
+	return md, nil
+}
+
+// Drop the store metadata we have, and read (and verify) it again.
+func (s *Store) reloadMetadata() error {
+	s.meta = nil
+	if s.mdkey == nil {
+		return nil
+	}
+	md, err := s.getStoreMetadata()
+	if err == nil {
+		_, err = s.openStoreMetadata(s.mdkey, md)
+	}
+	if s.layer.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
 func (s *Store) putStoreMetadata(md storeMetadata) (err error) {
+	if s.mdkey == nil {
+		return ErrStoreNotConnected
+	}
+	if !s.verified {
+		return s.putUnverifiedMetadata(md)
+	}
+	md.Version = c_METADATA_VERSION
+	if s.keys.EncKey != nil {
+		md.KeyCheck = crypto.KeyCheck(s.keys.EncKey, s.keys.AuthKey)
+	}
+	// Without the full keys, the key slots MAC is kept as it was; the fields it covers can't be changed.
+	if s.mdkey.keySlotsKey != nil {
+		if md.KeySlotsMAC, err = s.mdkey.keySlotsMAC(md); err != nil {
+			return
+		}
+	}
+	data, err := s.mdkey.seal(md)
+	if err != nil {
+		return
+	}
+	_, err = s.layer.PutReader(c_METADATA_KEY, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	s.meta = &md
+	s.authenticated = true
+	return
+}
+
+// Until the keys are proven, legacy metadata is written as it was, in the clear, and without a key check or MAC; if
+// the keys were wrong, they'd lock out the right ones.
+func (s *Store) putUnverifiedMetadata(md storeMetadata) (err error) {
+	if !md.isLegacy() {
+		return ErrKeysUnverified
+	}
+	if md.Version == 0 {
+		md.Version = 1
+	}
 	data, err := json.Marshal(md)
 	if err != nil {
 		return
@@ -76,6 +315,9 @@ func (s *Store) putStoreMetadata(md storeMetadata) (err error) {
 }
 
 func (s *Store) getUserMetadata(key string) (interface{}, error) {
+	if s.mdkey == nil {
+		return nil, ErrStoreNotConnected
+	}
 	md, err := s.getStoreMetadata()
 	if err != nil {
 		return nil, err
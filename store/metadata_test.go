@@ -1,6 +1,8 @@
 package store
 
 import (
+	"encoding/json"
+	"github.com/aviddiviner/inc/store/crypto"
 	"github.com/aviddiviner/inc/store/storage"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -11,40 +13,53 @@ func TestCustomMetadataWorks(t *testing.T) {
 	salt := []byte("salty")
 	layer := storage.NewMockStorage()
 	store := NewStore(layer, "test")
+	assert.NoError(t, store.Open(testCryptoKeys))
 
 	assertMetadataEquals := func(expected storeMetadata) {
+		expected.KeyCheck = crypto.KeyCheck(testCryptoKeys.EncKey, testCryptoKeys.AuthKey)
+		expected.KeySlotsMAC, _ = store.mdkey.keySlotsMAC(expected)
 		got, _ := store.getStoreMetadata()
 		assert.Equal(t, expected, got)
+		other := NewStore(layer, "test")
+		raw, _ := other.getStoreMetadata()
+		got, _ = other.openStoreMetadata(store.mdkey, raw)
+		assert.Equal(t, expected, got)
 	}
-	assertRawMetadataEquals := func(expected string) {
+	rawMetadata := func() string {
 		r, _ := layer.GetReader(c_METADATA_KEY)
 		actual, _ := ioutil.ReadAll(r)
-		assert.Equal(t, expected, string(actual))
+		return string(actual)
 	}
 
-	simple := storeMetadata{Version: 1, StoreFormat: 1, Salt: salt}
-	store.putStoreMetadata(simple)
+	simple := storeMetadata{Version: c_METADATA_VERSION, StoreFormat: 1, Salt: salt}
+	assert.NoError(t, store.putStoreMetadata(simple))
 
 	assertMetadataEquals(simple)
-	assertRawMetadataEquals(`{"version":1,"storeFormat":1,"salt":"c2FsdHk=","userData":null}`)
+	assert.Regexp(t, `^{"version":6,"storeFormat":1,"salt":"c2FsdHk=","userData":null,"keyCheck":"[^"]+","keySlotsMAC":"[^"]+","mac":"[^"]+"}$`, rawMetadata())
 
 	userData := map[string]interface{}{
-		"123": 123,
+		"123": 123.0,
 		"foo": "bar",
 	}
-	full := storeMetadata{Version: 1, StoreFormat: 1, Salt: salt, UserData: userData}
-	store.putStoreMetadata(full)
+	full := storeMetadata{Version: c_METADATA_VERSION, StoreFormat: 1, Salt: salt, UserData: userData}
+	assert.NoError(t, store.putStoreMetadata(full))
 
 	assertMetadataEquals(full)
-	assertRawMetadataEquals(`{"version":1,"storeFormat":1,"salt":"c2FsdHk=","userData":{"123":123,"foo":"bar"}}`)
+	assert.Regexp(t, `^{"version":6,"storeFormat":1,"salt":"c2FsdHk=","userData":null,"keyCheck":"[^"]+","keySlotsMAC":"[^"]+","sealedUserData":"[^"]+","mac":"[^"]+"}$`, rawMetadata())
+	assert.NotContains(t, rawMetadata(), `"foo"`)
 }
 
 func TestCustomMetadataGetAndSet(t *testing.T) {
 	layer := storage.NewMockStorage()
-	store := NewStore(layer, "test")
+	store := legacyStore(layer)
 
 	layer.PutString(c_METADATA_KEY, `{"version":1}`)
 	_, err := store.GetMetadata("foo")
+	assert.Equal(t, ErrStoreNotConnected, err)
+	assert.Equal(t, ErrStoreNotConnected, store.PutMetadata("foo", "bar"))
+
+	assert.NoError(t, store.Open(testCryptoKeys))
+	_, err = store.GetMetadata("foo")
 	assert.EqualError(t, err, ErrMissingMetadata.Error())
 
 	store.PutMetadata("foo", "bar")
@@ -52,11 +67,98 @@ func TestCustomMetadataGetAndSet(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "bar", foo.(string))
 
+	// Metadata from before version 4 is read in the clear, to upgrade it.
 	layer = storage.NewMockStorage()
-	store = NewStore(layer, "test")
+	store = legacyStore(layer)
 
 	layer.PutString(c_METADATA_KEY, `{"version":1,"userData":{"foo":"bar"}}`)
+	assert.NoError(t, store.Open(testCryptoKeys))
 	foo, err = store.GetMetadata("foo")
 	assert.NoError(t, err)
 	assert.Equal(t, "bar", foo.(string))
 }
+
+func TestTamperedMetadata(t *testing.T) {
+	layer := storage.NewMockStorage()
+	store := NewStore(layer, "test")
+	keys, err := store.Wipe(testSecret)
+	assert.NoError(t, err)
+	assert.NoError(t, store.PutMetadata("latest", "new"))
+	r, _ := layer.GetReader(c_METADATA_KEY)
+	good, _ := ioutil.ReadAll(r)
+
+	tamper := func(fn func(map[string]interface{})) {
+		var md map[string]interface{}
+		assert.NoError(t, json.Unmarshal(good, &md))
+		fn(md)
+		data, _ := json.Marshal(md)
+		layer.PutString(c_METADATA_KEY, string(data))
+	}
+
+	// Roll the user data back to an older copy.
+	store.PutMetadata("latest", "old")
+	r, _ = layer.GetReader(c_METADATA_KEY)
+	old, _ := ioutil.ReadAll(r)
+	var oldMd map[string]interface{}
+	json.Unmarshal(old, &oldMd)
+	tamper(func(md map[string]interface{}) { md["sealedUserData"] = oldMd["sealedUserData"] })
+	_, err = NewStore(layer, "test").Unlock(testSecret)
+	assert.Equal(t, ErrMetadataNotAuthentic, err)
+	assert.Equal(t, ErrMetadataNotAuthentic, NewStore(layer, "test").Open(keys))
+
+	// Change the fields in the clear, or strip the MAC.
+	tamper(func(md map[string]interface{}) { md["storeFormat"] = 2 })
+	assert.Equal(t, ErrMetadataNotAuthentic, NewStore(layer, "test").Open(keys))
+	tamper(func(md map[string]interface{}) { delete(md, "mac") })
+	assert.Equal(t, ErrMetadataNotAuthentic, NewStore(layer, "test").Open(keys))
+	tamper(func(md map[string]interface{}) { md["userData"] = map[string]interface{}{"latest": "evil"} })
+	assert.Equal(t, ErrMetadataNotAuthentic, NewStore(layer, "test").Open(keys))
+
+	tamper(func(md map[string]interface{}) { md["keyCheck"] = md["mac"] })
+	assert.Equal(t, ErrWrongKey, NewStore(layer, "test").Open(keys))
+
+	// Pass it off as metadata from before the MAC, with the user data in the clear.
+	tamper(func(md map[string]interface{}) {
+		md["version"] = 3
+		md["userData"] = map[string]interface{}{"latest": "old"}
+		delete(md, "mac")
+		delete(md, "sealedUserData")
+	})
+	assert.Equal(t, ErrMetadataNotAuthentic, NewStore(layer, "test").Open(keys))
+
+	tamper(func(md map[string]interface{}) {})
+	store = NewStore(layer, "test")
+	assert.NoError(t, store.Open(keys))
+	latest, err := store.GetMetadata("latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", latest)
+	assert.NotContains(t, string(good), `"latest"`)
+}
+
+func TestWriteOnlyMetadata(t *testing.T) {
+	layer := storage.NewMockStorage()
+	keys, err := NewStore(layer, "test").Wipe(testSecret)
+	assert.NoError(t, err)
+	wk, err := keys.WriteOnly()
+	assert.NoError(t, err)
+
+	// Hosts with write-only keys can update the user data.
+	writer := NewStore(layer, "test")
+	assert.NoError(t, writer.OpenWriteOnly(wk))
+	assert.NoError(t, writer.PutMetadata("latest", "new"))
+	store := NewStore(layer, "test")
+	assert.NoError(t, store.Open(keys))
+	latest, err := store.GetMetadata("latest")
+	assert.NoError(t, err)
+	assert.Equal(t, "new", latest)
+
+	// But not the key slots, even though the rest of the metadata is sealed with keys they have.
+	md, err := writer.getStoreMetadata()
+	assert.NoError(t, err)
+	slot, err := newKeySlot("evil", []byte("evil"), Keys{make([]byte, 32), make([]byte, 32)}, md.kdf())
+	assert.NoError(t, err)
+	md.KeySlots = append(md.KeySlots, slot)
+	assert.NoError(t, writer.putStoreMetadata(md))
+	assert.NoError(t, NewStore(layer, "test").OpenWriteOnly(wk))
+	assert.Equal(t, ErrMetadataNotAuthentic, NewStore(layer, "test").Open(keys))
+}
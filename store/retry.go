@@ -0,0 +1,106 @@
+package store
+
+import (
+	"github.com/aviddiviner/inc/store/storage"
+	"io"
+	"log"
+	"time"
+)
+
+// RetryPolicy decides how often, and how long to wait before, requests to the storage layer are retried after they
+// fail with a transient (or throttling) error. (See storage.RetryPolicy.)
+type RetryPolicy = storage.RetryPolicy
+
+// DefaultRetryPolicy is used by new stores.
+var DefaultRetryPolicy = storage.DefaultRetryPolicy
+
+// -----------------------------------------------------------------------------
+
+// A storage layer which retries idempotent requests.
+type retryLayer struct {
+	StorageLayer
+	policy RetryPolicy
+}
+
+// Make a request until it succeeds, fails with an error not worth retrying, or we run out of attempts.
+func (r *retryLayer) do(op, key string, req func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = req()
+		if err == nil {
+			return
+		}
+		class := r.ErrorClass(err)
+		if !class.Retryable() {
+			return
+		}
+		if attempt >= r.policy.Attempts {
+			if attempt > 1 {
+				log.Printf("store: %s: %s: giving up after %d attempts: %s\n", op, key, attempt, err)
+			}
+			return
+		}
+		delay := r.policy.Delay(attempt, class)
+		log.Printf("store: %s: %s: %s error, retrying in %s: %s\n", op, key, class, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+func (r *retryLayer) Exists() (ok bool, err error) {
+	err = r.do("exists", "", func() (err error) {
+		ok, err = r.StorageLayer.Exists()
+		return
+	})
+	return
+}
+
+func (r *retryLayer) Size(key string) (size int, err error) {
+	err = r.do("size", key, func() (err error) {
+		size, err = r.StorageLayer.Size(key)
+		return
+	})
+	return
+}
+
+func (r *retryLayer) GetReader(key string) (rd io.Reader, err error) {
+	err = r.do("get", key, func() (err error) {
+		rd, err = r.StorageLayer.GetReader(key)
+		return
+	})
+	return
+}
+
+func (r *retryLayer) GetReaderParts(key string, ranges []ByteRange) (rd io.Reader, err error) {
+	err = r.do("get.parts", key, func() (err error) {
+		rd, err = r.StorageLayer.GetReaderParts(key, ranges)
+		return
+	})
+	return
+}
+
+// PutReader is only retried if we can rewind the reader to try again.
+func (r *retryLayer) PutReader(key string, rd io.Reader) (written int, err error) {
+	rs, ok := rd.(io.ReadSeeker)
+	if !ok {
+		return r.StorageLayer.PutReader(key, rd)
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	err = r.do("put", key, func() (err error) {
+		if _, err = rs.Seek(start, io.SeekStart); err != nil {
+			return
+		}
+		written, err = r.StorageLayer.PutReader(key, rs)
+		return
+	})
+	return
+}
+
+func (r *retryLayer) List(prefix string) (list map[string]int, err error) {
+	err = r.do("list", prefix, func() (err error) {
+		list, err = r.StorageLayer.List(prefix)
+		return
+	})
+	return
+}
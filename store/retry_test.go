@@ -0,0 +1,91 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"github.com/aviddiviner/inc/store/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+var testFault = errors.New("connection reset")
+
+var quickRetries = RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+// Fail the first n requests for a key with some error.
+func failRequests(n int, err error) (storage.MockRequestFault, *int) {
+	count := 0
+	return func(key string) error {
+		if key == c_METADATA_KEY {
+			return nil
+		}
+		count += 1
+		if count <= n {
+			return err
+		}
+		return nil
+	}, &count
+}
+
+func TestRetriesTransientErrors(t *testing.T) {
+	layer := storage.NewMockStorage()
+	store := NewStore(layer, "test")
+	store.Open(testCryptoKeys)
+	store.SetRetryPolicy(quickRetries)
+
+	fault, count := failRequests(2, testFault)
+	layer.InjectRequestFault(fault)
+	_, err := store.Put("test", testData)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, *count)
+	layer.ClearRequestFaults()
+
+	fault, count = failRequests(2, storage.MockErrSlowDown)
+	layer.InjectRequestFault(fault)
+	got, err := store.Get("test")
+	assert.NoError(t, err)
+	assert.Equal(t, testData, got)
+	assert.Equal(t, 3, *count)
+	layer.ClearRequestFaults()
+
+	// Run out of attempts.
+	fault, count = failRequests(3, testFault)
+	layer.InjectRequestFault(fault)
+	_, err = store.Get("test")
+	assert.Equal(t, testFault, err)
+	assert.Equal(t, 3, *count)
+	layer.ClearRequestFaults()
+
+	// Streamed puts can't be retried by the store, but can be with Retry.
+	fault, count = failRequests(1, testFault)
+	layer.InjectRequestFault(fault)
+	err = store.Retry("put.packer", "packed", func() error {
+		packer, err := store.Pack("packed")
+		if err != nil {
+			return err
+		}
+		packer.PutReaderRange(bytes.NewReader(testData))
+		return packer.Close()
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, *count)
+}
+
+func TestDoesNotRetryOtherErrors(t *testing.T) {
+	layer := storage.NewMockStorage()
+	store := NewStore(layer, "test")
+	store.Open(testCryptoKeys)
+	store.SetRetryPolicy(quickRetries)
+
+	_, err := store.Get("missing")
+	assert.True(t, store.IsNotExist(err))
+	assert.Equal(t, storage.ErrorNotFound, store.ErrorClass(err))
+
+	fault, count := failRequests(5, storage.MockErrAccessDenied)
+	layer.InjectRequestFault(fault)
+	_, err = store.Put("test", testData)
+	assert.Equal(t, storage.MockErrAccessDenied, err)
+	assert.Equal(t, storage.ErrorAuth, store.ErrorClass(err))
+	assert.Equal(t, 1, *count)
+}
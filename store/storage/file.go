@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // FileStorage stores data locally on disk in some directory.
@@ -47,7 +48,7 @@ func (fs *FileStorage) Create() error {
 }
 
 func (fs *FileStorage) Size(key string) (int, error) {
-	fi, err := os.Stat(key)
+	fi, err := os.Stat(filepath.Join(fs.root, key))
 	if err != nil {
 		return 0, err
 	}
@@ -60,7 +61,25 @@ func (fs *FileStorage) GetReader(key string) (io.Reader, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &util.AutoCloseReader{rc}, nil
+	return &util.AutoCloseReader{RC: rc}, nil
+}
+
+func (fs *FileStorage) GetReaderParts(key string, ranges []ByteRange) (io.Reader, error) {
+	path := filepath.Join(fs.root, key)
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	var parts []io.Reader
+	for _, r := range mergeRanges(ranges) {
+		parts = append(parts, io.NewSectionReader(fh, int64(r[0]), int64(r.Len())))
+	}
+	return &util.AutoCloseReader{RC: &multiReadCloser{io.MultiReader(parts...), fh}}, nil
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
 }
 
 func (fs *FileStorage) PutReader(key string, r io.Reader) (length int, err error) {
@@ -85,3 +104,49 @@ func (fs *FileStorage) PutReader(key string, r io.Reader) (length int, err error
 func (fs *FileStorage) IsNotExist(err error) bool {
 	return os.IsNotExist(err)
 }
+
+func (fs *FileStorage) ErrorClass(err error) ErrorClass {
+	switch {
+	case os.IsNotExist(err):
+		return ErrorNotFound
+	case os.IsPermission(err):
+		return ErrorAuth
+	}
+	return ErrorPermanent
+}
+
+func (fs *FileStorage) List(prefix string) (map[string]int, error) {
+	list := make(map[string]int)
+	err := filepath.Walk(fs.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(fs.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			list[key] = int(fi.Size())
+		}
+		return nil
+	})
+	return list, err
+}
+
+func (fs *FileStorage) Delete(key string) error {
+	path := filepath.Join(fs.root, key)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	// Tidy up any folders left empty, but never the root.
+	for dir := filepath.Dir(path); dir != fs.root && strings.HasPrefix(dir, fs.root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break // not empty
+		}
+	}
+	return nil
+}
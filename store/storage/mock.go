@@ -4,15 +4,22 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"strings"
+	"sync"
 )
 
 var MockErrNoSuchKey = errors.New("The specified key does not exist.")
+var MockErrInvalidRange = errors.New("The requested range is not satisfiable.")
+var MockErrSlowDown = errors.New("Please reduce your request rate.")
+var MockErrAccessDenied = errors.New("Access Denied")
 
 type MockRequestFault func(key string) error
 type MockReaderWrapper func(r io.Reader) io.Reader
 
-// MockStorage is used for testing; data is stored in memory in a map.
+// MockStorage is used for testing; data is stored in memory in a map. It's safe to use from many goroutines at once;
+// the injected callbacks are called without holding its lock, so they may use it too.
 type MockStorage struct {
+	mu        sync.Mutex
 	dataStore map[string][]byte
 	requestFn []MockRequestFault
 	readerFn  []MockReaderWrapper
@@ -26,36 +33,92 @@ func (s *MockStorage) Exists() (bool, error) { return true, nil }
 func (s *MockStorage) Create() error         { return nil }
 
 func (s *MockStorage) Size(key string) (int, error) {
+	if err := s.requestFault(key); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if data, ok := s.dataStore[key]; ok {
 		return len(data), nil
 	}
 	return 0, MockErrNoSuchKey
 }
 
-func (s *MockStorage) GetReader(key string) (r io.Reader, err error) {
-	for _, fn := range s.requestFn {
-		err = fn(key)
-		if err != nil {
-			return
+// Call the injected request faults, returning the first error.
+func (s *MockStorage) requestFault(key string) error {
+	s.mu.Lock()
+	requestFn := s.requestFn
+	s.mu.Unlock()
+	for _, fn := range requestFn {
+		if err := fn(key); err != nil {
+			return err
 		}
 	}
-	if data, ok := s.dataStore[key]; ok {
-		r = bytes.NewReader(data)
-		for _, fn := range s.readerFn {
-			r = fn(r)
-		}
+	return nil
+}
+
+func (s *MockStorage) GetReader(key string) (r io.Reader, err error) {
+	if err = s.requestFault(key); err != nil {
+		return
+	}
+	data, ok := s.get(key)
+	if !ok {
+		err = MockErrNoSuchKey
 		return
 	}
-	err = MockErrNoSuchKey
-	return
+	return s.wrapReader(bytes.NewReader(data)), nil
+}
+
+// The data stored at a key, if any.
+func (s *MockStorage) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.dataStore[key]
+	return data, ok
+}
+
+// Call the injected reader wrappers on a reader being returned.
+func (s *MockStorage) wrapReader(r io.Reader) io.Reader {
+	s.mu.Lock()
+	readerFn := s.readerFn
+	s.mu.Unlock()
+	for _, fn := range readerFn {
+		r = fn(r)
+	}
+	return r
+}
+
+func (s *MockStorage) GetReaderParts(key string, ranges []ByteRange) (r io.Reader, err error) {
+	if err = s.requestFault(key); err != nil {
+		return
+	}
+	data, ok := s.get(key)
+	if !ok {
+		err = MockErrNoSuchKey
+		return
+	}
+	var parts []io.Reader
+	for _, rng := range ranges {
+		if rng[0] < 0 || rng[1] < rng[0] || rng[1] >= len(data) {
+			err = MockErrInvalidRange
+			return
+		}
+		parts = append(parts, bytes.NewReader(data[rng[0]:rng[1]+1]))
+	}
+	return s.wrapReader(io.MultiReader(parts...)), nil
 }
 
 func (s *MockStorage) PutReader(key string, r io.Reader) (int, error) {
+	if err := s.requestFault(key); err != nil {
+		return 0, err
+	}
 	var buf bytes.Buffer
 	if n, err := io.Copy(&buf, r); err != nil {
 		return int(n), err
 	}
 	written := buf.Len()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.dataStore[key] = buf.Bytes()
 	return written, nil
 }
@@ -67,29 +130,77 @@ func (s *MockStorage) IsNotExist(err error) bool {
 	return false
 }
 
+// ErrorClass treats any errors other than the MockErr* ones (e.g. from injected faults) as transient.
+func (s *MockStorage) ErrorClass(err error) ErrorClass {
+	switch err {
+	case MockErrNoSuchKey:
+		return ErrorNotFound
+	case MockErrInvalidRange:
+		return ErrorPermanent
+	case MockErrSlowDown:
+		return ErrorThrottled
+	case MockErrAccessDenied:
+		return ErrorAuth
+	}
+	return ErrorTransient
+}
+
+func (s *MockStorage) List(prefix string) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make(map[string]int)
+	for key, data := range s.dataStore {
+		if strings.HasPrefix(key, prefix) {
+			list[key] = len(data)
+		}
+	}
+	return list, nil
+}
+
+func (s *MockStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dataStore[key]; !ok {
+		return MockErrNoSuchKey
+	}
+	delete(s.dataStore, key)
+	return nil
+}
+
 // Put allows easy writing to a key for tests.
 func (s *MockStorage) PutString(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.dataStore[key] = []byte(value)
 }
 
-// InjectRequestFault adds a callback which gets called when a key is requested by GetReader.
+// InjectRequestFault adds a callback which gets called when a key is requested by GetReader, GetReaderParts,
+// PutReader or Size.
 // This func should return an error or nil.
 func (s *MockStorage) InjectRequestFault(fn MockRequestFault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.requestFn = append(s.requestFn, fn)
 }
 
-// InjectReaderWrapper adds a callback which gets called when an io.Reader is returned by GetReader.
+// InjectReaderWrapper adds a callback which gets called when an io.Reader is returned by GetReader (or GetReaderParts).
 // This func should wrap that Reader or return it unchanged.
 func (s *MockStorage) InjectReaderWrapper(fn MockReaderWrapper) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.readerFn = append(s.readerFn, fn)
 }
 
 // ClearRequestFaults clears any request callbacks that have been added by InjectRequestFault.
 func (s *MockStorage) ClearRequestFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.requestFn = nil
 }
 
 // ClearReaderWrappers clears any reader callbacks that have been added by InjectReaderWrapper.
 func (s *MockStorage) ClearReaderWrappers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.readerFn = nil
 }
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/mitchellh/goamz/s3"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	c_PART_SIZE    = 8 << 20 // objects bigger than this are uploaded in parts (S3 needs parts of at least 5MB)
+	c_PART_UPLOADS = 4       // parts uploaded at once, each with its own buffer
+)
+
+// The parts of the S3 API used for uploading objects, so that they can be faked in tests.
+type uploadBucket interface {
+	PutReader(path string, r io.Reader, length int64, contType string, perm s3.ACL) error
+	InitMulti(key string, contType string, perm s3.ACL) (multipartUpload, error)
+	// ErrorClass says whether a failed part is worth uploading again.
+	ErrorClass(err error) ErrorClass
+}
+
+// An S3 multipart upload in progress.
+type multipartUpload interface {
+	PutPart(n int, r io.ReadSeeker) (s3.Part, error)
+	Complete(parts []s3.Part) error
+	Abort() error
+}
+
+// Adapts an *s3.Bucket to the uploadBucket interface.
+type s3UploadBucket struct {
+	*s3.Bucket
+}
+
+func (b s3UploadBucket) InitMulti(key string, contType string, perm s3.ACL) (multipartUpload, error) {
+	multi, err := b.Bucket.InitMulti(key, contType, perm)
+	if err != nil {
+		return nil, err
+	}
+	return multi, nil
+}
+
+func (b s3UploadBucket) ErrorClass(err error) ErrorClass {
+	return s3ErrorClass(err)
+}
+
+// -----------------------------------------------------------------------------
+
+// Upload an object from a reader. Small objects are put in one request. Bigger
+// objects are uploaded in parts, a few at a time, so we never hold more than a
+// few parts in memory. Failed parts are retried by the policy.
+func uploadReader(b uploadBucket, key string, r io.Reader, p RetryPolicy) (length int, err error) {
+	var first bytes.Buffer
+	n, err := io.CopyN(&first, r, c_PART_SIZE)
+	if err == io.EOF {
+		err = b.PutReader(key, &first, n, c_CONTENT_TYPE, c_DEFAULT_ACL)
+		if err != nil {
+			return
+		}
+		return int(n), nil
+	}
+	if err != nil {
+		return
+	}
+	return uploadMultipart(b, key, first.Bytes(), r, p)
+}
+
+// A fixed number of part buffers, allocated as they're needed.
+type partBuffers struct {
+	free  chan []byte
+	alloc int
+}
+
+func newPartBuffers(first []byte) *partBuffers {
+	p := &partBuffers{free: make(chan []byte, c_PART_UPLOADS), alloc: 1}
+	p.free <- first
+	return p
+}
+
+// Get a free buffer, waiting for one if they're all in use.
+func (p *partBuffers) get() []byte {
+	select {
+	case buf := <-p.free:
+		return buf
+	default:
+	}
+	if p.alloc < cap(p.free) {
+		p.alloc += 1
+		return make([]byte, c_PART_SIZE)
+	}
+	return <-p.free
+}
+
+func (p *partBuffers) put(buf []byte) {
+	p.free <- buf[:c_PART_SIZE]
+}
+
+// Upload the rest of an object in parts, given the (full) first part. If any
+// part fails, the upload is aborted, so S3 doesn't keep the parts around.
+func uploadMultipart(b uploadBucket, key string, first []byte, r io.Reader, p RetryPolicy) (length int, err error) {
+	multi, err := b.InitMulti(key, c_CONTENT_TYPE, c_DEFAULT_ACL)
+	if err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var parts []s3.Part
+	var partErr error
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return partErr != nil
+	}
+
+	buffers := newPartBuffers(first)
+	buf := buffers.get()
+	for n := 1; ; n++ {
+		wg.Add(1)
+		go func(n int, data []byte) {
+			defer wg.Done()
+			part, err := uploadPart(b, multi, key, n, data, p)
+			buffers.put(data)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				partErr = err
+				return
+			}
+			parts = append(parts, part)
+		}(n, buf)
+		length += len(buf)
+
+		if len(buf) < c_PART_SIZE || failed() {
+			break // last part
+		}
+		buf = buffers.get()
+		var size int
+		size, err = io.ReadFull(r, buf)
+		if err == io.EOF {
+			err = nil
+			buffers.put(buf)
+			break // no more parts
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			buffers.put(buf)
+			break
+		}
+		buf = buf[:size]
+	}
+	wg.Wait()
+
+	if err == nil {
+		err = partErr
+	}
+	if err == nil {
+		sort.Slice(parts, func(i, j int) bool { return parts[i].N < parts[j].N })
+		err = multi.Complete(parts)
+	}
+	if err != nil {
+		log.Printf("s3: aborting upload of %s: %s\n", key, err)
+		if e := multi.Abort(); e != nil {
+			log.Printf("s3: failed to abort upload of %s: %s\n", key, e)
+		}
+		return 0, err
+	}
+	return
+}
+
+// Upload a part, retrying it (after a delay, as the policy says) while it fails
+// with errors worth retrying.
+func uploadPart(b uploadBucket, multi multipartUpload, key string, n int, data []byte, p RetryPolicy) (part s3.Part, err error) {
+	for attempt := 1; ; attempt++ {
+		part, err = multi.PutPart(n, bytes.NewReader(data))
+		if err == nil {
+			return
+		}
+		class := b.ErrorClass(err)
+		if !class.Retryable() || attempt >= p.Attempts {
+			log.Printf("s3: failed to upload part %d of %s (%s error, attempt %d/%d): %s\n", n, key, class, attempt,
+				p.Attempts, err)
+			return
+		}
+		delay := p.Delay(attempt, class)
+		log.Printf("s3: failed to upload part %d of %s (%s error, retrying in %s): %s\n", n, key, class, delay, err)
+		time.Sleep(delay)
+	}
+}
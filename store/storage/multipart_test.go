@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+var errFakePart = errors.New("part failed")
+var errFakeDenied = errors.New("access denied")
+
+var quickRetries = RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+// An in-memory fake of the S3 upload API.
+type fakeUploadBucket struct {
+	sync.Mutex
+	objects  map[string][]byte
+	uploads  []*fakeUpload
+	failPart func(n, attempt int) error // called on each part upload
+	inFlight int
+	maxParts int // most parts being uploaded at once
+}
+
+func newFakeUploadBucket() *fakeUploadBucket {
+	return &fakeUploadBucket{objects: make(map[string][]byte)}
+}
+
+func (b *fakeUploadBucket) PutReader(path string, r io.Reader, length int64, contType string, perm s3.ACL) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != length {
+		return errors.New("wrong content length")
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.objects[path] = data
+	return nil
+}
+
+func (b *fakeUploadBucket) InitMulti(key string, contType string, perm s3.ACL) (multipartUpload, error) {
+	b.Lock()
+	defer b.Unlock()
+	u := &fakeUpload{b: b, key: key, parts: make(map[int][]byte), attempts: make(map[int]int)}
+	b.uploads = append(b.uploads, u)
+	return u, nil
+}
+
+type fakeUpload struct {
+	b         *fakeUploadBucket
+	key       string
+	parts     map[int][]byte
+	attempts  map[int]int
+	completed bool
+	aborted   bool
+}
+
+func (u *fakeUpload) PutPart(n int, r io.ReadSeeker) (s3.Part, error) {
+	u.b.Lock()
+	u.attempts[n] += 1
+	attempt := u.attempts[n]
+	u.b.inFlight += 1
+	if u.b.inFlight > u.b.maxParts {
+		u.b.maxParts = u.b.inFlight
+	}
+	u.b.Unlock()
+	defer func() {
+		u.b.Lock()
+		u.b.inFlight -= 1
+		u.b.Unlock()
+	}()
+
+	time.Sleep(time.Millisecond)
+	if u.b.failPart != nil {
+		if err := u.b.failPart(n, attempt); err != nil {
+			return s3.Part{}, err
+		}
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return s3.Part{}, err
+	}
+	u.b.Lock()
+	defer u.b.Unlock()
+	u.parts[n] = data
+	return s3.Part{N: n, Size: int64(len(data))}, nil
+}
+
+func (u *fakeUpload) Complete(parts []s3.Part) error {
+	u.b.Lock()
+	defer u.b.Unlock()
+	var data []byte
+	for i, p := range parts {
+		if p.N != i+1 {
+			return errors.New("parts out of order")
+		}
+		if i < len(parts)-1 && p.Size < 5<<20 {
+			return errors.New("part too small")
+		}
+		data = append(data, u.parts[p.N]...)
+	}
+	u.b.objects[u.key] = data
+	u.completed = true
+	return nil
+}
+
+func (b *fakeUploadBucket) ErrorClass(err error) ErrorClass {
+	switch err {
+	case errFakePart:
+		return ErrorTransient
+	case errFakeDenied:
+		return ErrorAuth
+	}
+	return ErrorPermanent
+}
+
+func (u *fakeUpload) Abort() error {
+	u.b.Lock()
+	defer u.b.Unlock()
+	u.aborted = true
+	return nil
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// -----------------------------------------------------------------------------
+
+func TestUploadSmallObject(t *testing.T) {
+	b := newFakeUploadBucket()
+	data := randomData(1 << 20)
+
+	n, err := uploadReader(b, "small", bytes.NewReader(data), quickRetries)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, data, b.objects["small"])
+	assert.Empty(t, b.uploads)
+}
+
+func TestUploadMultipart(t *testing.T) {
+	b := newFakeUploadBucket()
+	data := randomData(6*c_PART_SIZE + 123)
+
+	n, err := uploadReader(b, "big", iotest.HalfReader(bytes.NewReader(data)), quickRetries)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.True(t, bytes.Equal(data, b.objects["big"]))
+
+	assert.Len(t, b.uploads, 1)
+	assert.Len(t, b.uploads[0].parts, 7)
+	assert.True(t, b.uploads[0].completed)
+	assert.True(t, b.maxParts <= c_PART_UPLOADS, "%d parts at once", b.maxParts)
+
+	// Exactly one part's worth.
+	n, err = uploadReader(b, "exact", bytes.NewReader(data[:c_PART_SIZE]), quickRetries)
+	assert.NoError(t, err)
+	assert.Equal(t, c_PART_SIZE, n)
+	assert.True(t, bytes.Equal(data[:c_PART_SIZE], b.objects["exact"]))
+}
+
+func TestUploadRetriesFailedParts(t *testing.T) {
+	b := newFakeUploadBucket()
+	b.failPart = func(n, attempt int) error {
+		if n == 2 && attempt < quickRetries.Attempts {
+			return errFakePart
+		}
+		return nil
+	}
+	data := randomData(3 * c_PART_SIZE)
+
+	_, err := uploadReader(b, "big", bytes.NewReader(data), quickRetries)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, b.objects["big"]))
+	assert.Equal(t, quickRetries.Attempts, b.uploads[0].attempts[2])
+	assert.Equal(t, 1, b.uploads[0].attempts[1])
+
+	// Some errors aren't worth retrying.
+	b.failPart = func(n, attempt int) error {
+		if n == 2 {
+			return errFakeDenied
+		}
+		return nil
+	}
+	_, err = uploadReader(b, "denied", bytes.NewReader(data), quickRetries)
+	assert.Equal(t, errFakeDenied, err)
+	assert.Equal(t, 1, b.uploads[1].attempts[2])
+	assert.True(t, b.uploads[1].aborted)
+}
+
+func TestUploadAbortsOnFailure(t *testing.T) {
+	b := newFakeUploadBucket()
+	b.failPart = func(n, attempt int) error {
+		if n == 2 {
+			return errFakePart
+		}
+		return nil
+	}
+	data := randomData(3 * c_PART_SIZE)
+
+	_, err := uploadReader(b, "big", bytes.NewReader(data), quickRetries)
+	assert.Equal(t, errFakePart, err)
+	assert.Equal(t, quickRetries.Attempts, b.uploads[0].attempts[2])
+	assert.True(t, b.uploads[0].aborted)
+	assert.False(t, b.uploads[0].completed)
+	assert.NotContains(t, b.objects, "big")
+
+	// Errors reading the object abort the upload too.
+	b.failPart = nil
+	r := io.MultiReader(bytes.NewReader(data), iotest.TimeoutReader(bytes.NewReader(data)))
+	_, err = uploadReader(b, "big", r, quickRetries)
+	assert.Equal(t, iotest.ErrTimeout, err)
+	assert.True(t, b.uploads[1].aborted)
+	assert.NotContains(t, b.objects, "big")
+}
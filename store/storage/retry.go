@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy decides how often, and how long to wait before, requests to the storage layer are retried after they
+// fail with a transient (or throttling) error. Delays grow exponentially, with some random jitter so that many
+// requests failing at once don't all retry at once.
+type RetryPolicy struct {
+	Attempts  int           // tries at each request, including the first
+	BaseDelay time.Duration // delay before the first retry; doubles after each retry
+	MaxDelay  time.Duration // longest delay between retries
+}
+
+// DefaultRetryPolicy is used by new stores.
+var DefaultRetryPolicy = RetryPolicy{Attempts: 5, BaseDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second}
+
+// Throttled requests wait this many times longer before retrying.
+const c_THROTTLE_FACTOR = 4
+
+// Delay returns how long to wait before the given retry (starting at 1).
+func (p RetryPolicy) Delay(retry int, class ErrorClass) time.Duration {
+	d := p.BaseDelay
+	if class == ErrorThrottled {
+		d *= c_THROTTLE_FACTOR
+	}
+	for i := 1; i < retry && (p.MaxDelay == 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Wait at least half the delay, and up to the full delay.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
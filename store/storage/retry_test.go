@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Attempts: 10, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	for i := 0; i < 20; i++ {
+		d := p.Delay(1, ErrorTransient)
+		assert.True(t, d >= 500*time.Millisecond && d <= time.Second, "%s", d)
+		d = p.Delay(3, ErrorTransient)
+		assert.True(t, d >= 2*time.Second && d <= 4*time.Second, "%s", d)
+		d = p.Delay(1, ErrorThrottled)
+		assert.True(t, d >= 2*time.Second && d <= 4*time.Second, "%s", d)
+		d = p.Delay(8, ErrorTransient)
+		assert.True(t, d >= 5*time.Second && d <= 10*time.Second, "%s", d)
+	}
+}
@@ -3,10 +3,12 @@ package storage
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"github.com/aviddiviner/inc/util"
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
 	"io"
+	"net"
 	"net/http"
 )
 
@@ -15,8 +17,10 @@ const c_DEFAULT_ACL = s3.Private
 
 // S3Connection stores data remotely to a private S3 bucket.
 type S3Connection struct {
-	client *s3.S3
-	bucket *s3.Bucket
+	client   *s3.S3
+	bucket   *s3.Bucket
+	uploader uploadBucket
+	retry    RetryPolicy // for the parts of multipart uploads
 }
 
 // NewS3Connection connects to S3 in the given region, using the AWS credentials
@@ -29,7 +33,8 @@ func NewS3Connection(region, bucket, accessKey, secretKey string) (*S3Connection
 		return nil, err
 	}
 	client := s3.New(auth, aws.Regions[region])
-	return &S3Connection{client, client.Bucket(bucket)}, nil
+	b := client.Bucket(bucket)
+	return &S3Connection{client, b, s3UploadBucket{b}, DefaultRetryPolicy}, nil
 }
 
 func (c *S3Connection) Exists() (bool, error) {
@@ -82,22 +87,97 @@ func (c *S3Connection) GetReader(key string) (io.Reader, error) {
 		}
 		return nil, err
 	}
-	return &util.AutoCloseReader{rc}, nil
+	return &util.AutoCloseReader{RC: rc}, nil
 }
 
-func (c *S3Connection) PutReader(key string, r io.Reader) (length int, err error) {
-	// TODO: S3 multipart uploads should be a better way.
-	var buf bytes.Buffer
-	n, err := io.Copy(&buf, r) // we need the length :(
+func (c *S3Connection) GetReaderParts(key string, ranges []ByteRange) (io.Reader, error) {
+	merged := mergeRanges(ranges)
+	if len(merged) == 0 {
+		return bytes.NewReader(nil), nil
+	}
+	// Fetch the first range now, so we return any errors (like missing keys) up front.
+	first, err := c.getRange(key, merged[0])
 	if err != nil {
-		return
+		return nil, err
 	}
-	err = c.bucket.PutReader(key, &buf, n, c_CONTENT_TYPE, c_DEFAULT_ACL)
+	return &s3RangeReader{c: c, key: key, ranges: merged[1:], curr: first}, nil
+}
+
+// Make a GET request for a range of bytes of some object.
+func (c *S3Connection) getRange(key string, r ByteRange) (io.Reader, error) {
+	headers := map[string][]string{"Range": {fmt.Sprintf("bytes=%d-%d", r[0], r[1])}}
+	resp, err := c.bucket.GetResponseWithHeaders(key, headers)
 	if err != nil {
-		return
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, &HeadError{resp, errors.New("failed ranged GET request")}
+	}
+	return &util.AutoCloseReader{RC: resp.Body}, nil
+}
+
+// Reads the ranges of an object one after the other, only requesting each range
+// once we're done reading the last.
+type s3RangeReader struct {
+	c      *S3Connection
+	key    string
+	ranges []ByteRange
+	curr   io.Reader
+}
+
+func (s *s3RangeReader) Read(b []byte) (n int, err error) {
+	for {
+		n, err = s.curr.Read(b)
+		if err != io.EOF || len(s.ranges) == 0 {
+			return
+		}
+		if n > 0 {
+			return n, nil
+		}
+		s.curr, err = s.c.getRange(s.key, s.ranges[0])
+		if err != nil {
+			return
+		}
+		s.ranges = s.ranges[1:]
+	}
+}
+
+func (c *S3Connection) PutReader(key string, r io.Reader) (length int, err error) {
+	return uploadReader(c.uploader, key, r, c.retry)
+}
+
+// SetRetryPolicy changes how failed parts of multipart uploads are retried. (Whole requests are retried by the store.)
+func (c *S3Connection) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+}
+
+// S3 returns at most 1000 keys per list request.
+const c_LIST_MAX_KEYS = 1000
+
+func (c *S3Connection) List(prefix string) (map[string]int, error) {
+	list := make(map[string]int)
+	marker := ""
+	for {
+		resp, err := c.bucket.List(prefix, "", marker, c_LIST_MAX_KEYS)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range resp.Contents {
+			list[key.Key] = int(key.Size)
+			marker = key.Key
+		}
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return list, nil
+		}
 	}
-	length = int(n)
-	return
+}
+
+func (c *S3Connection) Delete(key string) error {
+	return c.bucket.Del(key)
 }
 
 func (c *S3Connection) IsNotExist(err error) bool {
@@ -110,3 +190,32 @@ func (c *S3Connection) IsNotExist(err error) bool {
 	}
 	return false
 }
+
+func (c *S3Connection) ErrorClass(err error) ErrorClass {
+	return s3ErrorClass(err)
+}
+
+func s3ErrorClass(err error) ErrorClass {
+	switch e := err.(type) {
+	case *s3.Error:
+		switch e.Code {
+		case "NoSuchKey", "NoSuchBucket":
+			return ErrorNotFound
+		case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken":
+			return ErrorAuth
+		case "SlowDown", "Throttling", "RequestLimitExceeded":
+			return ErrorThrottled
+		case "InternalError", "RequestTimeout", "ServiceUnavailable":
+			return ErrorTransient
+		}
+		return statusErrorClass(e.StatusCode)
+	case *HeadError:
+		return statusErrorClass(e.Response.StatusCode)
+	case net.Error:
+		return ErrorTransient // timeouts, connections reset, etc.
+	}
+	if err == io.ErrUnexpectedEOF {
+		return ErrorTransient
+	}
+	return ErrorPermanent
+}
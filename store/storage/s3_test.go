@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// An in-process fake of the S3 REST API, as much of it as uploads use, so that tests go through the real requests
+// and responses of the S3 client.
+type fakeS3 struct {
+	sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte // the parts of uploads in progress, by upload ID
+	attempts map[int]int               // part uploads, by part number
+	started  int
+	aborted  int
+	failPart func(n, attempt int) (status int, code string) // called on each part upload; 0 to carry on
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte), attempts: make(map[int]int)}
+}
+
+func s3ErrorResponse(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, http.StatusText(status))
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 || parts[0] != "bucket" {
+		s3ErrorResponse(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key, q := parts[1], r.URL.Query()
+	_, initMulti := q["uploads"]
+	id := q.Get("uploadId")
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s3ErrorResponse(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if id != "" && f.uploads[id] == nil {
+		s3ErrorResponse(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	switch {
+	case r.Method == "POST" && initMulti:
+		f.started += 1
+		id = strconv.Itoa(f.started)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId>"+
+			"</InitiateMultipartUploadResult>", key, id)
+	case r.Method == "PUT" && id != "":
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		f.attempts[n] += 1
+		if f.failPart != nil {
+			if status, code := f.failPart(n, f.attempts[n]); status != 0 {
+				s3ErrorResponse(w, status, code)
+				return
+			}
+		}
+		f.uploads[id][n] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+	case r.Method == "POST" && id != "":
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(data, &complete); err != nil {
+			s3ErrorResponse(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		sort.Slice(complete.Parts, func(i, j int) bool { return complete.Parts[i].PartNumber < complete.Parts[j].PartNumber })
+		var object []byte
+		for i, p := range complete.Parts {
+			part, ok := f.uploads[id][p.PartNumber]
+			if !ok || p.PartNumber != i+1 || p.ETag != fmt.Sprintf(`"%x"`, md5.Sum(part)) {
+				s3ErrorResponse(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, part...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, id)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+	case r.Method == "DELETE" && id != "":
+		delete(f.uploads, id)
+		f.aborted += 1
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		f.objects[key] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(data)))
+	default:
+		s3ErrorResponse(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// Connect to a fake S3 server. Close the server when done.
+func newFakeS3Connection() (*S3Connection, *fakeS3, *httptest.Server) {
+	fake := newFakeS3()
+	srv := httptest.NewServer(fake)
+	client := s3.New(aws.Auth{AccessKey: "access", SecretKey: "secret"}, aws.Region{Name: "fake", S3Endpoint: srv.URL})
+	b := client.Bucket("bucket")
+	c := &S3Connection{client, b, s3UploadBucket{b}, DefaultRetryPolicy}
+	c.SetRetryPolicy(quickRetries)
+	return c, fake, srv
+}
+
+// -----------------------------------------------------------------------------
+
+func TestS3Upload(t *testing.T) {
+	c, fake, srv := newFakeS3Connection()
+	defer srv.Close()
+	small := randomData(1 << 10)
+	n, err := c.PutReader("small", bytes.NewReader(small))
+	assert.NoError(t, err)
+	assert.Equal(t, len(small), n)
+	assert.Equal(t, small, fake.objects["small"])
+
+	big := randomData(2*c_PART_SIZE + 123)
+	n, err = c.PutReader("big", bytes.NewReader(big))
+	assert.NoError(t, err)
+	assert.Equal(t, len(big), n)
+	assert.True(t, bytes.Equal(big, fake.objects["big"]))
+	assert.Equal(t, map[int]int{1: 1, 2: 1, 3: 1}, fake.attempts)
+	assert.Empty(t, fake.uploads)
+}
+
+func TestS3UploadRetriesFailedParts(t *testing.T) {
+	c, fake, srv := newFakeS3Connection()
+	defer srv.Close()
+	fake.failPart = func(n, attempt int) (int, string) {
+		if n == 2 && attempt < quickRetries.Attempts {
+			return http.StatusServiceUnavailable, "SlowDown"
+		}
+		return 0, ""
+	}
+	data := randomData(3 * c_PART_SIZE)
+	_, err := c.PutReader("big", bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(data, fake.objects["big"]))
+	assert.Equal(t, quickRetries.Attempts, fake.attempts[2])
+	assert.Equal(t, 1, fake.attempts[1])
+
+	// Errors which retrying won't help fail the upload at once, and abort it.
+	fake.attempts = make(map[int]int)
+	fake.failPart = func(n, attempt int) (int, string) {
+		if n == 2 {
+			return http.StatusForbidden, "AccessDenied"
+		}
+		return 0, ""
+	}
+	_, err = c.PutReader("denied", bytes.NewReader(data))
+	assert.Equal(t, ErrorAuth, c.ErrorClass(err))
+	assert.Equal(t, 1, fake.attempts[2])
+	assert.Equal(t, 1, fake.aborted)
+	assert.Empty(t, fake.uploads)
+	assert.NotContains(t, fake.objects, "denied")
+}
@@ -0,0 +1,67 @@
+package storage
+
+// ByteRange is an offset pair (zero-indexed, inclusive) used when requesting partial contents of an object.
+// See http://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.35 for more details.
+type ByteRange [2]int
+
+// Len returns the number of bytes in the range.
+func (r ByteRange) Len() int {
+	return r[1] - r[0] + 1
+}
+
+// Merge ranges which follow on directly from each other, so they can be read together.
+func mergeRanges(ranges []ByteRange) (merged []ByteRange) {
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1][1]+1 == r[0] {
+			merged[n-1][1] = r[1]
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return
+}
+
+// ErrorClass says what kind of failure an error from a storage layer is, and so whether the request is worth retrying.
+type ErrorClass int
+
+const (
+	ErrorPermanent ErrorClass = iota // retrying won't help
+	ErrorTransient                   // network trouble, server errors, timeouts
+	ErrorThrottled                   // too many requests; back off for longer
+	ErrorAuth                        // bad credentials or permissions
+	ErrorNotFound                    // the object (or container) doesn't exist
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorTransient:
+		return "transient"
+	case ErrorThrottled:
+		return "throttled"
+	case ErrorAuth:
+		return "auth"
+	case ErrorNotFound:
+		return "not found"
+	}
+	return "permanent"
+}
+
+// Retryable returns true if a request which failed with this class of error might succeed if tried again.
+func (c ErrorClass) Retryable() bool {
+	return c == ErrorTransient || c == ErrorThrottled
+}
+
+// Classify an HTTP status code.
+func statusErrorClass(status int) ErrorClass {
+	switch {
+	case status == 404:
+		return ErrorNotFound
+	case status == 401 || status == 403:
+		return ErrorAuth
+	case status == 429 || status == 503:
+		return ErrorThrottled
+	case status == 408 || status >= 500:
+		return ErrorTransient
+	}
+	return ErrorPermanent
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"github.com/aviddiviner/inc/store/crypto"
 	"github.com/aviddiviner/inc/store/storage"
@@ -10,6 +11,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"strings"
 )
 
 // Error when attempting to unlock a store which hasn't been initialized.
@@ -18,12 +20,30 @@ var ErrStoreNotInitialized = errors.New("remote store not initialized")
 // Error when attempting to read/write from the store before it's been opened, unlocked or wiped.
 var ErrStoreNotConnected = errors.New("store not ready for reading/writing")
 
+// Error when reading from the store with write-only keys, which can only encrypt.
+var ErrWriteOnly = crypto.ErrWriteOnly
+
+// Error when opening a store made before store format 3 with write-only keys.
+var ErrWriteOnlyUnsupported = errors.New("store format doesn't support write-only keys")
+
+// Error when choosing the compression of a store made before store format 4, whose objects are always gzip.
+var ErrCompressionUnsupported = errors.New("store format doesn't support choosing the compression (it's always gzip)")
+
+// Error when opening a store with keys (or a password) other than the ones it was made with.
+var ErrWrongKey = errors.New("wrong password or keys for this store")
+
+// Error when writing the metadata of a store with no key check, before the keys were proven against any object in it.
+var ErrKeysUnverified = errors.New("keys not verified against the store; unable to write its metadata")
+
+// Error when opening a store whose metadata was written before it was authenticated, without AllowLegacyMetadata.
+var ErrLegacyMetadata = errors.New("the store metadata isn't authenticated; run `inc key upgrade-metadata` once to authenticate it")
+
 // Error when attempting to read/write to a forbidden key name (e.g. "metadata" which is used internally).
 var ErrForbiddenKey = errors.New("read/write to key name is forbidden")
 
 // ByteRange is an offset pair (zero-indexed, inclusive) used when requesting partial contents from the storage layer.
 // See http://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.35 for more details.
-type ByteRange [2]int
+type ByteRange = storage.ByteRange
 
 // StorageLayer is the interface used by the store for underlying storage.
 type StorageLayer interface {
@@ -40,9 +60,14 @@ type StorageLayer interface {
 	PutReader(key string, r io.Reader) (int, error)
 	// IsNotExist returns true if the error indicates an object does not exist.
 	IsNotExist(err error) bool
-
-	// GetReaderParts(key string, ranges []ByteRange) (io.Reader, error)
-	// Delete(key string) error
+	// ErrorClass says what kind of failure an error is, and so whether to retry the request.
+	ErrorClass(err error) storage.ErrorClass
+	// List returns the keys of all objects starting with prefix, with their (encrypted) content lengths.
+	List(prefix string) (map[string]int, error)
+	// Delete removes an object identified by key.
+	Delete(key string) error
+	// GetReaderParts returns the contents of some byte ranges of an object, one after the other.
+	GetReaderParts(key string, ranges []ByteRange) (io.Reader, error)
 }
 
 // S3Config has the configuration options for creating a new S3 connection.
@@ -59,19 +84,87 @@ type Keys struct {
 	AuthKey []byte `json:"authKey"` // base64 encoded at rest
 }
 
+// WriteOnlyKeys are enough to write to a store, but not to read from it; the public key that data is sealed to, and
+// the key for naming data by its contents. Hosts which only back up can keep these instead of the full keys.
+type WriteOnlyKeys struct {
+	PublicKey []byte `json:"publicKey,omitempty"` // base64 encoded at rest
+	HashKey   []byte `json:"hashKey,omitempty"`   // base64 encoded at rest
+}
+
+// WriteOnly returns the write-only keys derived from the keys.
+func (k Keys) WriteOnly() (wk WriteOnlyKeys, err error) {
+	wk.PublicKey, wk.HashKey, err = crypto.WriteOnlyKeys(k.AuthKey)
+	return
+}
+
+// IsEmpty returns true if there are no write-only keys.
+func (wk WriteOnlyKeys) IsEmpty() bool {
+	return len(wk.PublicKey) == 0
+}
+
 // -----------------------------------------------------------------------------
 
 // Store handles compressing, encrypting and uploading blobs to some storage medium.
 type Store struct {
 	layer StorageLayer
+	retry *retryLayer
 	id    string
 	meta  *storeMetadata
+	keys  Keys
 	enc   crypto.Crypter
+	mdkey *metadataKeys // for the store metadata
+
+	verified      bool // the keys passed the key check, or decrypted an object (see proveKeys)
+	allowLegacy   bool // read metadata without a MAC, to upgrade it
+	authenticated bool // the metadata we have was read with its MAC, or written with one
+	writeOnly     bool
+	compression   zip.Config
 }
 
-// NewStore returns a store using some storage layer.
+// NewStore returns a store using some storage layer. Failed requests are retried with the DefaultRetryPolicy.
 func NewStore(layer StorageLayer, id string) *Store {
-	return &Store{layer: layer, id: id}
+	retry := &retryLayer{StorageLayer: layer, policy: DefaultRetryPolicy}
+	return &Store{layer: retry, retry: retry, id: id, compression: zip.DefaultConfig}
+}
+
+// SetCompression changes how new objects are compressed; zstd at its default level, if not set. Stores made before
+// store format 4 are always compressed with gzip, which older versions of inc can read.
+func (s *Store) SetCompression(c zip.Config) {
+	s.compression = c
+}
+
+// CheckCompression returns ErrCompressionUnsupported if the store can't compress new objects as configured; stores
+// made before store format 4 only use gzip, at its default level. Call this once the store is opened.
+func (s *Store) CheckCompression(c zip.Config) error {
+	md, err := s.getStoreMetadata()
+	if err != nil && !s.layer.IsNotExist(err) {
+		return err
+	}
+	if md.StoreFormat < 4 && c != (zip.Config{Codec: zip.Gzip}) {
+		return ErrCompressionUnsupported
+	}
+	return nil
+}
+
+// SetRetryPolicy changes how failed requests to the storage layer are retried.
+func (s *Store) SetRetryPolicy(p RetryPolicy) {
+	s.retry.policy = p
+	// Layers which retry requests of their own (like the parts of S3 uploads) follow the same policy.
+	if l, ok := s.retry.StorageLayer.(interface{ SetRetryPolicy(RetryPolicy) }); ok {
+		l.SetRetryPolicy(p)
+	}
+}
+
+// Retry calls some (idempotent) function, which makes requests to the store, until it succeeds or fails with an
+// error not worth retrying, following the store's retry policy. Use this for requests which can't be retried by
+// the store itself, like Packer uploads.
+func (s *Store) Retry(op, key string, fn func() error) error {
+	return s.retry.do(op, key, fn)
+}
+
+// ErrorClass says what kind of failure an error from the store is.
+func (s *Store) ErrorClass(err error) storage.ErrorClass {
+	return s.layer.ErrorClass(err)
 }
 
 // NewStoreS3 returns a store using S3 as its storage layer.
@@ -114,13 +207,9 @@ func (s *Store) IsClean() bool {
 	return false
 }
 
-// Wipe initializes the store by (re)populating it with metadata/salt. All existing data will be lost!
-// This will be followed by a call to Open so the store will be ready for use.
+// Wipe initializes the store by (re)populating it with metadata and new random master keys, held in a key slot opened
+// by our secret. All existing data will be lost! The store will be opened, ready for use.
 func (s *Store) Wipe(secret []byte) (keys Keys, err error) {
-	salt, err := crypto.Salt()
-	if err != nil {
-		return
-	}
 	ok, err := s.layer.Exists()
 	if err != nil {
 		return
@@ -131,15 +220,27 @@ func (s *Store) Wipe(secret []byte) (keys Keys, err error) {
 			return
 		}
 	}
-	err = s.putStoreMetadata(newMetadata(salt))
+	if keys.EncKey, keys.AuthKey, err = crypto.RandomKeys(); err != nil {
+		return
+	}
+	slot, err := newKeySlot("", secret, keys, crypto.DefaultKDF)
+	if err != nil {
+		return
+	}
+	if s.mdkey, err = fullMetadataKeys(keys); err != nil {
+		return
+	}
+	s.keys, s.verified = keys, true // for the key check
+	err = s.putStoreMetadata(newMetadata(slot, crypto.DefaultKDF))
 	if err != nil {
 		return
 	}
-	return s.Unlock(secret)
+	err = s.Open(keys)
+	return
 }
 
-// Unlock reads the store metadata and returns encryption keys derived from our secret+salt.
-// This will be followed by a call to Open so the store will be ready for use.
+// Unlock reads the store metadata and returns the encryption keys opened by our secret (from one of its key slots).
+// This will be followed by a call to Open so the store will be ready for use (and the metadata authenticated).
 func (s *Store) Unlock(secret []byte) (keys Keys, err error) {
 	md, err := s.getStoreMetadata()
 	if err != nil {
@@ -148,12 +249,15 @@ func (s *Store) Unlock(secret []byte) (keys Keys, err error) {
 		}
 		return
 	}
-	keys.EncKey, keys.AuthKey = crypto.DeriveKeys(secret, md.Salt)
+	if keys, _, err = md.openKeys(secret); err != nil {
+		return
+	}
 	err = s.Open(keys)
 	return
 }
 
-// Open sets the encryption keys to use, tests that we can read from the store.
+// Open sets the encryption keys to use, and checks they're the store's. Returns ErrWrongKey if they aren't, or
+// ErrMetadataNotAuthentic if the store metadata was changed without the keys.
 func (s *Store) Open(keys Keys) (err error) {
 	ok, err := s.layer.Exists()
 	if err != nil {
@@ -162,26 +266,191 @@ func (s *Store) Open(keys Keys) (err error) {
 	if !ok {
 		return ErrStoreNotInitialized
 	}
-	enc, err := crypto.NewCrypter(keys.EncKey, keys.AuthKey)
+	mdKeys, err := fullMetadataKeys(keys)
 	if err != nil {
 		return
 	}
-	// TODO: Test we can decrypt something from the store. Maybe not a known plaintext, as that might compromise our crypto?
-	// We could derive other keys from the secret for this? Maybe not an issue:
-	// http://crypto.stackexchange.com/questions/3952/is-it-possible-to-obtain-aes-128-key-from-a-known-ciphertext-plaintext-pair
-	// http://crypto.stackexchange.com/questions/1512/why-is-aes-resistant-to-known-plaintext-attacks
+	// Stores since format 2 are encrypted with AEAD; older stores with AES-CBC and HMAC-SHA1. (The AEAD crypter can
+	// still read CBC ciphertexts.) Since format 3, we can also read data sealed with the write-only keys.
+	newCrypter := crypto.NewCrypter
+	s.meta = nil
+	md, err := s.getStoreMetadata()
+	found := err == nil
+	if found && md.StoreFormat > c_STORE_FORMAT {
+		return ErrBadVersion
+	}
+	if found {
+		err = md.checkKeys(keys)
+	}
+	if err == nil && found && md.KeyCheck != nil {
+		md, err = s.openStoreMetadata(mdKeys, md)
+	}
+	switch {
+	case s.layer.IsNotExist(err):
+		err = nil
+	case err != nil:
+		return
+	case md.StoreFormat > c_STORE_FORMAT:
+		return ErrBadVersion
+	case md.StoreFormat >= 3:
+		newCrypter = crypto.NewKeyPairCrypter
+	case md.StoreFormat >= 2:
+		newCrypter = crypto.NewAEADCrypter
+	}
+	enc, err := newCrypter(keys.EncKey, keys.AuthKey)
+	if err != nil {
+		return
+	}
+	// Without a key check, any keys get this far; they must decrypt something in the store before we trust them with
+	// its metadata (and before they write a key check of their own). A store with no metadata and nothing in it yet
+	// has no keys to lock out.
+	verified := md.KeyCheck != nil
+	if !verified {
+		empty, err := s.proveKeys(md, enc)
+		if err != nil {
+			return err
+		}
+		verified = !empty || !found
+	}
+	if found && md.KeyCheck == nil {
+		if md, err = s.openStoreMetadata(mdKeys, md); err != nil {
+			return
+		}
+	}
 	s.enc = enc
+	s.keys = keys
+	s.mdkey = mdKeys
+	s.verified = verified
+	s.writeOnly = false
 	return
 }
 
+// Check keys against a store with no key check, by decrypting one of its objects; the latest manifest, or else the
+// smallest object which isn't packed. Returns ErrWrongKey if the object doesn't decrypt, or empty if there's nothing
+// to check them against.
+func (s *Store) proveKeys(md storeMetadata, enc crypto.Crypter) (empty bool, err error) {
+	key := ""
+	if latest, _ := md.UserData["manifest/latest"].(string); latest != "" {
+		if _, err := s.layer.Size("manifest/" + latest); err == nil {
+			key = "manifest/" + latest
+		}
+	}
+	if key == "" {
+		objects, err := s.layer.List("")
+		if err != nil {
+			return false, err
+		}
+		size := -1
+		for k, n := range objects {
+			if isForbiddenKey(k) || strings.HasPrefix(k, c_LOCK_PREFIX) || strings.HasPrefix(k, "blob/") {
+				continue
+			}
+			if size < 0 || n < size || (n == size && k < key) {
+				key, size = k, n
+			}
+		}
+		if key == "" {
+			return true, nil
+		}
+	}
+	r, err := s.layer.GetReader(key)
+	if err != nil {
+		return
+	}
+	ciphertext, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+	if _, err = enc.Decrypt(ciphertext); err != nil {
+		log.Printf("store: keys fail to decrypt %s: %v\n", key, err)
+		return false, ErrWrongKey
+	}
+	return false, nil
+}
+
+// OpenWriteOnly sets the write-only keys to use. Data put in the store is sealed so that only the full keys can read
+// it; reading anything back returns ErrWriteOnly.
+func (s *Store) OpenWriteOnly(wk WriteOnlyKeys) (err error) {
+	ok, err := s.layer.Exists()
+	if err != nil {
+		return
+	}
+	if !ok {
+		return ErrStoreNotInitialized
+	}
+	mdKeys, err := newMetadataKeys(wk.HashKey, nil)
+	if err != nil {
+		return
+	}
+	s.meta = nil
+	md, err := s.getStoreMetadata()
+	switch {
+	case err == nil && md.StoreFormat < 3:
+		return ErrWriteOnlyUnsupported // and its metadata may be legacy, which we couldn't upgrade anyway
+	case err == nil:
+		md, err = s.openStoreMetadata(mdKeys, md)
+	}
+	switch {
+	case s.layer.IsNotExist(err):
+		return ErrStoreNotInitialized
+	case err != nil:
+		return
+	case md.StoreFormat > c_STORE_FORMAT:
+		return ErrBadVersion
+	}
+	enc, err := crypto.NewWriteOnlyCrypter(wk.PublicKey, wk.HashKey)
+	if err != nil {
+		return
+	}
+	s.enc = enc
+	s.keys = Keys{}
+	s.mdkey = mdKeys
+	s.verified = true // by the metadata MAC, which write-only stores always have
+	s.writeOnly = true
+	return
+}
+
+// IsWriteOnly returns true if the store was opened with write-only keys.
+func (s *Store) IsWriteOnly() bool { return s.writeOnly }
+
 func (s *Store) isConnected() bool { return s.enc != nil }
 
 func isForbiddenKey(key string) bool { return key == c_METADATA_KEY }
 
+// AllowLegacyMetadata lets the store be opened with metadata written before it was authenticated (by inc before store
+// format 2), to upgrade it. Otherwise, such metadata is refused; once a store's metadata is authenticated, an old
+// copy put back in its place would roll the store back, and strip the MAC.
+func (s *Store) AllowLegacyMetadata() {
+	s.allowLegacy = true
+}
+
+// MetadataAuthenticated returns true if the store metadata was read with a MAC, or has been written with one.
+func (s *Store) MetadataAuthenticated() bool {
+	return s.authenticated
+}
+
+// UpgradeMetadata writes the store metadata again, with its MACs and a key check. The keys must have been proven
+// against the store first.
+func (s *Store) UpgradeMetadata() error {
+	switch {
+	case s.mdkey == nil:
+		return ErrStoreNotConnected
+	case s.writeOnly:
+		return ErrWriteOnly
+	case !s.verified:
+		return ErrKeysUnverified
+	}
+	md, err := s.getStoreMetadata()
+	if err != nil {
+		return err
+	}
+	return s.putStoreMetadata(md)
+}
+
 // -----------------------------------------------------------------------------
 
-// PutMetadata writes some arbitrary (unencrypted) field to the store metadata. Ideally, this should be some small
-// configuration data or similar.
+// PutMetadata writes some arbitrary field to the store metadata, where it's encrypted. Ideally, this should be some
+// small configuration data or similar.
 func (s *Store) PutMetadata(key string, data interface{}) error {
 	return s.putUserMetadata(key, data)
 }
@@ -194,8 +463,41 @@ func (s *Store) GetMetadata(key string) (interface{}, error) {
 // -----------------------------------------------------------------------------
 
 // Put some blob as an object in the store. Returns the bytes written. Will overwrite existing keys.
+// Unlike PutReader, this is retried if it fails.
 func (s *Store) Put(key string, data []byte) (written int, err error) {
-	return s.PutReader(key, bytes.NewReader(data))
+	return s.put(key, data, s.compression)
+}
+
+// PutUncompressed puts a blob in the store like Put, but without compressing it; for data that's compressed already.
+// (Stores made before store format 4 compress it anyway.)
+func (s *Store) PutUncompressed(key string, data []byte) (written int, err error) {
+	return s.put(key, data, zip.Config{Codec: zip.None})
+}
+
+func (s *Store) put(key string, data []byte, c zip.Config) (written int, err error) {
+	if isForbiddenKey(key) {
+		err = ErrForbiddenKey
+		return
+	}
+	if !s.isConnected() {
+		err = ErrStoreNotConnected
+		return
+	}
+	compressed, err := s.compressReader(bytes.NewReader(data), c)
+	if err != nil {
+		return
+	}
+	r, err := s.enc.EncryptReader(compressed)
+	if err != nil {
+		return
+	}
+	ciphertext, err := ioutil.ReadAll(r) // so we can retry
+	if err != nil {
+		return
+	}
+	written, err = s.layer.PutReader(key, bytes.NewReader(ciphertext))
+	log.Printf("store: put: %s (%s)\n", key, util.ByteCount(written))
+	return
 }
 
 // PutReader reads data into an object in the store. Returns the bytes written. Will overwrite existing keys.
@@ -208,7 +510,7 @@ func (s *Store) PutReader(key string, r io.Reader) (written int, err error) {
 		err = ErrStoreNotConnected
 		return
 	}
-	data, err := zip.CompressReader(r)
+	data, err := s.compressReader(r, s.compression)
 	if err != nil {
 		return
 	}
@@ -221,6 +523,26 @@ func (s *Store) PutReader(key string, r io.Reader) (written int, err error) {
 	return
 }
 
+// Since store format 4, objects start with a byte saying how they're compressed. Older stores are all gzip, without
+// one; we keep to that, so older versions of inc can still read them.
+func (s *Store) compressReader(r io.Reader, c zip.Config) (io.Reader, error) {
+	md, err := s.getStoreMetadata()
+	if err == nil && md.StoreFormat >= 4 {
+		return c.CompressReader(r)
+	}
+	return zip.CompressReader(r)
+}
+
+// ContentKey returns a key name for some data, made from a keyed hash of it. The
+// same data always gets the same key (in this store), but the key doesn't give
+// away anything about the data.
+func (s *Store) ContentKey(data []byte) (string, error) {
+	if !s.isConnected() {
+		return "", ErrStoreNotConnected
+	}
+	return hex.EncodeToString(s.enc.Hash(data)), nil
+}
+
 // Get returns the data stored by the given key.
 func (s *Store) Get(key string) (data []byte, err error) {
 	r, err := s.GetReader(key)
@@ -252,6 +574,91 @@ func (s *Store) GetReader(key string) (data io.Reader, err error) {
 	return zip.DecompressReader(plaintext)
 }
 
+// GetReaderParts returns a reader for some of the blobs packed in an object (see Packer), given by their byte
+// ranges. Each blob is decrypted and decompressed in turn, and their data returned one after the other.
+func (s *Store) GetReaderParts(key string, ranges []ByteRange) (data io.Reader, err error) {
+	if isForbiddenKey(key) {
+		err = ErrForbiddenKey
+		return
+	}
+	if !s.isConnected() {
+		err = ErrStoreNotConnected
+		return
+	}
+	log.Printf("store: get.parts: %s (%d parts)\n", key, len(ranges))
+	ciphertext, err := s.layer.GetReaderParts(key, ranges)
+	if err != nil {
+		return
+	}
+	return &partsReader{s: s, text: ciphertext, ranges: ranges}, nil
+}
+
+// Reads the blobs in a stream of ciphertexts, one after the other.
+type partsReader struct {
+	s      *Store
+	text   io.Reader
+	ranges []ByteRange
+	plain  io.Reader // decrypted current blob
+	data   io.Reader // decompressed current blob
+}
+
+func (p *partsReader) Read(b []byte) (n int, err error) {
+	for {
+		if p.data == nil {
+			if len(p.ranges) == 0 {
+				return 0, io.EOF
+			}
+			p.plain, err = p.s.enc.DecryptReader(io.LimitReader(p.text, int64(p.ranges[0].Len())))
+			if err != nil {
+				return
+			}
+			p.data, err = zip.DecompressReader(p.plain)
+			if err != nil {
+				return
+			}
+			p.ranges = p.ranges[1:]
+		}
+		n, err = p.data.Read(b)
+		if err != io.EOF {
+			return
+		}
+		// The HMAC is only checked once all the ciphertext has been read.
+		if _, err = io.Copy(ioutil.Discard, p.plain); err != nil {
+			return
+		}
+		p.data = nil
+		if n > 0 {
+			return
+		}
+	}
+}
+
+// List returns the keys of all objects in the store starting with prefix, and their stored sizes.
+func (s *Store) List(prefix string) (objects map[string]int, err error) {
+	if !s.isConnected() {
+		err = ErrStoreNotConnected
+		return
+	}
+	objects, err = s.layer.List(prefix)
+	if err != nil {
+		return
+	}
+	delete(objects, c_METADATA_KEY)
+	return
+}
+
+// Delete removes an object from the store.
+func (s *Store) Delete(key string) error {
+	if isForbiddenKey(key) {
+		return ErrForbiddenKey
+	}
+	if !s.isConnected() {
+		return ErrStoreNotConnected
+	}
+	log.Printf("store: delete: %s\n", key)
+	return s.layer.Delete(key)
+}
+
 // IsNotExist returns a boolean indicating whether the error is because the object does not exist.
 func (s *Store) IsNotExist(err error) bool {
 	return s.layer.IsNotExist(err)
@@ -261,6 +668,15 @@ func (s *Store) IsNotExist(err error) bool {
 
 // Pack multiple blobs as a single object in the store. Will overwrite existing keys.
 func (s *Store) Pack(key string) (*Packer, error) {
+	return s.pack(key, s.compression)
+}
+
+// PackUncompressed packs blobs like Pack, but without compressing them; for data that's compressed already.
+func (s *Store) PackUncompressed(key string) (*Packer, error) {
+	return s.pack(key, zip.Config{Codec: zip.None})
+}
+
+func (s *Store) pack(key string, c zip.Config) (*Packer, error) {
 	if isForbiddenKey(key) {
 		return nil, ErrForbiddenKey
 	}
@@ -268,7 +684,7 @@ func (s *Store) Pack(key string) (*Packer, error) {
 		return nil, ErrStoreNotConnected
 	}
 	r, w := io.Pipe()
-	p := &Packer{s: s, key: key, r: r, w: w, err: make(chan error)}
+	p := &Packer{s: s, key: key, r: r, w: w, err: make(chan error), compression: c}
 	go func() {
 		_, err := s.layer.PutReader(key, r)
 		r.CloseWithError(err)
@@ -285,6 +701,9 @@ type Packer struct {
 	w   *io.PipeWriter
 	err chan error
 
+	compression zip.Config
+
+	offset   int // bytes written so far
 	closed   bool
 	closeErr error
 	// sync.Mutex
@@ -292,7 +711,7 @@ type Packer struct {
 
 // PutReader reads data into the object. Returns the bytes written.
 func (p *Packer) PutReader(r io.Reader) (written int, err error) {
-	data, err := zip.CompressReader(r)
+	data, err := p.s.compressReader(r, p.compression)
 	if err != nil {
 		p.closeWriter(err)
 		return
@@ -311,10 +730,23 @@ func (p *Packer) PutReader(r io.Reader) (written int, err error) {
 		return
 	}
 	written = int(n)
+	p.offset += written
 	// log.Printf("store: put.packer: %s (%s)\n", p.key, util.ByteCount(written)) // TODO: Debug logging
 	return
 }
 
+// PutReaderRange reads data into the object, like PutReader, returning the byte range it was stored at. The data
+// can be read back on its own with Store.GetReaderParts.
+func (p *Packer) PutReaderRange(r io.Reader) (rng ByteRange, err error) {
+	start := p.offset
+	written, err := p.PutReader(r)
+	if err != nil {
+		return
+	}
+	rng = ByteRange{start, start + written - 1}
+	return
+}
+
 // Close finishes writing, returning any last errors.
 func (p *Packer) Close() error {
 	p.closeWriter(nil)
@@ -2,8 +2,13 @@ package store
 
 import (
 	"bytes"
+	"github.com/aviddiviner/inc/store/crypto"
 	"github.com/aviddiviner/inc/store/storage"
+	"github.com/aviddiviner/inc/store/zip"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"testing/iotest"
 )
@@ -30,6 +35,23 @@ func useStoreRW(t *testing.T, store *Store) {
 	assert.Equal(t, testData, got)
 }
 
+// A store from before key checks, with a manifest its keys can be proven against.
+func putLegacyStore(t *testing.T, layer *storage.MockStorage) {
+	enc, err := crypto.NewCrypter(testCryptoKeys.EncKey, testCryptoKeys.AuthKey)
+	assert.NoError(t, err)
+	manifest, err := enc.Encrypt([]byte("manifest"))
+	assert.NoError(t, err)
+	layer.PutString(c_METADATA_KEY, testMetadata)
+	layer.PutString("manifest/latest", string(manifest))
+}
+
+// A store allowed to open legacy metadata, to upgrade it.
+func legacyStore(layer StorageLayer) *Store {
+	s := NewStore(layer, "test")
+	s.AllowLegacyMetadata()
+	return s
+}
+
 func TestWipeAndUseStore(t *testing.T) {
 	store := NewStore(storage.NewMockStorage(), "test")
 	keys, err := store.Wipe(testSecret)
@@ -41,7 +63,7 @@ func TestWipeAndUseStore(t *testing.T) {
 
 func TestUnlockAndUseStore(t *testing.T) {
 	layer := storage.NewMockStorage()
-	store := NewStore(layer, "test")
+	store := legacyStore(layer)
 
 	// Unlock without metadata
 	keys, err := store.Unlock(testSecret)
@@ -82,6 +104,80 @@ func TestUnlockWithBadMetadata(t *testing.T) {
 	assert.EqualError(t, err, ErrBadVersion.Error())
 }
 
+func TestOpenWithWrongKey(t *testing.T) {
+	layer := storage.NewMockStorage()
+	store := NewStore(layer, "test")
+	keys, err := store.Wipe(testSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrWrongKey, NewStore(layer, "test").Open(testCryptoKeys))
+	assert.Equal(t, ErrWrongKey, NewStore(layer, "test").Open(Keys{EncKey: testCryptoKeys.EncKey, AuthKey: keys.AuthKey}))
+	assert.NoError(t, NewStore(layer, "test").Open(keys))
+	_, err = NewStore(layer, "test").Unlock([]byte("wrong password"))
+	assert.Equal(t, ErrWrongKey, err, "no key slot opens")
+
+	// Older stores have no key check; the keys must decrypt the latest manifest instead, or nothing is written with
+	// them. They get a key check the first time their metadata is written.
+	layer = storage.NewMockStorage()
+	putLegacyStore(t, layer)
+	_, err = legacyStore(layer).Unlock([]byte("wrong password"))
+	assert.Equal(t, ErrWrongKey, err)
+	raw, _ := layer.GetReader(c_METADATA_KEY)
+	data, _ := ioutil.ReadAll(raw)
+	assert.Equal(t, testMetadata, string(data))
+	store = legacyStore(layer)
+	_, err = store.Unlock(testSecret)
+	assert.NoError(t, err)
+	assert.NoError(t, store.PutMetadata("foo", "bar"))
+	_, err = NewStore(layer, "test").Unlock([]byte("wrong password"))
+	assert.Equal(t, ErrWrongKey, err)
+	_, err = NewStore(layer, "test").Unlock(testSecret)
+	assert.NoError(t, err)
+
+	// Once authenticated, the old metadata can't be put back; it would roll the store back, and strip its MAC.
+	layer.PutString(c_METADATA_KEY, testMetadata)
+	_, err = NewStore(layer, "test").Unlock(testSecret)
+	assert.Equal(t, ErrLegacyMetadata, err)
+
+	// With nothing to prove them against, the keys are taken, but write no key check which could lock out others.
+	layer = storage.NewMockStorage()
+	layer.PutString(c_METADATA_KEY, testMetadata)
+	store = legacyStore(layer)
+	_, err = store.Unlock([]byte("wrong password"))
+	assert.NoError(t, err)
+	assert.NoError(t, store.PutMetadata("foo", "bar"))
+	_, err = store.AddKeySlot("", []byte("another password"))
+	assert.Equal(t, ErrKeysUnverified, err)
+	_, err = legacyStore(layer).Unlock(testSecret)
+	assert.NoError(t, err)
+}
+
+func TestUpgradeMetadata(t *testing.T) {
+	layer := storage.NewMockStorage()
+	putLegacyStore(t, layer)
+
+	// Legacy metadata is only opened to upgrade it.
+	_, err := NewStore(layer, "test").Unlock(testSecret)
+	assert.Equal(t, ErrLegacyMetadata, err)
+	store := legacyStore(layer)
+	_, err = store.Unlock(testSecret)
+	assert.NoError(t, err)
+	assert.False(t, store.MetadataAuthenticated())
+	assert.NoError(t, store.UpgradeMetadata())
+	assert.True(t, store.MetadataAuthenticated())
+	other := NewStore(layer, "test")
+	_, err = other.Unlock(testSecret)
+	assert.NoError(t, err)
+	assert.True(t, other.MetadataAuthenticated())
+
+	// Until the keys are proven, it can't be.
+	layer = storage.NewMockStorage()
+	layer.PutString(c_METADATA_KEY, testMetadata)
+	store = legacyStore(layer)
+	_, err = store.Unlock(testSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrKeysUnverified, store.UpgradeMetadata())
+}
+
 func TestUseBeforeOpen(t *testing.T) {
 	store := NewStore(storage.NewMockStorage(), "test")
 
@@ -144,3 +240,241 @@ func TestPackerErrors(t *testing.T) {
 	assert.Error(t, err)
 	assert.True(t, store.IsNotExist(err))
 }
+
+func useStoreListAndDelete(t *testing.T, store *Store) {
+	for _, key := range []string{"blob/a/0", "blob/a/1", "blob/b/0", "manifest/a"} {
+		_, err := store.Put(key, testData)
+		assert.NoError(t, err)
+	}
+
+	list, err := store.List("blob/")
+	assert.NoError(t, err)
+	assert.Len(t, list, 3)
+	assert.NotZero(t, list["blob/a/1"])
+
+	assert.NoError(t, store.Delete("blob/a/1"))
+	assert.Equal(t, ErrForbiddenKey, store.Delete(c_METADATA_KEY))
+
+	_, err = store.Get("blob/a/1")
+	assert.True(t, store.IsNotExist(err))
+	assert.True(t, store.IsNotExist(store.Delete("blob/a/1")))
+
+	list, err = store.List("")
+	assert.NoError(t, err)
+	assert.Len(t, list, 3)
+	assert.NotContains(t, list, c_METADATA_KEY)
+}
+
+func TestListAndDelete(t *testing.T) {
+	store := NewStore(storage.NewMockStorage(), "test")
+	_, err := store.Wipe(testSecret)
+	assert.NoError(t, err)
+
+	useStoreListAndDelete(t, store)
+}
+
+func TestListAndDeleteFS(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	store := NewStore(storage.NewFileStorage(root), "test")
+	_, err = store.Wipe(testSecret)
+	assert.NoError(t, err)
+
+	useStoreListAndDelete(t, store)
+
+	size, err := store.layer.Size("blob/a/0")
+	assert.NoError(t, err)
+	assert.NotZero(t, size)
+
+	// Empty folders get cleaned up.
+	assert.NoError(t, store.Delete("blob/b/0"))
+	_, err = os.Stat(filepath.Join(root, "blob/b"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(root, "blob"))
+	assert.NoError(t, err)
+}
+
+func useStorePackedRanges(t *testing.T, store *Store) {
+	packer, err := store.Pack("blob/a/0")
+	assert.NoError(t, err)
+
+	blobs := [][]byte{[]byte("first"), testData, []byte("third"), []byte("fourth")}
+	var ranges []ByteRange
+	for _, blob := range blobs {
+		rng, err := packer.PutReaderRange(bytes.NewReader(blob))
+		assert.NoError(t, err)
+		ranges = append(ranges, rng)
+	}
+	assert.NoError(t, packer.Close())
+	assert.Equal(t, 0, ranges[0][0])
+	assert.Equal(t, ranges[0][1]+1, ranges[1][0])
+
+	r, err := store.GetReaderParts("blob/a/0", ranges[1:2])
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, testData, got)
+
+	r, err = store.GetReaderParts("blob/a/0", []ByteRange{ranges[0], ranges[2], ranges[3]})
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "firstthirdfourth", string(got))
+
+	// A range that isn't a whole blob doesn't decrypt.
+	r, err = store.GetReaderParts("blob/a/0", []ByteRange{{ranges[1][0], ranges[1][1] - 1}})
+	if err == nil {
+		_, err = ioutil.ReadAll(r)
+	}
+	assert.Error(t, err)
+
+	_, err = store.GetReaderParts("blob/a/1", ranges[:1])
+	assert.True(t, store.IsNotExist(err))
+}
+
+func TestPackedRanges(t *testing.T) {
+	store := NewStore(storage.NewMockStorage(), "test")
+	store.Open(testCryptoKeys)
+
+	useStorePackedRanges(t, store)
+}
+
+func TestPackedRangesFS(t *testing.T) {
+	root, err := ioutil.TempDir("", "go-test-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	store := NewStore(storage.NewFileStorage(root), "test")
+	_, err = store.Wipe(testSecret)
+	assert.NoError(t, err)
+
+	useStorePackedRanges(t, store)
+}
+
+func TestStoreFormats(t *testing.T) {
+	layer := storage.NewMockStorage()
+	store := NewStore(layer, "test")
+	_, err := store.Wipe(testSecret)
+	assert.NoError(t, err)
+	useStoreRW(t, store)
+	r, _ := layer.GetReader("test")
+	raw, _ := ioutil.ReadAll(r)
+	assert.True(t, bytes.HasPrefix(raw, []byte("inc\x00gcm")), "new stores use AEAD")
+
+	// Older stores carry on with CBC.
+	layer = storage.NewMockStorage()
+	layer.PutString(c_METADATA_KEY, testMetadata)
+	store = legacyStore(layer)
+	_, err = store.Unlock(testSecret)
+	assert.NoError(t, err)
+	useStoreRW(t, store)
+	r, _ = layer.GetReader("test")
+	raw, _ = ioutil.ReadAll(r)
+	assert.False(t, bytes.HasPrefix(raw, []byte("inc\x00gcm")))
+
+	layer.PutString(c_METADATA_KEY, `{"version":1,"storeFormat":5,"salt":"5+ZOMGkPADM="}`)
+	_, err = NewStore(layer, "test").Unlock(testSecret)
+	assert.Equal(t, ErrBadVersion, err)
+}
+
+func TestCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("all work and no play makes jack a dull boy\n"), 1000)
+	layer := storage.NewMockStorage()
+	store := NewStore(layer, "test")
+	keys, err := store.Wipe(testSecret)
+	assert.NoError(t, err)
+
+	sizes := make(map[zip.Codec]int)
+	for _, c := range []zip.Config{{Codec: zip.None}, {Codec: zip.Gzip}, {Codec: zip.Zstd, Level: 19}} {
+		assert.NoError(t, store.CheckCompression(c))
+		store.SetCompression(c)
+		sizes[c.Codec], err = store.Put("test", data)
+		assert.NoError(t, err)
+
+		// Whatever the codec, other hosts read it back.
+		other := NewStore(layer, "test")
+		assert.NoError(t, other.Open(keys))
+		got, err := other.Get("test")
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+	}
+	assert.True(t, sizes[zip.None] > len(data))
+	assert.True(t, sizes[zip.Zstd] < sizes[zip.Gzip])
+
+	// Data that's compressed already can be stored as it is.
+	n, err := store.PutUncompressed("raw", data)
+	assert.NoError(t, err)
+	assert.Equal(t, sizes[zip.None], n)
+	packer, err := store.PackUncompressed("packed")
+	assert.NoError(t, err)
+	rng, err := packer.PutReaderRange(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.NoError(t, packer.Close())
+	assert.True(t, rng.Len() > len(data))
+	got, err := store.Get("raw")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// Older stores are always gzip, without the codec byte.
+	layer = storage.NewMockStorage()
+	layer.PutString(c_METADATA_KEY, testMetadata)
+	store = legacyStore(layer)
+	_, err = store.Unlock(testSecret)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrCompressionUnsupported, store.CheckCompression(zip.Config{Codec: zip.None}))
+	assert.Equal(t, ErrCompressionUnsupported, store.CheckCompression(zip.Config{Codec: zip.Gzip, Level: 9}))
+	assert.NoError(t, store.CheckCompression(zip.Config{Codec: zip.Gzip}))
+	store.SetCompression(zip.Config{Codec: zip.None})
+	n, err = store.PutUncompressed("test", data)
+	assert.NoError(t, err)
+	assert.True(t, n < len(data)/10)
+	got, err = store.Get("test")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestWriteOnlyKeys(t *testing.T) {
+	layer := storage.NewMockStorage()
+	store := NewStore(layer, "test")
+	keys, err := store.Wipe(testSecret)
+	assert.NoError(t, err)
+	wk, err := keys.WriteOnly()
+	assert.NoError(t, err)
+	useStoreRW(t, store)
+	hash, _ := store.ContentKey(testData)
+
+	// Write with the write-only keys; they can't read anything back, not even what they wrote.
+	writer := NewStore(layer, "test")
+	assert.NoError(t, writer.OpenWriteOnly(wk))
+	assert.True(t, writer.IsWriteOnly())
+	_, err = writer.Put("sealed", testData)
+	assert.NoError(t, err)
+	_, err = writer.Get("sealed")
+	assert.Equal(t, ErrWriteOnly, err)
+	_, err = writer.Get("test")
+	assert.Equal(t, ErrWriteOnly, err)
+	got, _ := writer.ContentKey(testData)
+	assert.Equal(t, hash, got, "content is named alike")
+	_, err = writer.AddKeySlot("", []byte("another password"))
+	assert.Equal(t, ErrWriteOnly, err)
+
+	// Locks can be shared with hosts holding the full keys.
+	lock, err := writer.Lock(false)
+	assert.NoError(t, err)
+	locks, err := store.ListLocks()
+	assert.NoError(t, err)
+	assert.Len(t, locks, 1)
+	assert.NoError(t, lock.Unlock())
+
+	// The full keys read what was written.
+	got2, err := store.Get("sealed")
+	assert.NoError(t, err)
+	assert.Equal(t, testData, got2)
+
+	// Older stores can't be written with write-only keys.
+	layer = storage.NewMockStorage()
+	layer.PutString(c_METADATA_KEY, testMetadata)
+	assert.Equal(t, ErrWriteOnlyUnsupported, NewStore(layer, "test").OpenWriteOnly(wk))
+}
@@ -1,52 +1,217 @@
 package zip
 
 import (
+	"bufio"
 	"compress/gzip"
+	"errors"
+	"fmt"
 	"github.com/aviddiviner/inc/util"
+	"github.com/klauspost/compress/zstd"
 	"io"
+	"strconv"
+	"strings"
 )
 
+// Error when decompressing a stream which starts with an unknown codec byte.
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
 const c_COMPRESS_LEVEL = gzip.DefaultCompression
 
 // The amount of uncompressed bytes to read before flushing the gzip buffer.
 // Note: this affects compression ratios, so the more we read in, the better.
 const c_FLUSH_SIZE = 65535
 
+// Codec is the compression of a stream, given by the byte it starts with.
+type Codec byte
+
+const (
+	None Codec = iota
+	Gzip
+	Zstd
+)
+
+// Streams compressed before the codec byte are gzip, without one; they start with the gzip magic number instead.
+const c_GZIP_MAGIC = 0x1f
+
+var codecNames = map[Codec]string{None: "none", Gzip: "gzip", Zstd: "zstd"}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// Config says how to compress streams; with which codec, and at which level (0 for the codec's default). Gzip
+// levels go from 1 (fastest) to 9 (smallest); zstd levels from 1 to 22, as with the zstd command.
+type Config struct {
+	Codec Codec
+	Level int
+}
+
+// The default is zstd, at its default level; it's faster than gzip, and compresses better.
+var DefaultConfig = Config{Codec: Zstd}
+
+func (c Config) String() string {
+	if c.Level == 0 || c.Codec == None {
+		return c.Codec.String()
+	}
+	return fmt.Sprintf("%s:%d", c.Codec, c.Level)
+}
+
+// ParseConfig reads a codec and level, given as "zstd", "gzip:9", "none" and so on.
+func ParseConfig(val string) (c Config, err error) {
+	name, level := val, ""
+	if i := strings.IndexByte(val, ':'); i >= 0 {
+		name, level = val[:i], val[i+1:]
+	}
+	found := false
+	for codec, n := range codecNames {
+		if strings.EqualFold(name, n) {
+			c.Codec, found = codec, true
+		}
+	}
+	if level != "" && found {
+		c.Level, err = strconv.Atoi(level)
+	}
+	if !found || err != nil || c.Validate() != nil {
+		return Config{}, fmt.Errorf("unable to parse compression: %q", val)
+	}
+	return
+}
+
+// Validate returns an error if the level is out of range for the codec.
+func (c Config) Validate() error {
+	max := 0
+	switch c.Codec {
+	case Gzip:
+		max = gzip.BestCompression
+	case Zstd:
+		max = 22
+	case None:
+	default:
+		return ErrUnknownCodec
+	}
+	if c.Level < 0 || c.Level > max {
+		return fmt.Errorf("%s compression level %d out of range", c.Codec, c.Level)
+	}
+	return nil
+}
+
+type compressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// A writer which doesn't compress.
+type nopCompressor struct{ io.Writer }
+
+func (nopCompressor) Flush() error { return nil }
+func (nopCompressor) Close() error { return nil }
+
+func (c Config) newWriter(w io.Writer) (compressWriter, error) {
+	switch c.Codec {
+	case Gzip:
+		level := c.Level
+		if level == 0 {
+			level = c_COMPRESS_LEVEL
+		}
+		return gzip.NewWriterLevel(w, level)
+	case Zstd:
+		level := zstd.SpeedDefault
+		if c.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	case None:
+		return nopCompressor{w}, nil
+	}
+	return nil, ErrUnknownCodec
+}
+
+// Compress the input stream to a pipe, flushing at regular intervals of ~64KB.
+func compressPipe(in io.Reader, w *io.PipeWriter, zw compressWriter) {
+	for {
+		if _, err := io.CopyN(zw, in, c_FLUSH_SIZE); err != nil {
+			if err == io.EOF {
+				break
+			}
+			w.CloseWithError(err)
+			return
+		}
+		zw.Flush()
+	}
+	// Finished compressing. Close the compressor and write pipe.
+	if err := zw.Close(); err != nil {
+		w.CloseWithError(err)
+		return
+	}
+	w.Close()
+}
+
 // CompressReader reads from a stream and compresses using gzip at the default
-// compression ratio.  Will flush to output at regular intervals of ~64KB.
+// compression ratio, with no codec byte; as streams were before it, for stores
+// which older versions of inc still read. Will flush to output at regular
+// intervals of ~64KB.
 func CompressReader(in io.Reader) (out io.Reader, err error) {
 	r, w := io.Pipe()
 	gz, err := gzip.NewWriterLevel(w, c_COMPRESS_LEVEL)
 	if err != nil {
 		return
 	}
+	go compressPipe(in, w, gz)
+	return r, nil
+}
+
+// CompressReader reads from a stream and compresses it with the codec, writing
+// the codec byte first. Will flush to output at regular intervals of ~64KB.
+func (c Config) CompressReader(in io.Reader) (out io.Reader, err error) {
+	r, w := io.Pipe()
+	zw, err := c.newWriter(w)
+	if err != nil {
+		return
+	}
 	go func() {
-		// Compress input steam, flushing at regular intervals during the copy.
-		for {
-			if _, err = io.CopyN(gz, in, c_FLUSH_SIZE); err != nil {
-				if err == io.EOF {
-					break
-				}
-				w.CloseWithError(err)
-				return
-			}
-			gz.Flush()
-		}
-		// Finished compressing. Close gzip and write pipe.
-		if err := gz.Close(); err != nil {
+		if _, err := w.Write([]byte{byte(c.Codec)}); err != nil {
 			w.CloseWithError(err)
 			return
 		}
-		w.Close()
+		compressPipe(in, w, zw)
 	}()
 	return r, nil
 }
 
-// DecompressReader read from a stream and decompresses using gzip.
+// DecompressReader reads from a stream and decompresses it with the codec its
+// first byte gives; or with gzip, for streams from before the codec byte.
 func DecompressReader(in io.Reader) (out io.Reader, err error) {
+	br := bufio.NewReader(in)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == c_GZIP_MAGIC {
+		return decompressGzip(br)
+	}
+	br.Discard(1)
+	switch Codec(first[0]) {
+	case Gzip:
+		return decompressGzip(br)
+	case Zstd:
+		dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &util.AutoCloseReader{RC: dec.IOReadCloser()}, nil
+	case None:
+		return br, nil
+	}
+	return nil, ErrUnknownCodec
+}
+
+func decompressGzip(in io.Reader) (out io.Reader, err error) {
 	rc, err := gzip.NewReader(in)
 	if err != nil {
 		return
 	}
-	return &util.AutoCloseReader{rc}, nil
+	return &util.AutoCloseReader{RC: rc}, nil
 }
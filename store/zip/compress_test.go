@@ -3,6 +3,7 @@ package zip
 import (
 	"bytes"
 	"compress/gzip"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"testing"
@@ -63,3 +64,67 @@ func decompress(t *testing.T, data []byte) []byte {
 	assert.NoError(t, r.Close())
 	return out
 }
+
+// A sample which compresses alike every time, unlike the random words.
+func logLines(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "%05d GET /static/page-%d.html 200 %d\n", i, i%37, i*7919%4096)
+	}
+	return buf.Bytes()
+}
+
+func TestCodecs(t *testing.T) {
+	sample := logLines(5000)
+	sizes := make(map[Config]int)
+	for _, c := range []Config{{Codec: None}, {Codec: Gzip}, {Codec: Gzip, Level: 1}, {Codec: Zstd}, {Codec: Zstd, Level: 19}} {
+		r, err := c.CompressReader(bytes.NewReader(sample))
+		assert.NoError(t, err, c.String())
+		zipped, err := ioutil.ReadAll(iotest.OneByteReader(r))
+		assert.NoError(t, err, c.String())
+		assert.Equal(t, byte(c.Codec), zipped[0], "starts with the codec byte")
+		sizes[c] = len(zipped)
+
+		r, err = DecompressReader(bytes.NewReader(zipped))
+		assert.NoError(t, err, c.String())
+		unzipped, err := ioutil.ReadAll(iotest.OneByteReader(r))
+		assert.NoError(t, err, c.String())
+		assert.Equal(t, sample, unzipped, "decompresses back to the original")
+	}
+	// It's enough that each codec shrinks the sample; how they compare depends on it.
+	for c, size := range sizes {
+		if c.Codec == None {
+			assert.Equal(t, len(sample)+1, size)
+		} else {
+			assert.True(t, size < len(sample)/2, "%s compresses", c)
+		}
+	}
+
+	// Streams from before the codec byte are gzip.
+	r, err := DecompressReader(bytes.NewReader(compress(t, sample)))
+	assert.NoError(t, err)
+	unzipped, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, sample, unzipped)
+
+	_, err = DecompressReader(bytes.NewReader([]byte{0x7f, 1, 2, 3}))
+	assert.Equal(t, ErrUnknownCodec, err)
+}
+
+func TestParseConfig(t *testing.T) {
+	for val, expected := range map[string]Config{
+		"zstd":    {Codec: Zstd},
+		"zstd:19": {Codec: Zstd, Level: 19},
+		"GZIP:9":  {Codec: Gzip, Level: 9},
+		"none":    {Codec: None},
+	} {
+		c, err := ParseConfig(val)
+		assert.NoError(t, err, val)
+		assert.Equal(t, expected, c, val)
+	}
+	for _, val := range []string{"", "lz4", "gzip:10", "zstd:23", "zstd:-1", "zstd:fast", "none:3"} {
+		_, err := ParseConfig(val)
+		assert.Error(t, err, val)
+	}
+	assert.Equal(t, "zstd:19", Config{Codec: Zstd, Level: 19}.String())
+}
@@ -0,0 +1,68 @@
+package zip
+
+import (
+	"bytes"
+	"math"
+)
+
+// SampleSize is how much of the start of some data Incompressible looks at.
+const SampleSize = 64 << 10
+
+// Samples smaller than this say too little by their entropy; they're taken to be compressible.
+const c_MIN_ENTROPY_SAMPLE = 1 << 10
+
+// Data with more entropy than this (in bits per byte, out of 8) is taken to be compressed or encrypted already.
+const c_MAX_ENTROPY = 7.5
+
+// The magic numbers at the start of formats which are compressed already.
+var compressedMagic = []struct {
+	offset int
+	magic  []byte
+}{
+	{0, []byte{0x1f, 0x8b}},                       // gzip
+	{0, []byte{0x28, 0xb5, 0x2f, 0xfd}},           // zstd
+	{0, []byte{0x04, 0x22, 0x4d, 0x18}},           // lz4
+	{0, []byte("BZh")},                            // bzip2
+	{0, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},   // xz
+	{0, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}}, // 7-zip
+	{0, []byte("PK\x03\x04")},                     // zip (and docx, jar, epub, ...)
+	{0, []byte("Rar!\x1a\x07")},                   // rar
+	{0, []byte{0xff, 0xd8, 0xff}},                 // jpeg
+	{0, []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a}},  // png
+	{0, []byte("GIF8")},                           // gif
+	{8, []byte("WEBP")},                           // webp
+	{4, []byte("ftyp")},                           // mp4, mov, m4a, heic, ...
+	{0, []byte{0x1a, 0x45, 0xdf, 0xa3}},           // matroska, webm
+	{0, []byte("OggS")},                           // ogg, opus
+	{0, []byte("fLaC")},                           // flac
+	{0, []byte("ID3")},                            // mp3
+}
+
+// Incompressible guesses, from a sample of the start of some data, whether compressing it would gain little; it's in
+// a compressed format (by its magic number), or looks random enough that it may as well be.
+func Incompressible(sample []byte) bool {
+	for _, m := range compressedMagic {
+		if len(sample) >= m.offset+len(m.magic) && bytes.Equal(sample[m.offset:m.offset+len(m.magic)], m.magic) {
+			return true
+		}
+	}
+	if len(sample) > SampleSize {
+		sample = sample[:SampleSize]
+	}
+	return len(sample) >= c_MIN_ENTROPY_SAMPLE && entropy(sample) > c_MAX_ENTROPY
+}
+
+// The Shannon entropy of the bytes of data, in bits per byte.
+func entropy(data []byte) (bits float64) {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / float64(len(data))
+			bits -= p * math.Log2(p)
+		}
+	}
+	return
+}
@@ -0,0 +1,29 @@
+package zip
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestIncompressible(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+	assert.True(t, Incompressible(random), "random data")
+	assert.False(t, Incompressible(random[:100]), "too little to tell")
+	assert.False(t, Incompressible(sample), "text")
+	assert.False(t, Incompressible(nil))
+
+	r, _ := DefaultConfig.CompressReader(bytes.NewReader(sample))
+	zipped, _ := ioutil.ReadAll(r)
+	assert.True(t, Incompressible(zipped[1:]), "zstd, by its magic number")
+	assert.True(t, Incompressible(compress(t, sample)), "gzip, by its magic number")
+	assert.True(t, Incompressible([]byte("\xff\xd8\xff\xe0\x00\x10JFIF")), "jpeg")
+	assert.True(t, Incompressible([]byte("RIFF\x00\x00\x00\x00WEBPVP8 ")), "webp")
+
+	assert.InDelta(t, 0, entropy(bytes.Repeat([]byte("a"), 100)), 0.001)
+	assert.InDelta(t, 1, entropy([]byte("abababab")), 0.001)
+	assert.InDelta(t, 8, entropy(random), 0.1)
+}
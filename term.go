@@ -0,0 +1,66 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// Get or set the terminal settings of a file descriptor (see tcgetattr and tcsetattr).
+func termios(fd uintptr, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTerminal returns true if the file is a terminal.
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	return termios(f.Fd(), c_IOCTL_GET_TERMIOS, &t) == nil
+}
+
+// Read a line typed in at the terminal, with echo turned off.
+func readNoEcho(f *os.File, in *bufio.Reader) (string, error) {
+	var old syscall.Termios
+	if err := termios(f.Fd(), c_IOCTL_GET_TERMIOS, &old); err != nil {
+		return "", err
+	}
+	noEcho := old
+	noEcho.Lflag &^= syscall.ECHO
+	noEcho.Lflag |= syscall.ICANON | syscall.ISIG
+	// Turn echo back on if we're interrupted while it's off, rather than leave the terminal without it.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan bool)
+	defer func() {
+		signal.Stop(signals)
+		close(done)
+	}()
+	go func() {
+		select {
+		case sig := <-signals:
+			termios(f.Fd(), c_IOCTL_SET_TERMIOS, &old)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(128 + int(sig.(syscall.Signal)))
+		case <-done:
+		}
+	}()
+
+	if err := termios(f.Fd(), c_IOCTL_SET_TERMIOS, &noEcho); err != nil {
+		return "", err
+	}
+	line, err := in.ReadString('\n')
+	termios(f.Fd(), c_IOCTL_SET_TERMIOS, &old)
+	fmt.Fprintln(os.Stderr)
+	if err != nil && line == "" {
+		return "", err
+	}
+	return firstLine([]byte(line)), nil
+}
@@ -0,0 +1,10 @@
+// +build darwin
+
+package main
+
+import "syscall"
+
+const (
+	c_IOCTL_GET_TERMIOS = syscall.TIOCGETA
+	c_IOCTL_SET_TERMIOS = syscall.TIOCSETA
+)
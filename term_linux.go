@@ -0,0 +1,10 @@
+// +build linux
+
+package main
+
+import "syscall"
+
+const (
+	c_IOCTL_GET_TERMIOS = syscall.TCGETS
+	c_IOCTL_SET_TERMIOS = syscall.TCSETS
+)
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+)
+
+// Error when reading a password from the terminal on a platform where we can't turn echo off.
+var errNoTerminal = errors.New("unable to read a password from the terminal on this platform; use --pass-file or --pass-command")
+
+// isTerminal returns false; we can't tell (or turn off echo) here, so passwords aren't prompted for.
+func isTerminal(f *os.File) bool { return false }
+
+// Read a line typed in at the terminal, with echo turned off. Unsupported here.
+func readNoEcho(f *os.File, in *bufio.Reader) (string, error) { return "", errNoTerminal }